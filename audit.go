@@ -0,0 +1,350 @@
+package wgrpcd
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// auditedMethods are the RPCs that change a device, its peers or the denylist.
+// Read-only RPCs are not audited.
+var auditedMethods = map[string]bool{
+	PermissionChangeListenPort: true,
+	PermissionCreatePeer:       true,
+	PermissionRekeyPeer:        true,
+	PermissionRemovePeer:       true,
+	PermissionImport:           true,
+	PermissionSuspendPeer:      true,
+	PermissionResumePeer:       true,
+	PermissionLiftRevocation:   true,
+}
+
+// AuditEntry is one record in the audit log.
+// Each entry holds the hash of the entry before it, so an entry cannot be changed, removed or reordered without breaking the chain.
+// Nothing records the last entry, so entries cut off the end of the log are not detected.
+type AuditEntry struct {
+	Sequence         uint64    `json:"sequence"`
+	Time             time.Time `json:"time"`
+	ClientIdentifier string    `json:"clientIdentifier"`
+	Method           string    `json:"method"`
+	DeviceName       string    `json:"deviceName,omitempty"`
+	PublicKeys       []string  `json:"publicKeys,omitempty"`
+	Code             string    `json:"code"`
+	Message          string    `json:"message,omitempty"`
+	PreviousHash     string    `json:"previousHash"`
+	Hash             string    `json:"hash,omitempty"`
+}
+
+// computeHash returns the hex SHA-256 of the entry's JSON encoding with the Hash field left out.
+func (a *AuditEntry) computeHash() (string, error) {
+	entry := *a
+	entry.Hash = ""
+	b, err := json.Marshal(&entry)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// proto converts an AuditEntry to its wire format.
+func (a *AuditEntry) proto() *AuditRecord {
+	return &AuditRecord{
+		Sequence:         a.Sequence,
+		Time:             a.Time.Unix(),
+		ClientIdentifier: a.ClientIdentifier,
+		Method:           a.Method,
+		DeviceName:       a.DeviceName,
+		PublicKeys:       a.PublicKeys,
+		Code:             a.Code,
+		Message:          a.Message,
+		PreviousHash:     a.PreviousHash,
+		Hash:             a.Hash,
+	}
+}
+
+// AuditQuery selects entries from an AuditLog.
+// Empty fields match every entry.
+// If Limit is greater than zero, only the Limit most recent matching entries are returned.
+type AuditQuery struct {
+	DeviceName       string
+	PublicKey        string
+	ClientIdentifier string
+	Method           string
+	Since            time.Time
+	Until            time.Time
+	Limit            int
+}
+
+// Matches returns true if the entry satisfies every field of the query.
+func (q *AuditQuery) Matches(entry *AuditEntry) bool {
+	if q.DeviceName != "" && entry.DeviceName != q.DeviceName {
+		return false
+	}
+	if q.ClientIdentifier != "" && entry.ClientIdentifier != q.ClientIdentifier {
+		return false
+	}
+	if q.Method != "" && entry.Method != q.Method {
+		return false
+	}
+	if !q.Since.IsZero() && entry.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && entry.Time.After(q.Until) {
+		return false
+	}
+	if q.PublicKey != "" {
+		for _, publicKey := range entry.PublicKeys {
+			if publicKey == q.PublicKey {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// AuditLog is an append-only, hash-chained record of mutating operations.
+// Append fills in the entry's Sequence, PreviousHash and Hash.
+// Query returns matching entries oldest first.
+type AuditLog interface {
+	Append(entry *AuditEntry) error
+	Query(query *AuditQuery) ([]*AuditEntry, error)
+}
+
+// FileAuditLog is an AuditLog that keeps entries in memory and appends each one to a file as a line of JSON.
+// A FileAuditLog with an empty filename is never written to disk.
+type FileAuditLog struct {
+	filename string
+	mutex    sync.Mutex
+	file     *os.File
+	entries  []*AuditEntry
+}
+
+// NewFileAuditLog returns a FileAuditLog loaded from filename.
+// A missing file is treated as an empty log and will be created on the first append.
+// The existing chain is verified first, and a log that has been edited, reordered or had entries removed from the middle is refused.
+func NewFileAuditLog(filename string) (*FileAuditLog, error) {
+	log := newMemoryAuditLog()
+	if filename == "" {
+		return log, nil
+	}
+	log.filename = filename
+
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = readAuditLog(file, func(entry *AuditEntry) {
+		log.entries = append(log.entries, entry)
+	})
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("audit log %s failed verification: %w", filename, err)
+	}
+
+	log.file = file
+	return log, nil
+}
+
+// newMemoryAuditLog returns a FileAuditLog that is never written to disk.
+func newMemoryAuditLog() *FileAuditLog {
+	return &FileAuditLog{
+		entries: []*AuditEntry{},
+	}
+}
+
+// Append chains an entry onto the end of the log and writes it to disk before returning.
+func (f *FileAuditLog) Append(entry *AuditEntry) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	e := *entry
+	e.Sequence = 1
+	e.PreviousHash = ""
+	if len(f.entries) > 0 {
+		last := f.entries[len(f.entries)-1]
+		e.Sequence = last.Sequence + 1
+		e.PreviousHash = last.Hash
+	}
+
+	hash, err := e.computeHash()
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+
+	if f.file != nil {
+		b, err := json.Marshal(&e)
+		if err != nil {
+			return err
+		}
+		_, err = f.file.Write(append(b, '\n'))
+		if err != nil {
+			return err
+		}
+		err = f.file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	f.entries = append(f.entries, &e)
+	*entry = e
+	return nil
+}
+
+// Query returns copies of the entries that match query, oldest first.
+func (f *FileAuditLog) Query(query *AuditQuery) ([]*AuditEntry, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	entries := []*AuditEntry{}
+	for _, entry := range f.entries {
+		if query.Matches(entry) {
+			e := *entry
+			e.PublicKeys = append([]string{}, entry.PublicKeys...)
+			entries = append(entries, &e)
+		}
+	}
+	if query.Limit > 0 && len(entries) > query.Limit {
+		entries = entries[len(entries)-query.Limit:]
+	}
+	return entries, nil
+}
+
+// Close closes the log file.
+func (f *FileAuditLog) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// VerifyAuditLog reads a log written by FileAuditLog and checks every entry's hash and its link to the entry before it.
+// It returns the number of entries verified, and an error naming the first line that fails verification.
+// A log truncated after any entry still verifies, so compare the count with a copy kept elsewhere to detect that.
+func VerifyAuditLog(r io.Reader) (int, error) {
+	count := 0
+	err := readAuditLog(r, func(*AuditEntry) {
+		count++
+	})
+	return count, err
+}
+
+// readAuditLog verifies the chain in r, calling fn with each entry in order.
+func readAuditLog(r io.Reader, fn func(entry *AuditEntry)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	var previous *AuditEntry
+	line := 0
+	for scanner.Scan() {
+		line++
+		var entry AuditEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid entry: %v", line, err)
+		}
+
+		hash, err := entry.computeHash()
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		if hash != entry.Hash {
+			return fmt.Errorf("line %d: entry %d has been modified: hash is %s, expected %s", line, entry.Sequence, entry.Hash, hash)
+		}
+
+		expectedSequence, expectedPreviousHash := uint64(1), ""
+		if previous != nil {
+			expectedSequence, expectedPreviousHash = previous.Sequence+1, previous.Hash
+		}
+		if entry.Sequence != expectedSequence {
+			return fmt.Errorf("line %d: entry %d is out of sequence, expected entry %d", line, entry.Sequence, expectedSequence)
+		}
+		if entry.PreviousHash != expectedPreviousHash {
+			return fmt.Errorf("line %d: entry %d does not follow the entry before it", line, entry.Sequence)
+		}
+
+		fn(&entry)
+		previous = &entry
+	}
+	return scanner.Err()
+}
+
+// auditor records the outcome of mutating RPCs in an AuditLog.
+type auditor struct {
+	log    AuditLog
+	logger Logger
+}
+
+// UnaryServerInterceptor appends an entry for every audited RPC once it has been handled.
+// It runs before the auth interceptor so requests that are refused are recorded too.
+func (a *auditor) UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !auditedMethods[info.FullMethod] {
+		return handler(ctx, req)
+	}
+
+	ctx, client := withRequestClient(ctx)
+	resp, err := handler(ctx, req)
+
+	st := status.Convert(err)
+	entry := &AuditEntry{
+		Time:             time.Now().UTC(),
+		ClientIdentifier: client.identifier,
+		Method:           info.FullMethod,
+		DeviceName:       auditDeviceName(req),
+		PublicKeys:       auditPublicKeys(req, resp),
+		Code:             st.Code().String(),
+		Message:          st.Message(),
+	}
+	auditErr := a.log.Append(entry)
+	if auditErr != nil {
+		// The change has already been made, so the client still gets its result.
+		a.logger.Error("failed to write audit log", logKeyClient, client.identifier, "method", info.FullMethod, logKeyError, auditErr)
+	}
+	return resp, err
+}
+
+// auditDeviceName returns the device an RPC acted on, if it names one.
+func auditDeviceName(req interface{}) string {
+	if r, ok := req.(interface{ GetDeviceName() string }); ok {
+		return r.GetDeviceName()
+	}
+	return ""
+}
+
+// auditPublicKeys returns the peer keys named in an RPC's request and, if it succeeded, its response.
+func auditPublicKeys(req, resp interface{}) []string {
+	publicKeys := []string{}
+	add := func(message interface{}) {
+		if m, ok := message.(interface{ GetPublicKey() string }); ok && m.GetPublicKey() != "" {
+			publicKeys = append(publicKeys, m.GetPublicKey())
+		}
+	}
+
+	add(req)
+	if r, ok := req.(*ImportRequest); ok {
+		for _, peer := range r.GetPeers() {
+			add(peer)
+		}
+	}
+	add(resp)
+	return publicKeys
+}
@@ -0,0 +1,102 @@
+package wgrpcd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestAuditLog appends entries for three requests to a new audit log and returns its lines.
+func writeTestAuditLog(t *testing.T) []string {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	log, err := NewFileAuditLog(filename)
+	if err != nil {
+		t.Fatalf("NewFileAuditLog: %v", err)
+	}
+	for _, method := range []string{PermissionCreatePeer, PermissionRekeyPeer, PermissionRemovePeer} {
+		err = log.Append(&AuditEntry{ClientIdentifier: "client", Method: method, DeviceName: "wg0", Code: "OK"})
+		if err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	err = log.Close()
+	if err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("failed to read audit log: %v", err)
+	}
+	return strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+}
+
+func TestAuditLogReopens(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	err := ioutil.WriteFile(filename, []byte(strings.Join(writeTestAuditLog(t), "\n")+"\n"), 0600)
+	if err != nil {
+		t.Fatalf("failed to write audit log: %v", err)
+	}
+
+	log, err := NewFileAuditLog(filename)
+	if err != nil {
+		t.Fatalf("NewFileAuditLog: %v", err)
+	}
+	defer log.Close()
+
+	entry := &AuditEntry{ClientIdentifier: "client", Method: PermissionImport, Code: "OK"}
+	err = log.Append(entry)
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if entry.Sequence != 4 {
+		t.Errorf("got sequence %d, want the chain continued at 4", entry.Sequence)
+	}
+
+	entries, err := log.Query(&AuditQuery{Method: PermissionRekeyPeer})
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Sequence != 2 {
+		t.Errorf("got entries %+v, want the RekeyPeer entry", entries)
+	}
+}
+
+func TestAuditLogDetectsTampering(t *testing.T) {
+	lines := writeTestAuditLog(t)
+	tests := map[string][]string{
+		"edited entry":    {lines[0], strings.Replace(lines[1], `"clientIdentifier":"client"`, `"clientIdentifier":"someone-else"`, 1), lines[2]},
+		"reordered entry": {lines[0], lines[2], lines[1]},
+		"removed entry":   {lines[0], lines[2]},
+		"removed first":   {lines[1], lines[2]},
+		"invalid entry":   {lines[0], "{", lines[2]},
+	}
+	for name, tampered := range tests {
+		contents := []byte(strings.Join(tampered, "\n") + "\n")
+
+		_, err := VerifyAuditLog(bytes.NewReader(contents))
+		if err == nil {
+			t.Errorf("%s: VerifyAuditLog accepted the log", name)
+		}
+
+		filename := filepath.Join(t.TempDir(), "audit.log")
+		err = ioutil.WriteFile(filename, contents, 0600)
+		if err != nil {
+			t.Fatalf("failed to write audit log: %v", err)
+		}
+		log, err := NewFileAuditLog(filename)
+		if err == nil {
+			log.Close()
+			t.Errorf("%s: NewFileAuditLog opened the log", name)
+		}
+	}
+
+	count, err := VerifyAuditLog(strings.NewReader(strings.Join(lines, "\n") + "\n"))
+	if err != nil || count != 3 {
+		t.Errorf("untouched log got %d entries and error %v, want 3 entries", count, err)
+	}
+}
@@ -0,0 +1,80 @@
+package wgrpcd
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/joncooperworks/grpcauth"
+	"google.golang.org/grpc/metadata"
+)
+
+// clientCertThumbprintKey is the metadata key identifyClientCert puts the verified client certificate's thumbprint under, so tokens bound to a certificate can be checked against it.
+// Any value the client sends itself is removed first.
+const clientCertThumbprintKey = "x-wgrpcd-client-cert-thumbprint"
+
+// CertificateThumbprint returns the base64url encoded SHA-256 hash of a certificate, as used in the x5t#S256 confirmation claim of RFC 8705 certificate-bound access tokens.
+func CertificateThumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// tokenConfirmation is the cnf claim of a certificate-bound token.
+type tokenConfirmation struct {
+	CertificateThumbprint string `json:"x5t#S256,omitempty"`
+}
+
+// boundCertificateThumbprint returns the x5t#S256 confirmation claim of the JWT in the authorization metadata, or an empty string if the token isn't bound to a certificate.
+// It doesn't verify the token, so it must only be called once the AuthFunc has accepted it.
+func boundCertificateThumbprint(md metadata.MD) string {
+	authorization := md.Get("authorization")
+	if len(authorization) != 1 {
+		return ""
+	}
+
+	parts := strings.Split(strings.TrimPrefix(authorization[0], "Bearer "), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+
+	claims := &struct {
+		Confirmation *tokenConfirmation `json:"cnf"`
+	}{}
+	if json.Unmarshal(payload, claims) != nil || claims.Confirmation == nil {
+		return ""
+	}
+	return claims.Confirmation.CertificateThumbprint
+}
+
+// bindTokensToCertificates wraps authFunc so a token carrying a cnf.x5t#S256 claim is only accepted over a connection using the client certificate it names, as in RFC 8705.
+// A token stolen from one client can't be replayed with another client's certificate.
+// If requireBinding is set, tokens that aren't bound to a certificate are refused too.
+func bindTokensToCertificates(authFunc grpcauth.AuthFunc, requireBinding bool) grpcauth.AuthFunc {
+	return func(md metadata.MD) (*grpcauth.AuthResult, error) {
+		result, err := authFunc(md)
+		if err != nil {
+			return nil, err
+		}
+
+		bound := boundCertificateThumbprint(md)
+		if bound == "" {
+			if requireBinding {
+				return nil, fmt.Errorf("token is not bound to a client certificate")
+			}
+			return result, nil
+		}
+
+		presented := md.Get(clientCertThumbprintKey)
+		if len(presented) != 1 || presented[0] != bound {
+			return nil, fmt.Errorf("token is bound to a different client certificate")
+		}
+		return result, nil
+	}
+}
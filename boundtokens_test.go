@@ -0,0 +1,102 @@
+package wgrpcd
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"log/slog"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestCertificateBoundTokens(t *testing.T) {
+	other := testCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "other-client"}}, nil)
+
+	tests := []struct {
+		name           string
+		bindTo         string
+		requireBinding bool
+		sentThumbprint string
+		want           codes.Code
+	}{
+		{name: "bound to the client's certificate", bindTo: "client", want: codes.NotFound},
+		{name: "bound to another certificate", bindTo: CertificateThumbprint(other.Leaf), want: codes.Unauthenticated},
+		{name: "unbound", want: codes.NotFound},
+		{name: "unbound with binding required", requireBinding: true, want: codes.Unauthenticated},
+		{name: "bound to the client's certificate with binding required", bindTo: "client", requireBinding: true, want: codes.NotFound},
+		// The client can't claim another certificate's thumbprint, since identifyClientCert replaces it with the one it connected with.
+		{name: "thumbprint sent by the client", bindTo: CertificateThumbprint(other.Leaf), sentThumbprint: CertificateThumbprint(other.Leaf), want: codes.Unauthenticated},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			publicKey, privateKey := newTestTokenKey(t)
+			serverConfig, clientConfig := testTLSConfigs(t)
+
+			bindTo := test.bindTo
+			if bindTo == "client" {
+				bindTo = CertificateThumbprint(clientConfig.Certificates[0].Leaf)
+			}
+			token, err := IssueSignedToken(privateKey, &SignedToken{
+				Subject:               "client",
+				Scopes:                []string{PermissionHealthCheck},
+				ExpiresAt:             time.Now().Add(time.Hour),
+				CertificateThumbprint: bindTo,
+			})
+			if err != nil {
+				t.Fatalf("IssueSignedToken: %v", err)
+			}
+
+			rpcServer, err := NewServer(&ServerConfig{
+				TLSConfig:                     serverConfig,
+				AuthFunc:                      NewSignedTokenAuth(publicKey, nil).AuthFunc,
+				Logger:                        slog.New(slog.NewTextHandler(ioutil.Discard, nil)),
+				AuthenticateHealthChecks:      true,
+				RequireCertificateBoundTokens: test.requireBinding,
+			})
+			if err != nil {
+				t.Fatalf("NewServer: %v", err)
+			}
+			conn := dialTest(t, serveTest(t, rpcServer), clientConfig, SignedTokenCredentials(token))
+
+			ctx := context.Background()
+			if test.sentThumbprint != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, clientCertThumbprintKey, test.sentThumbprint)
+			}
+			_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: "unknown"})
+			if status.Code(err) != test.want {
+				t.Errorf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestIdentifyClientCertStripsClientThumbprint(t *testing.T) {
+	// Without a verified certificate, as on a Unix socket, a thumbprint sent by the client must not survive to be checked against a bound token.
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(clientCertThumbprintKey, "forged"))
+	md, _ := metadata.FromIncomingContext(identifyClientCert(ctx))
+	if thumbprint := md.Get(clientCertThumbprintKey); len(thumbprint) != 0 {
+		t.Errorf("got thumbprint %q, want it removed", thumbprint)
+	}
+
+	authFunc := bindTokensToCertificates(staticAuth(PermissionHealthCheck), false)
+	_, err := authFunc(metadata.Join(md, metadata.Pairs("authorization", "Bearer "+boundTestToken(t, "forged"))))
+	if err == nil {
+		t.Error("token bound to a forged thumbprint was accepted")
+	}
+}
+
+// boundTestToken returns a JWT carrying only a cnf.x5t#S256 claim, for AuthFuncs that don't check signatures.
+func boundTestToken(t *testing.T, thumbprint string) string {
+	t.Helper()
+
+	_, privateKey := newTestTokenKey(t)
+	return signTestToken(t, privateKey, `{"alg":"EdDSA","typ":"JWT"}`, map[string]interface{}{
+		"cnf": map[string]string{"x5t#S256": thumbprint},
+	})
+}
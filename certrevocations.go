@@ -0,0 +1,188 @@
+package wgrpcd
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Reasons a client certificate is rejected, used to label metrics.
+const (
+	certRejectedCRL    = "crl"
+	certRejectedSerial = "denied_serial"
+)
+
+// ClientCertRevocationsConfig lists the CRLs and serial numbers of client certificates that must no longer be accepted.
+// DeniedSerials are hex serial numbers, like those printed by `openssl x509 -serial`, with or without colons.
+// Each CRL must be signed by a certificate in CACertFilename.
+// Metrics and Logger are optional.
+type ClientCertRevocationsConfig struct {
+	CACertFilename string
+	CRLFilenames   []string
+	DeniedSerials  []string
+	Metrics        *Metrics
+	Logger         Logger
+}
+
+// ClientCertRevocations rejects TLS handshakes from client certificates that have been revoked by a CRL or a serial number denylist.
+// It is loaded once and never changes, so reloading it means building a new one and swapping it into the tls.Config.
+type ClientCertRevocations struct {
+	crls    []*x509.RevocationList
+	serials map[string]bool
+	metrics *Metrics
+	logger  Logger
+}
+
+// NewClientCertRevocations loads and checks the signature of each CRL in config.
+// CRLs can be PEM or DER encoded, so the CRL files certstrap writes can be used directly.
+func NewClientCertRevocations(config *ClientCertRevocationsConfig) (*ClientCertRevocations, error) {
+	revocations := &ClientCertRevocations{
+		serials: map[string]bool{},
+		metrics: config.Metrics,
+		logger:  config.Logger,
+	}
+	if revocations.logger == nil {
+		revocations.logger = slog.Default()
+	}
+
+	for _, serial := range config.DeniedSerials {
+		parsed, err := parseSerial(serial)
+		if err != nil {
+			return nil, err
+		}
+		revocations.serials[parsed.String()] = true
+	}
+
+	if len(config.CRLFilenames) == 0 {
+		return revocations, nil
+	}
+
+	caCerts, err := loadCertificates(config.CACertFilename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CA certificate for CRLs: %w", err)
+	}
+	for _, filename := range config.CRLFilenames {
+		crl, err := loadCRL(filename, caCerts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load CRL %s: %w", filename, err)
+		}
+		if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+			// Refusing every client would be worse than using a stale list, so the CRL is still used.
+			revocations.logger.Warn("CRL is out of date, publish a new one", "file", filename, "next_update", crl.NextUpdate)
+		}
+		revocations.crls = append(revocations.crls, crl)
+	}
+	return revocations, nil
+}
+
+// VerifyPeerCertificate can be used as the VerifyPeerCertificate function of a tls.Config.
+// It runs after the client certificate chain has been verified against the CA, and rejects it if any certificate in the chain has been revoked.
+// The tls.Config must set ClientAuth to tls.RequireAndVerifyClientCert so there is always a verified chain to check.
+func (c *ClientCertRevocations) VerifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			reason := c.revoked(cert)
+			if reason == "" {
+				continue
+			}
+
+			c.logger.Warn("rejected revoked client certificate", "subject", cert.Subject.String(), "serial", formatSerial(cert.SerialNumber), "reason", reason)
+			if c.metrics != nil {
+				c.metrics.rejectedClientCerts.WithLabelValues(reason).Inc()
+			}
+			return fmt.Errorf("client certificate %s has been revoked", formatSerial(cert.SerialNumber))
+		}
+	}
+	return nil
+}
+
+// revoked returns why cert has been revoked, or an empty string if it hasn't.
+func (c *ClientCertRevocations) revoked(cert *x509.Certificate) string {
+	if c.serials[cert.SerialNumber.String()] {
+		return certRejectedSerial
+	}
+	for _, crl := range c.crls {
+		if !bytes.Equal(crl.RawIssuer, cert.RawIssuer) {
+			continue
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return certRejectedCRL
+			}
+		}
+	}
+	return ""
+}
+
+// parseSerial parses a hex serial number like "01:A3:FF", "01a3ff" or "0x01a3ff".
+func parseSerial(serial string) (*big.Int, error) {
+	s := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(serial)), "0x")
+	s = strings.ReplaceAll(s, ":", "")
+	parsed, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		return nil, fmt.Errorf("invalid certificate serial number %q, expected hex", serial)
+	}
+	return parsed, nil
+}
+
+// formatSerial formats a serial number the way openssl prints it.
+func formatSerial(serial *big.Int) string {
+	return fmt.Sprintf("%X", serial)
+}
+
+// loadCertificates returns every certificate in a PEM file.
+func loadCertificates(filename string) ([]*x509.Certificate, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, contents = pem.Decode(contents)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", filename)
+	}
+	return certs, nil
+}
+
+// loadCRL reads a PEM or DER CRL and checks it was signed by one of caCerts.
+func loadCRL(filename string, caCerts []*x509.Certificate) (*x509.RevocationList, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(contents); block != nil {
+		contents = block.Bytes
+	}
+
+	crl, err := x509.ParseRevocationList(contents)
+	if err != nil {
+		return nil, err
+	}
+	for _, ca := range caCerts {
+		if bytes.Equal(crl.RawIssuer, ca.RawSubject) && crl.CheckSignatureFrom(ca) == nil {
+			return crl, nil
+		}
+	}
+	return nil, fmt.Errorf("CRL is not signed by the CA")
+}
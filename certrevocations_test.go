@@ -0,0 +1,202 @@
+package wgrpcd
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a throwaway CA whose certificate is written to a file, for loading CRLs against.
+type testCA struct {
+	cert     *tls.Certificate
+	filename string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	cert := testCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "wgrpcd test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, nil)
+	filename := filepath.Join(t.TempDir(), "ca.pem")
+	err := ioutil.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0644)
+	if err != nil {
+		t.Fatalf("failed to write CA certificate: %v", err)
+	}
+	return &testCA{cert: cert, filename: filename}
+}
+
+func (c *testCA) issue(t *testing.T, commonName string, usage x509.ExtKeyUsage) *tls.Certificate {
+	t.Helper()
+
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{usage},
+	}
+	if usage == x509.ExtKeyUsageServerAuth {
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	return testCertificate(t, template, c.cert)
+}
+
+// writeCRL writes a CRL revoking serials, signed by the CA, and returns its filename.
+func (c *testCA) writeCRL(t *testing.T, pemEncoded bool, serials ...*big.Int) string {
+	t.Helper()
+
+	entries := []x509.RevocationListEntry{}
+	for _, serial := range serials {
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: serial, RevocationTime: time.Now()})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                time.Now().Add(-time.Minute),
+		NextUpdate:                time.Now().Add(time.Hour),
+		RevokedCertificateEntries: entries,
+	}, c.cert.Leaf, c.cert.PrivateKey.(crypto.Signer))
+	if err != nil {
+		t.Fatalf("failed to create CRL: %v", err)
+	}
+
+	contents := der
+	if pemEncoded {
+		contents = pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+	}
+	filename := filepath.Join(t.TempDir(), "ca.crl")
+	err = ioutil.WriteFile(filename, contents, 0644)
+	if err != nil {
+		t.Fatalf("failed to write CRL: %v", err)
+	}
+	return filename
+}
+
+// handshake connects client to a server using the CA's certificate and revocations, and returns the server's handshake error.
+func (c *testCA) handshake(t *testing.T, client *tls.Certificate, revocations *ClientCertRevocations) error {
+	t.Helper()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(c.cert.Leaf)
+	server := c.issue(t, "localhost", x509.ExtKeyUsageServerAuth)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+			Certificates: []tls.Certificate{*client},
+			RootCAs:      pool,
+			ServerName:   "127.0.0.1",
+			MinVersion:   tls.VersionTLS13,
+		})
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	serverConn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	defer serverConn.Close()
+
+	return tls.Server(serverConn, &tls.Config{
+		Certificates:          []tls.Certificate{*server},
+		ClientCAs:             pool,
+		ClientAuth:            tls.RequireAndVerifyClientCert,
+		VerifyPeerCertificate: revocations.VerifyPeerCertificate,
+		MinVersion:            tls.VersionTLS13,
+	}).Handshake()
+}
+
+func newTestRevocations(t *testing.T, config *ClientCertRevocationsConfig) (*ClientCertRevocations, error) {
+	config.Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	return NewClientCertRevocations(config)
+}
+
+func TestClientCertRevocationsRefuseRevokedCertificates(t *testing.T) {
+	ca := newTestCA(t)
+	revoked := ca.issue(t, "revoked", x509.ExtKeyUsageClientAuth)
+	denied := ca.issue(t, "denied", x509.ExtKeyUsageClientAuth)
+	valid := ca.issue(t, "valid", x509.ExtKeyUsageClientAuth)
+
+	for _, pemEncoded := range []bool{true, false} {
+		revocations, err := newTestRevocations(t, &ClientCertRevocationsConfig{
+			CACertFilename: ca.filename,
+			CRLFilenames:   []string{ca.writeCRL(t, pemEncoded, revoked.Leaf.SerialNumber)},
+			// Serials are accepted the way openssl prints them.
+			DeniedSerials: []string{formatSerialWithColons(denied.Leaf.SerialNumber)},
+		})
+		if err != nil {
+			t.Fatalf("NewClientCertRevocations with PEM %v: %v", pemEncoded, err)
+		}
+
+		if err := ca.handshake(t, revoked, revocations); err == nil {
+			t.Errorf("PEM %v: certificate revoked by the CRL completed a handshake", pemEncoded)
+		}
+		if err := ca.handshake(t, denied, revocations); err == nil {
+			t.Errorf("PEM %v: certificate with a denied serial completed a handshake", pemEncoded)
+		}
+		if err := ca.handshake(t, valid, revocations); err != nil {
+			t.Errorf("PEM %v: valid certificate was refused: %v", pemEncoded, err)
+		}
+	}
+}
+
+func TestClientCertRevocationsRefuseCRLsFromOtherCAs(t *testing.T) {
+	ca := newTestCA(t)
+	// The other CA has the same name, so only the signature tells them apart.
+	other := newTestCA(t)
+
+	_, err := newTestRevocations(t, &ClientCertRevocationsConfig{
+		CACertFilename: ca.filename,
+		CRLFilenames:   []string{other.writeCRL(t, true, big.NewInt(1))},
+	})
+	if err == nil {
+		t.Error("CRL signed by another CA was loaded")
+	}
+}
+
+func TestParseSerial(t *testing.T) {
+	for _, serial := range []string{"01:A3:FF", "01a3ff", "0x01A3FF", " 1a3ff "} {
+		parsed, err := parseSerial(serial)
+		if err != nil {
+			t.Errorf("parseSerial(%q): %v", serial, err)
+			continue
+		}
+		if parsed.Int64() != 0x01a3ff {
+			t.Errorf("parseSerial(%q) = %X, want 1A3FF", serial, parsed)
+		}
+	}
+	if _, err := parseSerial("not hex"); err == nil {
+		t.Error("invalid serial was parsed")
+	}
+}
+
+// formatSerialWithColons formats a serial number like openssl x509 -serial with colons between bytes.
+func formatSerialWithColons(serial *big.Int) string {
+	formatted := ""
+	for i, b := range serial.Bytes() {
+		if i > 0 {
+			formatted += ":"
+		}
+		formatted += fmt.Sprintf("%02X", b)
+	}
+	return formatted
+}
@@ -5,14 +5,20 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"time"
 
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
 )
 
 var (
@@ -40,6 +46,8 @@ type PeerConfigInfo struct {
 	PublicKey       string
 	AllowedIPs      []net.IPNet
 	ServerPublicKey string
+	Name            string
+	Labels          map[string]string
 }
 
 // Client interfaces with the wgrpcd API and marshals data between Go and the underlying transport.
@@ -47,8 +55,10 @@ type Client struct {
 	GrpcAddress       string
 	TLSCredentials    credentials.TransportCredentials
 	AdditionalOptions []grpc.DialOption
+	TracerProvider    trace.TracerProvider
 	conn              *grpc.ClientConn
 	wireguardClient   WireguardRPCClient
+	tracer            trace.Tracer
 }
 
 // NewClient returns a client configured with client TLS certificates and the wgrpcd instance URL.
@@ -84,6 +94,7 @@ func NewClient(config *ClientConfig) (*Client, error) {
 		GrpcAddress:       config.GRPCAddress,
 		TLSCredentials:    cred,
 		AdditionalOptions: config.Options,
+		TracerProvider:    config.TracerProvider,
 	}, nil
 }
 
@@ -98,6 +109,14 @@ func (c *Client) Connect() error {
 			Time:    KeepaliveTime,
 			Timeout: KeepaliveTimeout,
 		}),
+		grpc.WithChainUnaryInterceptor(otelgrpc.UnaryClientInterceptor(
+			otelgrpc.WithTracerProvider(tracerProvider(c.TracerProvider)),
+			otelgrpc.WithPropagators(tracePropagator()),
+		)),
+		grpc.WithChainStreamInterceptor(otelgrpc.StreamClientInterceptor(
+			otelgrpc.WithTracerProvider(tracerProvider(c.TracerProvider)),
+			otelgrpc.WithPropagators(tracePropagator()),
+		)),
 	}
 	opts = append(opts, c.AdditionalOptions...)
 
@@ -108,6 +127,7 @@ func (c *Client) Connect() error {
 
 	c.conn = conn
 	c.wireguardClient = NewWireguardRPCClient(c.conn)
+	c.tracer = tracerProvider(c.TracerProvider).Tracer(tracerName)
 	return nil
 }
 
@@ -118,6 +138,12 @@ func (c *Client) checkConnection() {
 	}
 }
 
+// startSpan starts the client-side span for a Client method.
+// The gRPC call it makes, and any credentials it fetches, become children of this span.
+func (c *Client) startSpan(ctx context.Context, method string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return c.tracer.Start(ctx, "wgrpcd.Client/"+method, trace.WithAttributes(attributes...))
+}
+
 // Close closes a client connection and frees the resouces associated with it.
 func (c *Client) Close() error {
 	if c.conn != nil {
@@ -128,13 +154,22 @@ func (c *Client) Close() error {
 
 // CreatePeer calls the server's CreatePeer method and returns a Wireguard config for the newly created peer.
 func (c *Client) CreatePeer(ctx context.Context, deviceName string, allowedIPs []net.IPNet) (*PeerConfigInfo, error) {
+	return c.CreateLabelledPeer(ctx, deviceName, allowedIPs, "", nil)
+}
+
+// CreateLabelledPeer creates a new peer with a friendly name and labels that the server stores alongside it.
+func (c *Client) CreateLabelledPeer(ctx context.Context, deviceName string, allowedIPs []net.IPNet, name string, labels map[string]string) (*PeerConfigInfo, error) {
 	c.checkConnection()
+	ctx, span := c.startSpan(ctx, "CreatePeer", deviceAttribute.String(deviceName))
 
 	request := &CreatePeerRequest{
 		AllowedIPs: IPNetsToStrings(allowedIPs),
 		DeviceName: deviceName,
+		Name:       name,
+		Labels:     labels,
 	}
 	response, err := c.wireguardClient.CreatePeer(ctx, request)
+	endSpan(span, err)
 	if err != nil {
 		return nil, err
 	}
@@ -143,6 +178,8 @@ func (c *Client) CreatePeer(ctx context.Context, deviceName string, allowedIPs [
 		PublicKey:       response.GetPublicKey(),
 		AllowedIPs:      allowedIPs,
 		ServerPublicKey: response.GetServerPublicKey(),
+		Name:            response.GetName(),
+		Labels:          response.GetLabels(),
 	}
 	return peerConfigInfo, nil
 }
@@ -150,6 +187,7 @@ func (c *Client) CreatePeer(ctx context.Context, deviceName string, allowedIPs [
 // RekeyPeer wraps the server's RekeyPeer operation and returns the updated credentials.
 func (c *Client) RekeyPeer(ctx context.Context, deviceName string, oldPublicKey wgtypes.Key, allowedIPs []net.IPNet) (*PeerConfigInfo, error) {
 	c.checkConnection()
+	ctx, span := c.startSpan(ctx, "RekeyPeer", deviceAttribute.String(deviceName))
 
 	request := &RekeyPeerRequest{
 		PublicKey:  oldPublicKey.String(),
@@ -157,6 +195,7 @@ func (c *Client) RekeyPeer(ctx context.Context, deviceName string, oldPublicKey
 		DeviceName: deviceName,
 	}
 	response, err := c.wireguardClient.RekeyPeer(ctx, request)
+	endSpan(span, err)
 	if err != nil {
 		return nil, err
 	}
@@ -166,6 +205,8 @@ func (c *Client) RekeyPeer(ctx context.Context, deviceName string, oldPublicKey
 		PublicKey:       response.GetPublicKey(),
 		ServerPublicKey: response.GetServerPublicKey(),
 		AllowedIPs:      allowedIPs,
+		Name:            response.GetName(),
+		Labels:          response.GetLabels(),
 	}
 	return peerConfigInfo, nil
 }
@@ -173,12 +214,14 @@ func (c *Client) RekeyPeer(ctx context.Context, deviceName string, oldPublicKey
 // ChangeListenPort changes a wgrpcd's Wireguard server's listen port
 func (c *Client) ChangeListenPort(ctx context.Context, deviceName string, listenPort int) (int32, error) {
 	c.checkConnection()
+	ctx, span := c.startSpan(ctx, "ChangeListenPort", deviceAttribute.String(deviceName))
 
 	request := &ChangeListenPortRequest{
 		ListenPort: int32(listenPort),
 		DeviceName: deviceName,
 	}
 	response, err := c.wireguardClient.ChangeListenPort(ctx, request)
+	endSpan(span, err)
 	if err != nil {
 		return 0, err
 	}
@@ -189,12 +232,14 @@ func (c *Client) ChangeListenPort(ctx context.Context, deviceName string, listen
 // RemovePeer removes a peer from the Wireguard server and revokes its access.
 func (c *Client) RemovePeer(ctx context.Context, deviceName string, publicKey wgtypes.Key) (bool, error) {
 	c.checkConnection()
+	ctx, span := c.startSpan(ctx, "RemovePeer", deviceAttribute.String(deviceName))
 
 	request := &RemovePeerRequest{
 		PublicKey:  publicKey.String(),
 		DeviceName: deviceName,
 	}
 	response, err := c.wireguardClient.RemovePeer(ctx, request)
+	endSpan(span, err)
 	if err != nil {
 		return false, err
 	}
@@ -202,14 +247,118 @@ func (c *Client) RemovePeer(ctx context.Context, deviceName string, publicKey wg
 	return response.GetRemoved(), nil
 }
 
+// SuspendPeer takes a peer off the Wireguard server without forgetting its configuration.
+func (c *Client) SuspendPeer(ctx context.Context, deviceName string, publicKey wgtypes.Key) (bool, error) {
+	c.checkConnection()
+	ctx, span := c.startSpan(ctx, "SuspendPeer", deviceAttribute.String(deviceName))
+
+	request := &SuspendPeerRequest{
+		PublicKey:  publicKey.String(),
+		DeviceName: deviceName,
+	}
+	response, err := c.wireguardClient.SuspendPeer(ctx, request)
+	endSpan(span, err)
+	if err != nil {
+		return false, err
+	}
+
+	return response.GetSuspended(), nil
+}
+
+// ResumePeer restores a suspended peer with the same key and configuration it had before it was suspended.
+func (c *Client) ResumePeer(ctx context.Context, deviceName string, publicKey wgtypes.Key) (bool, error) {
+	c.checkConnection()
+	ctx, span := c.startSpan(ctx, "ResumePeer", deviceAttribute.String(deviceName))
+
+	request := &ResumePeerRequest{
+		PublicKey:  publicKey.String(),
+		DeviceName: deviceName,
+	}
+	response, err := c.wireguardClient.ResumePeer(ctx, request)
+	endSpan(span, err)
+	if err != nil {
+		return false, err
+	}
+
+	return response.GetResumed(), nil
+}
+
+// ListRevokedKeys returns the public keys the server refuses to add back to any device.
+func (c *Client) ListRevokedKeys(ctx context.Context) ([]*RevokedKey, error) {
+	c.checkConnection()
+	ctx, span := c.startSpan(ctx, "ListRevokedKeys")
+
+	request := &ListRevokedKeysRequest{}
+	response, err := c.wireguardClient.ListRevokedKeys(ctx, request)
+	endSpan(span, err)
+	if err != nil {
+		return []*RevokedKey{}, err
+	}
+
+	return response.GetRevokedKeys(), nil
+}
+
+// LiftRevocation removes a public key from the server's denylist so it can be imported again.
+func (c *Client) LiftRevocation(ctx context.Context, publicKey wgtypes.Key) (bool, error) {
+	c.checkConnection()
+	ctx, span := c.startSpan(ctx, "LiftRevocation")
+
+	request := &LiftRevocationRequest{
+		PublicKey: publicKey.String(),
+	}
+	response, err := c.wireguardClient.LiftRevocation(ctx, request)
+	endSpan(span, err)
+	if err != nil {
+		return false, err
+	}
+
+	return response.GetLifted(), nil
+}
+
+// QueryAudit returns the entries in the server's audit log that match query, oldest first.
+func (c *Client) QueryAudit(ctx context.Context, query *AuditQuery) ([]*AuditRecord, error) {
+	c.checkConnection()
+	ctx, span := c.startSpan(ctx, "QueryAudit")
+
+	request := &QueryAuditRequest{
+		DeviceName:       query.DeviceName,
+		PublicKey:        query.PublicKey,
+		ClientIdentifier: query.ClientIdentifier,
+		Method:           query.Method,
+		Limit:            int32(query.Limit),
+	}
+	if !query.Since.IsZero() {
+		request.Since = query.Since.Unix()
+	}
+	if !query.Until.IsZero() {
+		request.Until = query.Until.Unix()
+	}
+	response, err := c.wireguardClient.QueryAudit(ctx, request)
+	endSpan(span, err)
+	if err != nil {
+		return []*AuditRecord{}, err
+	}
+
+	return response.GetRecords(), nil
+}
+
 // ListPeers shows all peers authorized to connect to a Wireguard instance.
 func (c *Client) ListPeers(ctx context.Context, deviceName string) ([]*Peer, error) {
+	return c.ListPeersMatching(ctx, deviceName, "")
+}
+
+// ListPeersMatching shows the peers on a Wireguard instance whose labels match labelSelector.
+// See LabelSelector for the selector syntax.
+func (c *Client) ListPeersMatching(ctx context.Context, deviceName string, labelSelector string) ([]*Peer, error) {
 	c.checkConnection()
+	ctx, span := c.startSpan(ctx, "ListPeers", deviceAttribute.String(deviceName))
 
 	request := &ListPeersRequest{
-		DeviceName: deviceName,
+		DeviceName:    deviceName,
+		LabelSelector: labelSelector,
 	}
 	response, err := c.wireguardClient.ListPeers(ctx, request)
+	endSpan(span, err)
 	if err != nil {
 		return []*Peer{}, err
 	}
@@ -217,15 +366,62 @@ func (c *Client) ListPeers(ctx context.Context, deviceName string) ([]*Peer, err
 	return response.GetPeers(), nil
 }
 
+// WatchPeers streams changes to a device's peers matching labelSelector to fn until ctx is cancelled, the server ends the stream or fn returns an error.
+// The first events are a snapshot of every peer, ending with a PeerEvent_SYNCED event.
+// If counterInterval is at least a second, every peer's counters are also sent that often.
+func (c *Client) WatchPeers(ctx context.Context, deviceName string, labelSelector string, counterInterval time.Duration, fn func(event *PeerEvent) error) error {
+	c.checkConnection()
+	ctx, span := c.startSpan(ctx, "WatchPeers", deviceAttribute.String(deviceName))
+
+	err := c.watchPeers(ctx, deviceName, labelSelector, counterInterval, fn)
+	if status.Code(err) == codes.Canceled {
+		err = nil
+	}
+	endSpan(span, err)
+	return err
+}
+
+func (c *Client) watchPeers(ctx context.Context, deviceName string, labelSelector string, counterInterval time.Duration, fn func(event *PeerEvent) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	request := &WatchPeersRequest{
+		DeviceName:      deviceName,
+		LabelSelector:   labelSelector,
+		CounterInterval: int64(counterInterval / time.Second),
+	}
+	stream, err := c.wireguardClient.WatchPeers(ctx, request)
+	if err != nil {
+		return err
+	}
+
+	for {
+		event, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = fn(event)
+		if err != nil {
+			return err
+		}
+	}
+}
+
 // ImportPeers creates a new peer from a list of peers.
 func (c *Client) ImportPeers(ctx context.Context, deviceName string, peers []*ImportedPeer) error {
 	c.checkConnection()
+	ctx, span := c.startSpan(ctx, "Import", deviceAttribute.String(deviceName))
 
 	request := &ImportRequest{
 		DeviceName: deviceName,
 		Peers: peers,
 	}
 	_, err := c.wireguardClient.Import(ctx, request)
+	endSpan(span, err)
 	if err != nil {
 		return err
 	}
@@ -236,9 +432,11 @@ func (c *Client) ImportPeers(ctx context.Context, deviceName string, peers []*Im
 // Devices returns all Wireguard interfaces controllable by wgrpcd.
 func (c *Client) Devices(ctx context.Context) ([]string, error) {
 	c.checkConnection()
+	ctx, span := c.startSpan(ctx, "Devices")
 
 	request := &DevicesRequest{}
 	response, err := c.wireguardClient.Devices(ctx, request)
+	endSpan(span, err)
 	if err != nil {
 		return []string{}, err
 	}
@@ -0,0 +1,205 @@
+package wgrpcd
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/joncooperworks/grpcauth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// clientCertIdentityKey is the metadata key identifyClientCert puts the verified client certificate's identity under, for ClientCertAuth to read.
+// An AuthFunc only sees request metadata, so this is how the TLS connection's identity reaches it.
+// Any value the client sends itself is removed first.
+const clientCertIdentityKey = "x-wgrpcd-client-cert-identity"
+
+// ClientCertIdentity returns the identity of a client certificate.
+// It is the certificate's SPIFFE ID if it has one, then its Common Name, then its first DNS name or email address SAN.
+func ClientCertIdentity(cert *x509.Certificate) string {
+	for _, uri := range cert.URIs {
+		if uri.Scheme == "spiffe" {
+			return uri.String()
+		}
+	}
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
+
+// identifyClientCert replaces clientCertIdentityKey and clientCertThumbprintKey in the request metadata with the identity and thumbprint of the client's verified certificate.
+// It must run before the auth interceptor.
+func identifyClientCert(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		md = metadata.MD{}
+	}
+	md = md.Copy()
+	md.Delete(clientCertIdentityKey)
+	md.Delete(clientCertThumbprintKey)
+
+	p, ok := peer.FromContext(ctx)
+	if ok {
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.VerifiedChains) > 0 {
+			cert := tlsInfo.State.VerifiedChains[0][0]
+			identity := ClientCertIdentity(cert)
+			if identity != "" {
+				md.Set(clientCertIdentityKey, identity)
+			}
+			md.Set(clientCertThumbprintKey, CertificateThumbprint(cert))
+		}
+	}
+	return metadata.NewIncomingContext(ctx, md)
+}
+
+// identifyClientCertUnary is identifyClientCert for unary RPCs.
+func identifyClientCertUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return handler(identifyClientCert(ctx), req)
+}
+
+// identifyClientCertStream is identifyClientCert for streaming RPCs.
+func identifyClientCertStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &contextStream{ServerStream: stream, ctx: identifyClientCert(stream.Context())})
+}
+
+// ClientCertGrant gives the client certificates whose identity matches Identity the permissions in Permissions.
+// Identity is a pattern as used by path.Match, so "spiffe://example.com/ops/*" matches every ops workload.
+type ClientCertGrant struct {
+	Identity    string   `json:"identity"`
+	Permissions []string `json:"permissions"`
+}
+
+// ClientCertPolicy maps client certificate identities to the permissions they hold.
+// A client gets the permissions of every grant its identity matches, and none if it matches no grant.
+type ClientCertPolicy struct {
+	Grants []*ClientCertGrant `json:"grants"`
+}
+
+// LoadClientCertPolicy reads a ClientCertPolicy from a JSON file.
+func LoadClientCertPolicy(filename string) (*ClientCertPolicy, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &ClientCertPolicy{}
+	err = json.Unmarshal(contents, policy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client certificate policy %s: %w", filename, err)
+	}
+	err = policy.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid client certificate policy %s: %w", filename, err)
+	}
+	return policy, nil
+}
+
+// Validate checks every grant has a valid identity pattern and at least one permission, and that any device patterns are valid.
+func (p *ClientCertPolicy) Validate() error {
+	for i, grant := range p.Grants {
+		if grant.Identity == "" {
+			return fmt.Errorf("grant %d has no identity", i)
+		}
+		_, err := path.Match(grant.Identity, "")
+		if err != nil {
+			return fmt.Errorf("grant %d has invalid identity pattern %q: %w", i, grant.Identity, err)
+		}
+		if len(grant.Permissions) == 0 {
+			return fmt.Errorf("grant %d for %s has no permissions", i, grant.Identity)
+		}
+		for _, permission := range grant.Permissions {
+			_, err := path.Match(parseScope(permission).devicePattern, "")
+			if err != nil {
+				return fmt.Errorf("grant %d for %s has invalid device pattern in %q: %w", i, grant.Identity, permission, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Permissions returns the sorted permissions granted to identity.
+func (p *ClientCertPolicy) Permissions(identity string) []string {
+	permissions := map[string]bool{}
+	for _, grant := range p.Grants {
+		matched, _ := path.Match(grant.Identity, identity)
+		if !matched {
+			continue
+		}
+		for _, permission := range grant.Permissions {
+			permissions[permission] = true
+		}
+	}
+
+	sorted := make([]string, 0, len(permissions))
+	for permission := range permissions {
+		sorted = append(sorted, permission)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// ClientCertAuth authenticates clients by their mTLS client certificate rather than a token, and authorizes them with a ClientCertPolicy.
+// Unlike NoAuth, each client is identified by its own certificate and holds only the permissions the policy grants it.
+// The server's tls.Config must require and verify client certificates.
+type ClientCertAuth struct {
+	mutex  sync.RWMutex
+	policy *ClientCertPolicy
+}
+
+// NewClientCertAuth returns a ClientCertAuth using policy.
+func NewClientCertAuth(policy *ClientCertPolicy) (*ClientCertAuth, error) {
+	auth := &ClientCertAuth{}
+	err := auth.SetPolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+// SetPolicy replaces the policy used for requests that haven't been authenticated yet.
+func (c *ClientCertAuth) SetPolicy(policy *ClientCertPolicy) error {
+	err := policy.Validate()
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.policy = policy
+	return nil
+}
+
+// AuthFunc is a grpcauth.AuthFunc that identifies the client by its certificate.
+// Clients whose certificate matches no grant are authenticated with no permissions, so they are refused with PermissionDenied naming their identity.
+func (c *ClientCertAuth) AuthFunc(md metadata.MD) (*grpcauth.AuthResult, error) {
+	identities := md.Get(clientCertIdentityKey)
+	if len(identities) != 1 {
+		return nil, fmt.Errorf("no verified client certificate identity")
+	}
+
+	c.mutex.RLock()
+	policy := c.policy
+	c.mutex.RUnlock()
+
+	return &grpcauth.AuthResult{
+		ClientIdentifier: identities[0],
+		Timestamp:        time.Now(),
+		Permissions:      policy.Permissions(identities[0]),
+	}, nil
+}
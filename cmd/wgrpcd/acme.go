@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACME challenge types wgrpcd can answer.
+const (
+	acmeChallengeTLSALPN = "tls-alpn-01"
+	acmeChallengeHTTP    = "http-01"
+)
+
+// enabled reports whether the server certificate comes from an ACME CA instead of tls.certFile and tls.keyFile.
+func (a ACMEConfig) enabled() bool {
+	return len(a.Domains) > 0
+}
+
+// newACMEManager returns an autocert.Manager that obtains and renews certificates for the configured domains, storing them and the account key in the cache directory.
+func newACMEManager(config ACMEConfig, logger *slog.Logger) (*autocert.Manager, error) {
+	client := &acme.Client{DirectoryURL: config.DirectoryURL}
+	if config.DirectoryCACert != "" {
+		// A local test CA like Pebble serves its directory with a certificate from its own root.
+		caCert, err := ioutil.ReadFile(config.DirectoryCACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ACME directory CA certificate: %w", err)
+		}
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("failed to append ACME directory CA certificate to certificate pool")
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: certPool},
+			},
+		}
+	}
+
+	return &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       &acmeCache{Cache: autocert.DirCache(config.CacheDir), logger: logger},
+		HostPolicy:  autocert.HostWhitelist(config.Domains...),
+		RenewBefore: config.RenewBefore,
+		Client:      client,
+		Email:       config.Email,
+	}, nil
+}
+
+// acmeCache logs the certificates autocert stores, so operators can see when one was obtained or renewed and when it expires.
+type acmeCache struct {
+	autocert.Cache
+	logger *slog.Logger
+}
+
+// Put stores data under key, logging it if it is a certificate rather than the account key.
+func (c *acmeCache) Put(ctx context.Context, key string, data []byte) error {
+	err := c.Cache.Put(ctx, key, data)
+	if err != nil {
+		c.logger.Error("failed to store ACME certificate", "key", key, "error", err)
+		return err
+	}
+	if expiry := earliestExpiry(data); !expiry.IsZero() {
+		c.logger.Info("obtained ACME certificate", "domain", strings.TrimSuffix(key, "+rsa"), "expires", expiry)
+	}
+	return nil
+}
+
+// isACMEChallenge reports whether a ClientHello comes from an ACME CA validating a tls-alpn-01 challenge.
+// CAs offer only the acme-tls/1 protocol, which no gRPC client does.
+func isACMEChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
+
+// acmeHello prepares a ClientHello for autocert.Manager.GetCertificate.
+// Clients dialing by IP address don't send a server name, so they get the certificate of defaultDomain.
+// Every TLSv1.3 client supports ECDSA, so wgrpcd always asks for an ECDSA certificate rather than letting autocert guess from the cipher suites.
+func acmeHello(hello *tls.ClientHelloInfo, defaultDomain string) *tls.ClientHelloInfo {
+	prepared := *hello
+	if prepared.ServerName == "" {
+		prepared.ServerName = defaultDomain
+	}
+	prepared.CipherSuites = append([]uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, hello.CipherSuites...)
+	return &prepared
+}
+
+// obtainACMECertificates asks for the certificate of every domain up front, so problems with the CA or challenges show up in the logs at startup rather than on a client's first connection.
+// It must be called once wgrpcd is serving, so the CA can reach the challenge.
+func (c *certReloader) obtainACMECertificates(domains []string) {
+	for _, domain := range domains {
+		start := time.Now()
+		cert, err := c.getCertificate(&tls.ClientHelloInfo{ServerName: domain})
+		if err != nil {
+			c.logger.Error("failed to obtain ACME certificate", "domain", domain, "error", err)
+			continue
+		}
+		c.logger.Debug("ACME certificate ready", "domain", domain, "expires", cert.Leaf.NotAfter, "took", time.Since(start).Round(time.Millisecond))
+	}
+}
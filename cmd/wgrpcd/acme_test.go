@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// writeACMECertificate stores a self-signed certificate for domain in cacheDir the way autocert does, so it is served without asking a CA.
+// It returns the certificate's PEM.
+func writeACMECertificate(t *testing.T, cacheDir, domain string) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: domain},
+		DNSNames:              []string{domain},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	data := append(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), certPEM...)
+	err = os.MkdirAll(cacheDir, 0700)
+	if err != nil {
+		t.Fatalf("failed to create ACME cache: %v", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(cacheDir, domain), data, 0600)
+	if err != nil {
+		t.Fatalf("failed to write ACME certificate: %v", err)
+	}
+	return certPEM
+}
+
+// newTestACMEReloader returns a certReloader for domain whose ACME certificate is already in its cache.
+func newTestACMEReloader(t *testing.T, domain string) *certReloader {
+	t.Helper()
+
+	dir := t.TempDir()
+	cacheDir := filepath.Join(dir, "acme")
+	caCertFile := filepath.Join(dir, "ca.pem")
+	err := ioutil.WriteFile(caCertFile, writeACMECertificate(t, cacheDir, domain), 0600)
+	if err != nil {
+		t.Fatalf("failed to write CA certificate: %v", err)
+	}
+
+	reloader, err := newCertReloader(TLSConfig{
+		CACertFile: caCertFile,
+		ACME: ACMEConfig{
+			Domains:   []string{domain},
+			CacheDir:  cacheDir,
+			Challenge: acmeChallengeTLSALPN,
+		},
+	}, slog.New(slog.NewTextHandler(ioutil.Discard, nil)), nil)
+	if err != nil {
+		t.Fatalf("newCertReloader: %v", err)
+	}
+	return reloader
+}
+
+func TestACMECertificateIsServed(t *testing.T) {
+	reloader := newTestACMEReloader(t, "wgrpcd.example.com")
+
+	for _, serverName := range []string{"wgrpcd.example.com", ""} {
+		hello := &tls.ClientHelloInfo{
+			ServerName:      serverName,
+			SupportedProtos: []string{"h2"},
+			CipherSuites:    []uint16{tls.TLS_AES_128_GCM_SHA256},
+		}
+		config, err := reloader.getConfigForClient(hello)
+		if err != nil {
+			t.Fatalf("getConfigForClient(%q): %v", serverName, err)
+		}
+		if config.ClientAuth != tls.RequireAndVerifyClientCert {
+			t.Errorf("server name %q got a config that doesn't require client certificates", serverName)
+		}
+
+		cert, err := config.GetCertificate(hello)
+		if err != nil {
+			t.Fatalf("GetCertificate(%q): %v", serverName, err)
+		}
+		if cert.Leaf == nil || cert.Leaf.Subject.CommonName != "wgrpcd.example.com" {
+			t.Errorf("server name %q got certificate %v, want the one for wgrpcd.example.com", serverName, cert.Leaf)
+		}
+	}
+}
+
+func TestACMEChallengeGetsChallengeConfig(t *testing.T) {
+	reloader := newTestACMEReloader(t, "wgrpcd.example.com")
+
+	config, err := reloader.getConfigForClient(&tls.ClientHelloInfo{
+		ServerName:      "wgrpcd.example.com",
+		SupportedProtos: []string{acme.ALPNProto},
+	})
+	if err != nil {
+		t.Fatalf("getConfigForClient: %v", err)
+	}
+	if config != reloader.acmeChallenge {
+		t.Error("acme-tls/1 hello did not get the challenge config")
+	}
+	if config.ClientAuth != tls.NoClientCert {
+		t.Error("challenge config requires a client certificate the CA doesn't have")
+	}
+}
+
+func TestIsACMEChallenge(t *testing.T) {
+	tests := []struct {
+		protos    []string
+		challenge bool
+	}{
+		{[]string{acme.ALPNProto}, true},
+		{[]string{"h2"}, false},
+		{[]string{"h2", acme.ALPNProto}, false},
+		{nil, false},
+	}
+	for _, test := range tests {
+		challenge := isACMEChallenge(&tls.ClientHelloInfo{SupportedProtos: test.protos})
+		if challenge != test.challenge {
+			t.Errorf("isACMEChallenge(%q) = %v, want %v", test.protos, challenge, test.challenge)
+		}
+	}
+}
+
+func TestACMEHello(t *testing.T) {
+	hello := &tls.ClientHelloInfo{CipherSuites: []uint16{tls.TLS_AES_128_GCM_SHA256}}
+	prepared := acmeHello(hello, "wgrpcd.example.com")
+	if prepared.ServerName != "wgrpcd.example.com" {
+		t.Errorf("got server name %q, want the default domain", prepared.ServerName)
+	}
+	if prepared.CipherSuites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("got cipher suites %v, want an ECDSA suite first", prepared.CipherSuites)
+	}
+	if hello.ServerName != "" || len(hello.CipherSuites) != 1 {
+		t.Error("acmeHello modified the original hello")
+	}
+
+	prepared = acmeHello(&tls.ClientHelloInfo{ServerName: "other.example.com"}, "wgrpcd.example.com")
+	if prepared.ServerName != "other.example.com" {
+		t.Errorf("got server name %q, want the client's", prepared.ServerName)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/joncooperworks/wgrpcd"
+)
+
+// auditCommand runs `wgrpcd audit <subcommand>`.
+func auditCommand(config *Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: wgrpcd audit verify [-audit-log filename]")
+	}
+
+	switch args[0] {
+	case "verify":
+		return auditVerifyCommand(config, args[1:])
+	default:
+		return fmt.Errorf("unknown audit command %q. Allowed: (verify)", args[0])
+	}
+}
+
+// auditVerifyCommand checks the hash chain of an audit log written by wgrpcd and reports the first entry that has been changed.
+func auditVerifyCommand(config *Config, args []string) error {
+	flags := flag.NewFlagSet("audit verify", flag.ExitOnError)
+	filename := flags.String("audit-log", config.Stores.AuditLog, "-audit-log is the audit log to verify.")
+	flags.Parse(args)
+
+	file, err := os.Open(*filename)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	count, err := wgrpcd.VerifyAuditLog(file)
+	if err != nil {
+		return fmt.Errorf("%s failed verification after %d good entries: %w", *filename, count, err)
+	}
+
+	fmt.Printf("%s: %d entries verified\n", *filename, count)
+	return nil
+}
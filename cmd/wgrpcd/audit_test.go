@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/joncooperworks/wgrpcd"
+)
+
+func TestAuditVerifyCommand(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	log, err := wgrpcd.NewFileAuditLog(filename)
+	if err != nil {
+		t.Fatalf("NewFileAuditLog: %v", err)
+	}
+	for _, method := range []string{wgrpcd.PermissionCreatePeer, wgrpcd.PermissionRemovePeer} {
+		err = log.Append(&wgrpcd.AuditEntry{ClientIdentifier: "client", Method: method, Code: "OK"})
+		if err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	log.Close()
+
+	err = auditCommand(defaultConfig(), []string{"verify", "-audit-log", filename})
+	if err != nil {
+		t.Errorf("untouched log failed verification: %v", err)
+	}
+
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("failed to read audit log: %v", err)
+	}
+	edited := strings.Replace(string(contents), wgrpcd.PermissionRemovePeer, wgrpcd.PermissionRekeyPeer, 1)
+	err = ioutil.WriteFile(filename, []byte(edited), 0600)
+	if err != nil {
+		t.Fatalf("failed to write audit log: %v", err)
+	}
+
+	err = auditCommand(defaultConfig(), []string{"verify", "-audit-log", filename})
+	if err == nil || !strings.Contains(err.Error(), "after 1 good entries") {
+		t.Errorf("edited log got %v, want it to fail after the first entry", err)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"fmt"
+)
+
+// runCommand runs the subcommand named by the first argument left after the server's flags are parsed.
+func runCommand(config *Config, args []string) error {
+	switch args[0] {
+	case "audit":
+		return auditCommand(config, args[1:])
+	case "config":
+		return configCommand(config, args[1:])
+	case "pki":
+		return pkiCommand(config, args[1:])
+	case "token":
+		return tokenCommand(config, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q. Allowed: (audit, config, pki, token)", args[0])
+	}
+}
@@ -0,0 +1,599 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joncooperworks/wgrpcd"
+	"golang.org/x/crypto/acme/autocert"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of the wgrpcd command.
+// It is read from the -config file, then overridden by WGRPCD_ environment variables, then by flags.
+type Config struct {
+	ListenAddress   string                  `yaml:"listenAddress"`
+	UnixSocket      UnixSocketConfig        `yaml:"unixSocket"`
+	ShutdownTimeout time.Duration           `yaml:"shutdownTimeout"`
+	Reflection      bool                    `yaml:"reflection"`
+	TLS             TLSConfig               `yaml:"tls"`
+	Auth            AuthConfig              `yaml:"auth"`
+	Stores          StoresConfig            `yaml:"stores"`
+	Webhooks        WebhookConfig           `yaml:"webhooks"`
+	RateLimits      *wgrpcd.RateLimitConfig `yaml:"rateLimits"`
+	Health          HealthConfig            `yaml:"health"`
+	Metrics         MetricsConfig           `yaml:"metrics"`
+	Tracing         TracingConfig           `yaml:"tracing"`
+	Log             LogConfig               `yaml:"log"`
+
+	// sources records where the configuration came from, so validation errors can point at it.
+	sources configSources `yaml:"-"`
+}
+
+// TLSConfig holds the server's certificate, the CA client certificates are signed with, and the client certificates that have been revoked.
+// The files are checked for changes every WatchInterval, or only reloaded on SIGHUP if it is zero.
+// If ACME lists any domains, the server's certificate is obtained from an ACME CA instead of CertFile and KeyFile.
+type TLSConfig struct {
+	CertFile      string        `yaml:"certFile"`
+	KeyFile       string        `yaml:"keyFile"`
+	CACertFile    string        `yaml:"caCertFile"`
+	CRLFiles      []string      `yaml:"crlFiles"`
+	DeniedSerials []string      `yaml:"deniedSerials"`
+	WatchInterval time.Duration `yaml:"watchInterval"`
+	ACME          ACMEConfig    `yaml:"acme"`
+}
+
+// ACMEConfig obtains and renews the server's certificate for Domains from the ACME CA at DirectoryURL, like Let's Encrypt.
+// The CA validates the domains with a tls-alpn-01 challenge on the gRPC port, or an http-01 challenge on HTTPAddress.
+type ACMEConfig struct {
+	Domains         []string      `yaml:"domains"`
+	Email           string        `yaml:"email"`
+	DirectoryURL    string        `yaml:"directoryURL"`
+	DirectoryCACert string        `yaml:"directoryCACert"`
+	CacheDir        string        `yaml:"cacheDir"`
+	Challenge       string        `yaml:"challenge"`
+	HTTPAddress     string        `yaml:"httpAddress"`
+	RenewBefore     time.Duration `yaml:"renewBefore"`
+}
+
+// UnixSocketConfig enables a Unix socket listener alongside the TCP one.
+// Processes connecting to it don't use TLS, and are authorized by their user and group with the Policy file.
+type UnixSocketConfig struct {
+	Path   string `yaml:"path"`
+	Mode   string `yaml:"mode"`
+	Group  string `yaml:"group"`
+	Policy string `yaml:"policy"`
+}
+
+// AuthConfig enables OAuth2 authentication of clients with an OpenID provider, tokens signed by a local key, or authorization of client certificates by a policy file.
+type AuthConfig struct {
+	OpenIDProvider      string `yaml:"openidProvider"`
+	OpenIDDomain        string `yaml:"openidDomain"`
+	OpenIDAPIIdentifier string `yaml:"openidAPIIdentifier"`
+	OpenIDScopeClaim    string `yaml:"openidScopeClaim"`
+	OpenIDRoles         bool   `yaml:"openidRoles"`
+	ClientCertPolicy    string `yaml:"clientCertPolicy"`
+	TokenPublicKey      string `yaml:"tokenPublicKey"`
+	RevokedTokens       string `yaml:"revokedTokens"`
+	RequireBoundTokens  bool   `yaml:"requireBoundTokens"`
+}
+
+// StoresConfig holds the files wgrpcd keeps its state in.
+type StoresConfig struct {
+	Peers       string `yaml:"peers"`
+	Revocations string `yaml:"revocations"`
+	AuditLog    string `yaml:"auditLog"`
+}
+
+// WebhookConfig lists webhooks inline in Endpoints, or in a separate JSON File.
+type WebhookConfig struct {
+	File      string            `yaml:"file"`
+	Outbox    string            `yaml:"outbox"`
+	Endpoints []*wgrpcd.Webhook `yaml:"endpoints"`
+}
+
+// HealthConfig configures the gRPC health service.
+type HealthConfig struct {
+	ManagedDevices []string `yaml:"managedDevices"`
+	Authenticate   bool     `yaml:"authenticate"`
+}
+
+// MetricsConfig enables the Prometheus metrics endpoint.
+type MetricsConfig struct {
+	Address string `yaml:"address"`
+}
+
+// TracingConfig enables OpenTelemetry tracing.
+type TracingConfig struct {
+	OTLPEndpoint string `yaml:"otlpEndpoint"`
+	OTLPInsecure bool   `yaml:"otlpInsecure"`
+}
+
+// LogConfig configures the structured logger.
+type LogConfig struct {
+	Format string `yaml:"format"`
+	Level  string `yaml:"level"`
+}
+
+// defaultConfig returns the configuration wgrpcd uses when nothing overrides it.
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddress:   "localhost:15002",
+		ShutdownTimeout: 30 * time.Second,
+		UnixSocket: UnixSocketConfig{
+			Mode: "0660",
+		},
+		TLS: TLSConfig{
+			CertFile:      "servercert.pem",
+			KeyFile:       "serverkey.pem",
+			CACertFile:    "cacert.pem",
+			WatchInterval: 10 * time.Second,
+			ACME: ACMEConfig{
+				DirectoryURL: autocert.DefaultACMEDirectory,
+				CacheDir:     "acme",
+				Challenge:    acmeChallengeTLSALPN,
+				HTTPAddress:  ":80",
+			},
+		},
+		Stores: StoresConfig{
+			Peers:       "peers.json",
+			Revocations: "revoked.json",
+			AuditLog:    "audit.log",
+		},
+		Webhooks: WebhookConfig{
+			Outbox: "webhook-outbox.json",
+		},
+		Log: LogConfig{
+			Format: "text",
+			Level:  "info",
+		},
+	}
+}
+
+// configFlag is a flag that overrides a field of the configuration file.
+// Each one can also be set by an environment variable named by envName.
+type configFlag struct {
+	name  string
+	path  string
+	value flag.Value
+	usage string
+}
+
+// configFlags returns the flags that override c's fields.
+func configFlags(c *Config) []configFlag {
+	return []configFlag{
+		{"listen-address", "listenAddress", (*stringValue)(&c.ListenAddress), "-listen-address specifies the host:port pair to listen on."},
+		{"unix-socket", "unixSocket.path", (*stringValue)(&c.UnixSocket.Path), "-unix-socket also listens on a Unix socket at this path, authorizing local processes by their user and group instead of TLS."},
+		{"unix-socket-mode", "unixSocket.mode", (*stringValue)(&c.UnixSocket.Mode), "-unix-socket-mode is the octal file mode of the Unix socket."},
+		{"unix-socket-group", "unixSocket.group", (*stringValue)(&c.UnixSocket.Group), "-unix-socket-group is the group that owns the Unix socket."},
+		{"unix-socket-policy", "unixSocket.policy", (*stringValue)(&c.UnixSocket.Policy), "-unix-socket-policy is the JSON file granting permissions to the users and groups that connect to the Unix socket."},
+		{"shutdown-timeout", "shutdownTimeout", (*durationValue)(&c.ShutdownTimeout), "-shutdown-timeout is how long wgrpcd waits for requests in flight to finish after SIGINT or SIGTERM."},
+		{"reflection", "reflection", (*boolValue)(&c.Reflection), "-reflection enables gRPC server reflection for tools like grpcurl."},
+		{"cert-filename", "tls.certFile", (*stringValue)(&c.TLS.CertFile), "-cert-filename server's SSL certificate."},
+		{"key-filename", "tls.keyFile", (*stringValue)(&c.TLS.KeyFile), "-key-filename is the server's SSL key."},
+		{"ca-cert", "tls.caCertFile", (*stringValue)(&c.TLS.CACertFile), "-ca-cert is the CA that client certificates will be signed with."},
+		{"crl-files", "tls.crlFiles", (*listValue)(&c.TLS.CRLFiles), "-crl-files is a comma-separated list of CRLs, signed by the CA, listing revoked client certificates."},
+		{"denied-serials", "tls.deniedSerials", (*listValue)(&c.TLS.DeniedSerials), "-denied-serials is a comma-separated list of hex serial numbers of client certificates to reject."},
+		{"tls-watch-interval", "tls.watchInterval", (*durationValue)(&c.TLS.WatchInterval), "-tls-watch-interval is how often wgrpcd checks the certificate, key and CA files for changes. Zero only reloads them on SIGHUP."},
+		{"acme-domains", "tls.acme.domains", (*listValue)(&c.TLS.ACME.Domains), "-acme-domains is a comma-separated list of domains to obtain the server's certificate for from an ACME CA, instead of using -cert-filename and -key-filename."},
+		{"acme-email", "tls.acme.email", (*stringValue)(&c.TLS.ACME.Email), "-acme-email is the contact address given to the ACME CA, which it uses to warn about problems with certificates."},
+		{"acme-directory-url", "tls.acme.directoryURL", (*stringValue)(&c.TLS.ACME.DirectoryURL), "-acme-directory-url is the ACME CA's directory. Use a staging or local test CA's directory while testing."},
+		{"acme-directory-ca-cert", "tls.acme.directoryCACert", (*stringValue)(&c.TLS.ACME.DirectoryCACert), "-acme-directory-ca-cert is the CA certificate the ACME directory is served with, for local test CAs like Pebble."},
+		{"acme-cache-dir", "tls.acme.cacheDir", (*stringValue)(&c.TLS.ACME.CacheDir), "-acme-cache-dir is the directory wgrpcd keeps its ACME account key and certificates in."},
+		{"acme-challenge", "tls.acme.challenge", (*stringValue)(&c.TLS.ACME.Challenge), "-acme-challenge is how the ACME CA validates the domains. Allowed: (tls-alpn-01, http-01)"},
+		{"acme-http-address", "tls.acme.httpAddress", (*stringValue)(&c.TLS.ACME.HTTPAddress), "-acme-http-address is the host:port pair wgrpcd answers http-01 challenges on."},
+		{"acme-renew-before", "tls.acme.renewBefore", (*durationValue)(&c.TLS.ACME.RenewBefore), "-acme-renew-before is how long before expiry the certificate is renewed. Zero renews 30 days before."},
+		{"openid-provider", "auth.openidProvider", (*stringValue)(&c.Auth.OpenIDProvider), "-openid-provider enables OAuth2 authentication of clients using OpenID provider's machine-to-machine auth. Allowed: (aws, auth0, oidc)"},
+		{"openid-domain", "auth.openidDomain", (*stringValue)(&c.Auth.OpenIDDomain), "-openid-domain is the domain the OpenID provider gives when setting up a machine-to-machine app. With -openid-provider oidc, it is the issuer URL the provider's configuration is discovered from."},
+		{"openid-api-identifier", "auth.openidAPIIdentifier", (*stringValue)(&c.Auth.OpenIDAPIIdentifier), "-openid-api-identifier is the API identifier given by the OpenID provider when setting up a machine-to-machine app."},
+		{"openid-scope-claim", "auth.openidScopeClaim", (*stringValue)(&c.Auth.OpenIDScopeClaim), "-openid-scope-claim is the token claim holding a client's permissions with -openid-provider oidc, like scp or realm_access.roles. (default scope)"},
+		{"openid-roles", "auth.openidRoles", (*boolValue)(&c.Auth.OpenIDRoles), "-openid-roles lets the OpenID provider's scopes grant roles, method names without the API identifier and device scopes. Without it, clients need the full name of each method as a scope."},
+		{"client-cert-policy", "auth.clientCertPolicy", (*stringValue)(&c.Auth.ClientCertPolicy), "-client-cert-policy identifies clients by their certificate and grants them the permissions in this JSON policy file, instead of giving every client all permissions."},
+		{"token-public-key", "auth.tokenPublicKey", (*stringValue)(&c.Auth.TokenPublicKey), "-token-public-key authenticates clients with tokens issued by wgrpcd token issue, verified against this Ed25519 public key."},
+		{"revoked-tokens", "auth.revokedTokens", (*stringValue)(&c.Auth.RevokedTokens), "-revoked-tokens is the file listing the IDs of revoked tokens, one per line."},
+		{"require-bound-tokens", "auth.requireBoundTokens", (*boolValue)(&c.Auth.RequireBoundTokens), "-require-bound-tokens refuses tokens that aren't bound to the client's certificate with a cnf.x5t#S256 claim."},
+		{"peer-store", "stores.peers", (*stringValue)(&c.Stores.Peers), "-peer-store is the file wgrpcd keeps peer names, labels and suspended peers in."},
+		{"revocation-store", "stores.revocations", (*stringValue)(&c.Stores.Revocations), "-revocation-store is the file wgrpcd keeps the denylist of revoked public keys in."},
+		{"audit-log", "stores.auditLog", (*stringValue)(&c.Stores.AuditLog), "-audit-log is the file wgrpcd appends the hash-chained audit log of changes to."},
+		{"webhooks", "webhooks.file", (*stringValue)(&c.Webhooks.File), "-webhooks enables webhooks for peer events, configured by a JSON file listing each webhook's url, secret and events."},
+		{"webhook-outbox", "webhooks.outbox", (*stringValue)(&c.Webhooks.Outbox), "-webhook-outbox is the file wgrpcd keeps undelivered webhook events in."},
+		{"managed-devices", "health.managedDevices", (*listValue)(&c.Health.ManagedDevices), "-managed-devices is a comma-separated list of Wireguard devices that must exist for health checks to pass."},
+		{"authenticate-health-checks", "health.authenticate", (*boolValue)(&c.Health.Authenticate), "-authenticate-health-checks makes gRPC health checks authenticate like any other request."},
+		{"metrics-address", "metrics.address", (*stringValue)(&c.Metrics.Address), "-metrics-address enables a Prometheus metrics endpoint at http://host:port/metrics on the given host:port pair."},
+		{"otlp-endpoint", "tracing.otlpEndpoint", (*stringValue)(&c.Tracing.OTLPEndpoint), "-otlp-endpoint enables OpenTelemetry tracing and sends spans to the OTLP gRPC collector at this host:port pair."},
+		{"otlp-insecure", "tracing.otlpInsecure", (*boolValue)(&c.Tracing.OTLPInsecure), "-otlp-insecure sends spans to the OTLP collector without TLS."},
+		{"log-format", "log.format", (*stringValue)(&c.Log.Format), "-log-format sets the format of log records. Allowed: (text, json)"},
+		{"log-level", "log.level", (*stringValue)(&c.Log.Level), "-log-level sets the lowest level that will be logged. Allowed: (debug, info, warn, error)"},
+	}
+}
+
+// envName returns the environment variable that overrides a flag, like WGRPCD_LISTEN_ADDRESS for -listen-address.
+func envName(flagName string) string {
+	return "WGRPCD_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadConfig parses the command line and returns the configuration, along with the arguments left after the flags.
+// Defaults are overridden by the -config file, then by environment variables, then by flags that were set on the command line.
+func loadConfig(args []string) (*Config, []string, error) {
+	flags := flag.NewFlagSet("wgrpcd", flag.ExitOnError)
+	configFilename := flags.String("config", os.Getenv(envName("config")), "-config is a YAML configuration file. Flags and WGRPCD_ environment variables override it.")
+	for _, f := range configFlags(defaultConfig()) {
+		// Use the standard flag types where there is one, so usage shows their types and defaults.
+		switch v := f.value.(type) {
+		case *stringValue:
+			flags.StringVar((*string)(v), f.name, string(*v), f.usage)
+		case *boolValue:
+			flags.BoolVar((*bool)(v), f.name, bool(*v), f.usage)
+		case *durationValue:
+			flags.DurationVar((*time.Duration)(v), f.name, time.Duration(*v), f.usage)
+		default:
+			flags.Var(f.value, f.name, f.usage)
+		}
+	}
+	flags.Parse(args)
+
+	config := defaultConfig()
+	config.sources.overrides = map[string]string{}
+	if *configFilename != "" {
+		err := config.loadFile(*configFilename)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	overrides := configFlags(config)
+	for _, f := range overrides {
+		value, ok := os.LookupEnv(envName(f.name))
+		if !ok {
+			continue
+		}
+		err := f.value.Set(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid %s: %w", envName(f.name), err)
+		}
+		config.sources.overrides[f.path] = envName(f.name)
+	}
+
+	byName := map[string]configFlag{}
+	for _, f := range overrides {
+		byName[f.name] = f
+	}
+	flags.Visit(func(set *flag.Flag) {
+		f, ok := byName[set.Name]
+		if !ok {
+			return
+		}
+		// The flag was already parsed once, so its value is known to be valid.
+		f.value.Set(set.Value.String())
+		config.sources.overrides[f.path] = "-" + f.name
+	})
+
+	return config, flags.Args(), nil
+}
+
+// loadFile reads a YAML configuration file over c.
+// Unknown fields are errors, so typos don't silently fall back to defaults.
+func (c *Config) loadFile(filename string) error {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(contents))
+	decoder.KnownFields(true)
+	err = decoder.Decode(c)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+
+	var root yaml.Node
+	err = yaml.Unmarshal(contents, &root)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	c.sources.filename = filename
+	c.sources.root = &root
+	return nil
+}
+
+// Validate checks every field and returns all of the problems it finds, each pointing at the line or override that set the field.
+func (c *Config) Validate() error {
+	v := &configValidator{sources: &c.sources}
+
+	_, _, err := net.SplitHostPort(c.ListenAddress)
+	v.check(err == nil, "listenAddress", "must be a host:port pair, got %q", c.ListenAddress)
+	v.check(c.ShutdownTimeout > 0, "shutdownTimeout", "must be greater than zero")
+
+	if c.UnixSocket.Path != "" {
+		_, err := parseSocketMode(c.UnixSocket.Mode)
+		v.check(err == nil, "unixSocket.mode", "must be an octal file mode like 0660, got %q", c.UnixSocket.Mode)
+		v.check(c.UnixSocket.Policy != "", "unixSocket.policy", "is required when unixSocket.path is set")
+	}
+
+	if c.TLS.ACME.enabled() {
+		for i, domain := range c.TLS.ACME.Domains {
+			v.check(domain != "" && net.ParseIP(domain) == nil, fmt.Sprintf("tls.acme.domains.%d", i), "must be a domain name, got %q", domain)
+		}
+		directoryURL, err := url.Parse(c.TLS.ACME.DirectoryURL)
+		v.check(err == nil && (directoryURL.Scheme == "https" || directoryURL.Scheme == "http") && directoryURL.Host != "", "tls.acme.directoryURL", "must be an http or https URL, got %q", c.TLS.ACME.DirectoryURL)
+		v.check(c.TLS.ACME.CacheDir != "", "tls.acme.cacheDir", "is required when tls.acme.domains is set")
+		switch c.TLS.ACME.Challenge {
+		case acmeChallengeTLSALPN:
+		case acmeChallengeHTTP:
+			_, _, err := net.SplitHostPort(c.TLS.ACME.HTTPAddress)
+			v.check(err == nil, "tls.acme.httpAddress", "must be a host:port pair, got %q", c.TLS.ACME.HTTPAddress)
+		default:
+			v.check(false, "tls.acme.challenge", "must be one of (%s, %s), got %q", acmeChallengeTLSALPN, acmeChallengeHTTP, c.TLS.ACME.Challenge)
+		}
+		v.check(c.TLS.ACME.RenewBefore >= 0, "tls.acme.renewBefore", "must not be negative")
+	} else {
+		v.check(c.TLS.CertFile != "", "tls.certFile", "is required")
+		v.check(c.TLS.KeyFile != "", "tls.keyFile", "is required")
+	}
+	v.check(c.TLS.CACertFile != "", "tls.caCertFile", "is required")
+	for i, filename := range c.TLS.CRLFiles {
+		v.check(filename != "", fmt.Sprintf("tls.crlFiles.%d", i), "must not be empty")
+	}
+	for i, serial := range c.TLS.DeniedSerials {
+		_, err := wgrpcd.NewClientCertRevocations(&wgrpcd.ClientCertRevocationsConfig{DeniedSerials: []string{serial}})
+		v.check(err == nil, fmt.Sprintf("tls.deniedSerials.%d", i), "%v", err)
+	}
+	v.check(c.TLS.WatchInterval >= 0, "tls.watchInterval", "must not be negative")
+
+	switch c.Auth.OpenIDProvider {
+	case "":
+	case "aws", "auth0", "oidc":
+		v.check(c.Auth.OpenIDDomain != "", "auth.openidDomain", "is required when auth.openidProvider is set")
+		v.check(c.Auth.OpenIDAPIIdentifier != "", "auth.openidAPIIdentifier", "is required when auth.openidProvider is set")
+	default:
+		v.check(false, "auth.openidProvider", "must be one of (aws, auth0, oidc), got %q", c.Auth.OpenIDProvider)
+	}
+	v.check(c.Auth.OpenIDScopeClaim == "" || c.Auth.OpenIDProvider == "oidc", "auth.openidScopeClaim", "can only be used with auth.openidProvider oidc")
+	v.check(!c.Auth.OpenIDRoles || c.Auth.OpenIDProvider != "", "auth.openidRoles", "can only be used with auth.openidProvider")
+	v.check(c.Auth.OpenIDProvider == "" || c.Auth.ClientCertPolicy == "", "auth.clientCertPolicy", "can't be used with auth.openidProvider")
+	v.check(c.Auth.TokenPublicKey == "" || (c.Auth.OpenIDProvider == "" && c.Auth.ClientCertPolicy == ""), "auth.tokenPublicKey", "can't be used with auth.openidProvider or auth.clientCertPolicy")
+	v.check(c.Auth.RevokedTokens == "" || c.Auth.TokenPublicKey != "", "auth.revokedTokens", "can only be used with auth.tokenPublicKey")
+	v.check(!c.Auth.RequireBoundTokens || c.Auth.OpenIDProvider != "" || c.Auth.TokenPublicKey != "", "auth.requireBoundTokens", "needs auth.openidProvider or auth.tokenPublicKey")
+
+	v.check(c.Webhooks.File == "" || len(c.Webhooks.Endpoints) == 0, "webhooks.endpoints", "can't be used with webhooks.file")
+	for i, webhook := range c.Webhooks.Endpoints {
+		err := webhook.Validate()
+		v.check(err == nil, fmt.Sprintf("webhooks.endpoints.%d", i), "%v", err)
+	}
+
+	if c.RateLimits != nil {
+		if c.RateLimits.Default != nil {
+			err := (&wgrpcd.RateLimitConfig{Default: c.RateLimits.Default}).Validate()
+			v.check(err == nil, "rateLimits.default", "%v", errors.Unwrap(err))
+		}
+		methods := map[string]bool{}
+		for _, permission := range wgrpcd.RolePermissions(wgrpcd.RoleAdmin) {
+			methods[permission] = true
+			methods[strings.TrimPrefix(permission, "/wgrpcd.WireguardRPC/")] = true
+		}
+		names := make([]string, 0, len(c.RateLimits.Methods))
+		for method := range c.RateLimits.Methods {
+			names = append(names, method)
+		}
+		sort.Strings(names)
+		for _, method := range names {
+			limit := c.RateLimits.Methods[method]
+			path := "rateLimits.methods." + method
+			v.check(methods[method], path, "is not a wgrpcd method")
+			err := (&wgrpcd.RateLimitConfig{Methods: map[string]*wgrpcd.RateLimit{method: limit}}).Validate()
+			v.check(err == nil, path, "%v", errors.Unwrap(err))
+		}
+		v.check(c.RateLimits.MaxConcurrentMutations >= 0, "rateLimits.maxConcurrentMutations", "must not be negative")
+	}
+
+	for i, device := range c.Health.ManagedDevices {
+		v.check(device != "", fmt.Sprintf("health.managedDevices.%d", i), "must not be empty")
+	}
+
+	if c.Metrics.Address != "" {
+		_, _, err := net.SplitHostPort(c.Metrics.Address)
+		v.check(err == nil, "metrics.address", "must be a host:port pair, got %q", c.Metrics.Address)
+	}
+	if c.Tracing.OTLPEndpoint != "" {
+		_, _, err := net.SplitHostPort(c.Tracing.OTLPEndpoint)
+		v.check(err == nil, "tracing.otlpEndpoint", "must be a host:port pair, got %q", c.Tracing.OTLPEndpoint)
+	}
+
+	v.check(c.Log.Format == "text" || c.Log.Format == "json", "log.format", "must be one of (text, json), got %q", c.Log.Format)
+	_, err = parseLogLevel(c.Log.Level)
+	v.check(err == nil, "log.level", "%v", err)
+
+	return v.err()
+}
+
+// webhooks returns the webhooks listed in the configuration file, or in the separate webhooks file.
+func (c *Config) webhooks() ([]*wgrpcd.Webhook, error) {
+	if c.Webhooks.File != "" {
+		return wgrpcd.LoadWebhooks(c.Webhooks.File)
+	}
+	return c.Webhooks.Endpoints, nil
+}
+
+// configCommand runs `wgrpcd config <subcommand>`.
+func configCommand(config *Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: wgrpcd [-config filename] config validate")
+	}
+
+	switch args[0] {
+	case "validate":
+		return configValidateCommand(config)
+	default:
+		return fmt.Errorf("unknown config command %q. Allowed: (validate)", args[0])
+	}
+}
+
+// configValidateCommand checks the configuration wgrpcd would run with, after environment variables and flags are applied, without starting the server.
+func configValidateCommand(config *Config) error {
+	err := config.Validate()
+	if err != nil {
+		return err
+	}
+
+	source := "defaults"
+	if config.sources.filename != "" {
+		source = config.sources.filename
+	}
+	fmt.Printf("%s: configuration is valid\n", source)
+	return nil
+}
+
+// configSources records the file, and the environment variables and flags, a Config was built from.
+type configSources struct {
+	filename  string
+	root      *yaml.Node
+	overrides map[string]string
+}
+
+// describe returns where the field at path was set, like "config.yaml:12: log.level" or "-log-level".
+func (s *configSources) describe(path string) string {
+	if override, ok := s.overrides[path]; ok {
+		return override
+	}
+	if line := s.line(path); line > 0 {
+		return fmt.Sprintf("%s:%d: %s", s.filename, line, path)
+	}
+	return path
+}
+
+// line returns the line of the field at a dotted path in the configuration file, or 0 if the file doesn't set it.
+// Numeric path elements index into sequences.
+func (s *configSources) line(path string) int {
+	if s.root == nil || len(s.root.Content) == 0 {
+		return 0
+	}
+
+	node := s.root.Content[0]
+	for _, element := range strings.Split(path, ".") {
+		var next *yaml.Node
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == element {
+					next = node.Content[i+1]
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			index, err := strconv.Atoi(element)
+			if err == nil && index >= 0 && index < len(node.Content) {
+				next = node.Content[index]
+			}
+		}
+		if next == nil {
+			return 0
+		}
+		node = next
+	}
+	return node.Line
+}
+
+// configValidator collects validation errors.
+type configValidator struct {
+	sources *configSources
+	errors  []string
+}
+
+// check records an error about the field at path unless ok is true.
+func (v *configValidator) check(ok bool, path string, format string, args ...interface{}) {
+	if ok {
+		return
+	}
+	v.errors = append(v.errors, fmt.Sprintf("%s: %s", v.sources.describe(path), fmt.Sprintf(format, args...)))
+}
+
+func (v *configValidator) err() error {
+	if len(v.errors) == 0 {
+		return nil
+	}
+	return errors.New("invalid configuration:\n  " + strings.Join(v.errors, "\n  "))
+}
+
+// parseLogLevel parses a level name like "info" or "debug".
+func parseLogLevel(level string) (slog.Level, error) {
+	var logLevel slog.Level
+	err := logLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		return 0, fmt.Errorf("must be one of (debug, info, warn, error), got %q", level)
+	}
+	return logLevel, nil
+}
+
+// stringValue, boolValue, durationValue and listValue are flag.Values that write straight into a Config.
+type stringValue string
+
+func (s *stringValue) Set(value string) error {
+	*s = stringValue(value)
+	return nil
+}
+
+func (s *stringValue) String() string {
+	return string(*s)
+}
+
+type boolValue bool
+
+func (b *boolValue) Set(value string) error {
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	*b = boolValue(parsed)
+	return nil
+}
+
+func (b *boolValue) String() string {
+	return strconv.FormatBool(bool(*b))
+}
+
+// IsBoolFlag lets boolean flags be set without a value, like -reflection.
+func (b *boolValue) IsBoolFlag() bool {
+	return true
+}
+
+type durationValue time.Duration
+
+func (d *durationValue) Set(value string) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = durationValue(parsed)
+	return nil
+}
+
+func (d *durationValue) String() string {
+	return time.Duration(*d).String()
+}
+
+// listValue is a comma-separated list.
+type listValue []string
+
+func (l *listValue) Set(value string) error {
+	*l = nil
+	if value != "" {
+		*l = strings.Split(value, ",")
+	}
+	return nil
+}
+
+func (l *listValue) String() string {
+	return strings.Join(*l, ",")
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Key types pki can generate. Every TLSv1.3 implementation supports ECDSA P-256, so it is the default.
+const (
+	pkiKeyECDSA   = "ecdsa"
+	pkiKeyEd25519 = "ed25519"
+)
+
+// pkiCommand runs `wgrpcd pki <subcommand>`.
+// Its defaults are the files the configuration points the server at, so the certificates it writes work without further flags.
+func pkiCommand(config *Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: wgrpcd pki (init|server|client|revoke) [flags]")
+	}
+
+	switch args[0] {
+	case "init":
+		return pkiInitCommand(config, args[1:])
+	case "server":
+		return pkiServerCommand(config, args[1:])
+	case "client":
+		return pkiClientCommand(config, args[1:])
+	case "revoke":
+		return pkiRevokeCommand(config, args[1:])
+	default:
+		return fmt.Errorf("unknown pki command %q. Allowed: (init, server, client, revoke)", args[0])
+	}
+}
+
+// pkiInitCommand creates a CA for client and server certificates, and an empty CRL signed by it.
+func pkiInitCommand(config *Config, args []string) error {
+	flags := flag.NewFlagSet("pki init", flag.ExitOnError)
+	caCertFile := flags.String("ca-cert", config.TLS.CACertFile, "-ca-cert is where the CA certificate is written.")
+	caKeyFile := flags.String("ca-key", "cakey.pem", "-ca-key is where the CA's private key is written. Keep it offline once certificates are issued.")
+	crlFile := flags.String("crl", defaultCRLFile(config), "-crl is where the CA's certificate revocation list is written.")
+	name := flags.String("name", "wgrpcd CA", "-name is the CA's common name.")
+	keyType := flags.String("key-type", pkiKeyECDSA, "-key-type is the type of the CA's key. Allowed: (ecdsa, ed25519)")
+	validity := flags.Duration("validity", 10*365*24*time.Hour, "-validity is how long the CA certificate is valid for.")
+	crlValidity := flags.Duration("crl-validity", 30*24*time.Hour, "-crl-validity is how long until the CRL should be published again.")
+	flags.Parse(args)
+
+	if *validity <= 0 || *crlValidity <= 0 {
+		return fmt.Errorf("-validity and -crl-validity must be positive")
+	}
+
+	key, err := generatePKIKey(*keyType)
+	if err != nil {
+		return err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: *name},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(*validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		// The CA only signs leaf certificates, so an intermediate it signs by mistake isn't trusted.
+		MaxPathLenZero: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	crl, err := createCRL(caCert, key, nil, big.NewInt(1), *crlValidity)
+	if err != nil {
+		return err
+	}
+
+	err = checkNotExist(*caKeyFile, *caCertFile, *crlFile)
+	if err != nil {
+		return err
+	}
+	// The key is written first, so the CA is never left without it.
+	err = writeKeyFile(*caKeyFile, key, false)
+	if err != nil {
+		return err
+	}
+	err = writePEMFile(*caCertFile, "CERTIFICATE", der, 0644, false)
+	if err != nil {
+		return err
+	}
+	err = writePEMFile(*crlFile, "X509 CRL", crl, 0644, false)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("wrote %s, %s and %s\n", *caCertFile, *caKeyFile, *crlFile)
+	fmt.Printf("serve with: wgrpcd -ca-cert %s -crl-files %s\n", *caCertFile, *crlFile)
+	return nil
+}
+
+// pkiServerCommand issues the server's certificate for the names clients connect to.
+func pkiServerCommand(config *Config, args []string) error {
+	flags := flag.NewFlagSet("pki server", flag.ExitOnError)
+	ca := addCAFlags(flags, config)
+	certFile := flags.String("cert", config.TLS.CertFile, "-cert is where the server certificate is written.")
+	keyFile := flags.String("key", config.TLS.KeyFile, "-key is where the server's private key is written.")
+	hosts := flags.String("hosts", defaultServerHosts(config), "-hosts is a comma-separated list of the DNS names and IP addresses clients connect to the server with.")
+	keyType := flags.String("key-type", pkiKeyECDSA, "-key-type is the type of the server's key. Allowed: (ecdsa, ed25519)")
+	validity := flags.Duration("validity", 365*24*time.Hour, "-validity is how long the server certificate is valid for.")
+	force := flags.Bool("force", false, "-force replaces an existing certificate and key, to renew them. A running wgrpcd loads them without a restart.")
+	flags.Parse(args)
+
+	template := &x509.Certificate{
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range strings.Split(*hosts, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			if ip.IsUnspecified() {
+				return fmt.Errorf("-hosts must name the addresses clients connect to, not %s", host)
+			}
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+		if template.Subject.CommonName == "" {
+			template.Subject.CommonName = host
+		}
+	}
+	if template.Subject.CommonName == "" {
+		return fmt.Errorf("-hosts is required")
+	}
+
+	return issueLeafCertificate(ca, template, *certFile, *keyFile, *keyType, *validity, *force)
+}
+
+// pkiClientCommand issues a client certificate identified by its common name, or by a URI like a SPIFFE ID if one is given.
+// The identity is what -client-cert-policy grants permissions to.
+func pkiClientCommand(config *Config, args []string) error {
+	flags := flag.NewFlagSet("pki client", flag.ExitOnError)
+	ca := addCAFlags(flags, config)
+	name := flags.String("name", "", "-name is the client's common name, which identifies it unless -uri is set.")
+	uri := flags.String("uri", "", "-uri is a URI identifying the client, like spiffe://example.com/app.")
+	certFile := flags.String("cert", "", "-cert is where the client certificate is written. (default NAMEcert.pem)")
+	keyFile := flags.String("key", "", "-key is where the client's private key is written. (default NAMEkey.pem)")
+	keyType := flags.String("key-type", pkiKeyECDSA, "-key-type is the type of the client's key. Allowed: (ecdsa, ed25519)")
+	validity := flags.Duration("validity", 365*24*time.Hour, "-validity is how long the client certificate is valid for.")
+	force := flags.Bool("force", false, "-force replaces an existing certificate and key.")
+	flags.Parse(args)
+
+	if *name == "" {
+		return fmt.Errorf("-name is required")
+	}
+	// The name is part of the default filenames, so it mustn't point them at another directory.
+	if strings.ContainsAny(*name, `/\`) {
+		return fmt.Errorf("-name cannot contain path separators, got %q", *name)
+	}
+	if *certFile == "" {
+		*certFile = *name + "cert.pem"
+	}
+	if *keyFile == "" {
+		*keyFile = *name + "key.pem"
+	}
+
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: *name},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if *uri != "" {
+		parsed, err := url.Parse(*uri)
+		if err != nil || parsed.Scheme == "" {
+			return fmt.Errorf("-uri must be an absolute URI, got %q", *uri)
+		}
+		template.URIs = []*url.URL{parsed}
+	}
+
+	return issueLeafCertificate(ca, template, *certFile, *keyFile, *keyType, *validity, *force)
+}
+
+// pkiRevokeCommand adds certificates to the CRL and signs it again.
+// Certificates are given as PEM files or hex serial numbers. With none, the CRL is just signed again, to publish it before its next update.
+// A running wgrpcd loads the new CRL without a restart if it is one of -crl-files.
+func pkiRevokeCommand(config *Config, args []string) error {
+	flags := flag.NewFlagSet("pki revoke", flag.ExitOnError)
+	ca := addCAFlags(flags, config)
+	crlFile := flags.String("crl", defaultCRLFile(config), "-crl is the CA's certificate revocation list.")
+	crlValidity := flags.Duration("crl-validity", 30*24*time.Hour, "-crl-validity is how long until the CRL should be published again.")
+	flags.Parse(args)
+
+	if *crlValidity <= 0 {
+		return fmt.Errorf("-crl-validity must be positive")
+	}
+
+	caCert, caKey, err := ca.load()
+	if err != nil {
+		return err
+	}
+
+	contents, err := ioutil.ReadFile(*crlFile)
+	if err != nil {
+		return fmt.Errorf("failed to read CRL, create one with wgrpcd pki init: %w", err)
+	}
+	if block, _ := pem.Decode(contents); block != nil {
+		contents = block.Bytes
+	}
+	previous, err := x509.ParseRevocationList(contents)
+	if err != nil {
+		return fmt.Errorf("failed to parse CRL %s: %w", *crlFile, err)
+	}
+	err = previous.CheckSignatureFrom(caCert)
+	if err != nil {
+		return fmt.Errorf("CRL %s is not signed by the CA: %w", *crlFile, err)
+	}
+
+	entries := previous.RevokedCertificateEntries
+	revoked := map[string]bool{}
+	for _, entry := range entries {
+		revoked[entry.SerialNumber.String()] = true
+	}
+	now := time.Now()
+	for _, arg := range flags.Args() {
+		serial, err := revokedSerial(arg, caCert)
+		if err != nil {
+			return err
+		}
+		if revoked[serial.String()] {
+			fmt.Printf("%X is already revoked\n", serial)
+			continue
+		}
+		revoked[serial.String()] = true
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: serial, RevocationTime: now})
+		fmt.Printf("revoked %X\n", serial)
+	}
+
+	number := big.NewInt(1)
+	if previous.Number != nil {
+		number.Add(previous.Number, number)
+	}
+	crl, err := createCRL(caCert, caKey, entries, number, *crlValidity)
+	if err != nil {
+		return err
+	}
+	err = writePEMFile(*crlFile, "X509 CRL", crl, 0644, true)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("wrote %s listing %d revoked certificates, next update %s\n", *crlFile, len(entries), now.Add(*crlValidity).Format(time.RFC3339))
+	return nil
+}
+
+// caFlags are the flags naming the CA that signs certificates and CRLs.
+type caFlags struct {
+	certFile *string
+	keyFile  *string
+}
+
+func addCAFlags(flags *flag.FlagSet, config *Config) *caFlags {
+	return &caFlags{
+		certFile: flags.String("ca-cert", config.TLS.CACertFile, "-ca-cert is the CA certificate to sign with."),
+		keyFile:  flags.String("ca-key", "cakey.pem", "-ca-key is the CA's private key."),
+	}
+}
+
+// load reads the CA certificate and key, checking they belong together and the certificate is a CA.
+func (c *caFlags) load() (*x509.Certificate, crypto.Signer, error) {
+	caCert, err := loadCertificate(*c.certFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load CA certificate: %w", err)
+	}
+	if !caCert.IsCA || caCert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return nil, nil, fmt.Errorf("%s is not a CA certificate", *c.certFile)
+	}
+
+	caKey, err := loadPKIKey(*c.keyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load CA key: %w", err)
+	}
+	publicKey, ok := caKey.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !publicKey.Equal(caCert.PublicKey) {
+		return nil, nil, fmt.Errorf("%s is not the key of %s", *c.keyFile, *c.certFile)
+	}
+	return caCert, caKey, nil
+}
+
+// issueLeafCertificate signs a certificate for a new key with the CA, filling in the fields every server and client certificate shares.
+func issueLeafCertificate(ca *caFlags, template *x509.Certificate, certFile, keyFile, keyType string, validity time.Duration, force bool) error {
+	if validity <= 0 {
+		return fmt.Errorf("-validity must be positive")
+	}
+	caCert, caKey, err := ca.load()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template.NotBefore = now.Add(-time.Minute)
+	template.NotAfter = now.Add(validity)
+	if template.NotAfter.After(caCert.NotAfter) {
+		return fmt.Errorf("the certificate would outlive the CA, which expires %s. Use a shorter -validity", caCert.NotAfter.Format(time.RFC3339))
+	}
+	// ECDSA and Ed25519 keys only sign, they don't encipher keys.
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.BasicConstraintsValid = true
+	template.SerialNumber, err = randomSerial()
+	if err != nil {
+		return err
+	}
+
+	key, err := generatePKIKey(keyType)
+	if err != nil {
+		return err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, key.Public(), caKey)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate: %w", err)
+	}
+
+	// Both files are checked before either is written, so an existing certificate doesn't leave an orphaned key behind.
+	if !force {
+		err = checkNotExist(keyFile, certFile)
+		if err != nil {
+			return fmt.Errorf("%w. Use -force to replace it", err)
+		}
+	}
+	err = writeKeyFile(keyFile, key, force)
+	if err != nil {
+		return err
+	}
+	err = writePEMFile(certFile, "CERTIFICATE", der, 0644, force)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("wrote %s and %s, serial %X, expires %s\n", certFile, keyFile, template.SerialNumber, template.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// createCRL returns a DER CRL listing entries, signed by the CA.
+func createCRL(caCert *x509.Certificate, caKey crypto.Signer, entries []x509.RevocationListEntry, number *big.Int, validity time.Duration) ([]byte, error) {
+	now := time.Now()
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		RevokedCertificateEntries: entries,
+		Number:                    number,
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(validity),
+	}, caCert, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CRL: %w", err)
+	}
+	return crl, nil
+}
+
+// revokedSerial returns the serial number of a certificate to revoke, given as a PEM file or a hex serial number.
+// Certificates from files must have been issued by the CA, or revoking them would do nothing.
+func revokedSerial(arg string, caCert *x509.Certificate) (*big.Int, error) {
+	if _, err := os.Stat(arg); err == nil {
+		cert, err := loadCertificate(arg)
+		if err != nil {
+			return nil, err
+		}
+		if cert.CheckSignatureFrom(caCert) != nil {
+			return nil, fmt.Errorf("%s was not issued by the CA", arg)
+		}
+		return cert.SerialNumber, nil
+	}
+
+	s := strings.TrimPrefix(strings.ToLower(arg), "0x")
+	serial, ok := new(big.Int).SetString(strings.ReplaceAll(s, ":", ""), 16)
+	if !ok {
+		return nil, fmt.Errorf("%q is neither a certificate file nor a hex serial number", arg)
+	}
+	return serial, nil
+}
+
+// defaultCRLFile is the CRL the server is configured with, if there is exactly one.
+func defaultCRLFile(config *Config) string {
+	if len(config.TLS.CRLFiles) == 1 {
+		return config.TLS.CRLFiles[0]
+	}
+	return "crl.pem"
+}
+
+// defaultServerHosts is the host the server listens on, unless it listens on every address.
+func defaultServerHosts(config *Config) string {
+	host, _, err := net.SplitHostPort(config.ListenAddress)
+	if err != nil || host == "" {
+		return ""
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return ""
+	}
+	return host
+}
+
+// randomSerial returns a random positive 128 bit serial number, so serials don't collide without keeping track of them.
+func randomSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	return serial.Add(serial, big.NewInt(1)), nil
+}
+
+func generatePKIKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case pkiKeyECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case pkiKeyEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, fmt.Errorf("unknown key type %q. Allowed: (%s, %s)", keyType, pkiKeyECDSA, pkiKeyEd25519)
+	}
+}
+
+// loadPKIKey reads a PEM private key. PKCS #1 and SEC 1 keys are accepted as well as PKCS #8, so existing CAs, like certstrap's, can be used.
+func loadPKIKey(filename string) (crypto.Signer, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM private key found in %s", filename)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key in %s: %w", filename, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key in %s", filename)
+	}
+	return signer, nil
+}
+
+// checkNotExist returns an error if any of filenames already exists.
+func checkNotExist(filenames ...string) error {
+	for _, filename := range filenames {
+		_, err := os.Stat(filename)
+		if err == nil {
+			return fmt.Errorf("%s already exists", filename)
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeKeyFile(filename string, key crypto.Signer, force bool) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writePEMFile(filename, "PRIVATE KEY", der, 0600, force)
+}
+
+// writePEMFile writes der to filename as a PEM block.
+// Unless force is set, existing files are kept, so a CA or key isn't replaced by accident.
+// With force, the file is replaced in one rename, so wgrpcd never loads a partly written file.
+func writePEMFile(filename, blockType string, der []byte, perm os.FileMode, force bool) error {
+	contents := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if !force {
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(contents)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(contents)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/joncooperworks/wgrpcd"
+)
+
+func TestPKIRevokeListsSerialInCRL(t *testing.T) {
+	dir := t.TempDir()
+	caFlags := []string{"-ca-cert", filepath.Join(dir, "cacert.pem"), "-ca-key", filepath.Join(dir, "cakey.pem")}
+	crlFile := filepath.Join(dir, "crl.pem")
+	certFile := filepath.Join(dir, "appcert.pem")
+
+	err := pkiCommand(defaultConfig(), append(append([]string{"init"}, caFlags...), "-crl", crlFile))
+	if err != nil {
+		t.Fatalf("pki init: %v", err)
+	}
+	err = pkiCommand(defaultConfig(), append(append([]string{"client"}, caFlags...), "-name", "app", "-cert", certFile, "-key", filepath.Join(dir, "appkey.pem")))
+	if err != nil {
+		t.Fatalf("pki client: %v", err)
+	}
+	err = pkiCommand(defaultConfig(), append(append([]string{"revoke"}, caFlags...), "-crl", crlFile, certFile))
+	if err != nil {
+		t.Fatalf("pki revoke: %v", err)
+	}
+
+	cert, err := loadCertificate(certFile)
+	if err != nil {
+		t.Fatalf("failed to load client certificate: %v", err)
+	}
+	contents, err := ioutil.ReadFile(crlFile)
+	if err != nil {
+		t.Fatalf("failed to read CRL: %v", err)
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		t.Fatal("CRL is not PEM encoded")
+	}
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		t.Fatalf("failed to parse CRL: %v", err)
+	}
+	if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Cmp(cert.SerialNumber) != 0 {
+		t.Errorf("got CRL entries %+v, want only serial %X", crl.RevokedCertificateEntries, cert.SerialNumber)
+	}
+
+	_, err = wgrpcd.NewClientCertRevocations(&wgrpcd.ClientCertRevocationsConfig{
+		CACertFilename: caFlags[1],
+		CRLFilenames:   []string{crlFile},
+		Logger:         slog.New(slog.NewTextHandler(ioutil.Discard, nil)),
+	})
+	if err != nil {
+		t.Errorf("the server refused the CRL: %v", err)
+	}
+}
+
+func TestPKIClientKeepsExistingFiles(t *testing.T) {
+	dir := t.TempDir()
+	caFlags := []string{"-ca-cert", filepath.Join(dir, "cacert.pem"), "-ca-key", filepath.Join(dir, "cakey.pem")}
+	err := pkiCommand(defaultConfig(), append(append([]string{"init"}, caFlags...), "-crl", filepath.Join(dir, "crl.pem")))
+	if err != nil {
+		t.Fatalf("pki init: %v", err)
+	}
+
+	certFile := filepath.Join(dir, "appcert.pem")
+	keyFile := filepath.Join(dir, "appkey.pem")
+	err = ioutil.WriteFile(certFile, []byte("existing"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	err = pkiCommand(defaultConfig(), append(append([]string{"client"}, caFlags...), "-name", "app", "-cert", certFile, "-key", keyFile))
+	if err == nil {
+		t.Fatal("pki client replaced an existing certificate without -force")
+	}
+	if _, err := os.Stat(keyFile); !os.IsNotExist(err) {
+		t.Errorf("pki client wrote a key for a certificate it didn't write: %v", err)
+	}
+
+	err = pkiCommand(defaultConfig(), append(append([]string{"client"}, caFlags...), "-name", "app", "-cert", certFile, "-key", keyFile, "-force"))
+	if err != nil {
+		t.Errorf("pki client -force: %v", err)
+	}
+}
+
+func TestPKIClientRefusesNamesWithPathSeparators(t *testing.T) {
+	dir := t.TempDir()
+	caFlags := []string{"-ca-cert", filepath.Join(dir, "cacert.pem"), "-ca-key", filepath.Join(dir, "cakey.pem")}
+	err := pkiCommand(defaultConfig(), append(append([]string{"init"}, caFlags...), "-crl", filepath.Join(dir, "crl.pem")))
+	if err != nil {
+		t.Fatalf("pki init: %v", err)
+	}
+
+	for _, name := range []string{"../app", "team/app", `team\app`} {
+		err := pkiCommand(defaultConfig(), append(append([]string{"client"}, caFlags...), "-name", name))
+		if err == nil || !strings.Contains(err.Error(), "path separators") {
+			t.Errorf("pki client -name %q got %v, want it refused", name, err)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sdListenFDsStart is the first file descriptor systemd passes to a socket activated service.
+const sdListenFDsStart = 3
+
+// activatedListeners returns the sockets systemd opened for wgrpcd, as described by LISTEN_PID and LISTEN_FDS, or none if it wasn't socket activated.
+// The variables are unset so processes wgrpcd starts don't think the sockets are theirs.
+func activatedListeners() ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := []net.Listener{}
+	for i := 0; i < count; i++ {
+		fd := sdListenFDsStart + i
+
+		name := fmt.Sprintf("LISTEN_FD_%d", fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(file)
+		// FileListener duplicates the descriptor, so the original is closed either way and isn't inherited by child processes.
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %s from systemd is not a listening stream socket: %w", name, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// sdNotifier sends service status to systemd over NOTIFY_SOCKET, for services with Type=notify.
+// A nil sdNotifier does nothing, so wgrpcd runs the same without systemd.
+type sdNotifier struct {
+	addr   *net.UnixAddr
+	logger *slog.Logger
+}
+
+// newSDNotifier returns an sdNotifier for the NOTIFY_SOCKET systemd passed, or nil if there isn't one.
+func newSDNotifier(logger *slog.Logger) *sdNotifier {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	os.Unsetenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// Sockets starting with @ are in the abstract namespace.
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	return &sdNotifier{
+		addr:   &net.UnixAddr{Name: socket, Net: "unixgram"},
+		logger: logger,
+	}
+}
+
+// notify sends state, like "READY=1", to systemd. Failures are logged, since wgrpcd works the same without them.
+func (s *sdNotifier) notify(state string) {
+	if s == nil {
+		return
+	}
+
+	conn, err := net.DialUnix(s.addr.Net, nil, s.addr)
+	if err == nil {
+		_, err = conn.Write([]byte(state))
+		conn.Close()
+	}
+	if err != nil {
+		s.logger.Warn("failed to notify systemd", "state", strings.ReplaceAll(state, "\n", " "), "error", err)
+	}
+}
+
+// watchdogInterval returns how often systemd expects a watchdog ping, or zero if WatchdogSec isn't set for wgrpcd.
+func watchdogInterval() time.Duration {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// watchdog pings systemd at half the watchdog interval until ctx is cancelled, so systemd restarts wgrpcd if it hangs.
+func (s *sdNotifier) watchdog(ctx context.Context, interval time.Duration) {
+	if s == nil || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.notify("WATCHDOG=1")
+		}
+	}
+}
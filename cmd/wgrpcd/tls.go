@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/joncooperworks/wgrpcd"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certExpiryWarning is how close to expiry a certificate has to be for wgrpcd to warn about it when it is loaded.
+const certExpiryWarning = 30 * 24 * time.Hour
+
+// certReloader serves the server certificate, client CA and client certificate revocations from disk, and loads them again without restarting wgrpcd when the files change.
+// Connections that are already open keep the certificates they were set up with.
+// With ACME, the server certificate comes from acme instead, which renews it itself.
+type certReloader struct {
+	logger  *slog.Logger
+	metrics *wgrpcd.Metrics
+
+	// acme is nil unless the server certificate comes from an ACME CA. It is set up once, so changes to the ACME configuration need a restart.
+	acme              *autocert.Manager
+	acmeDefaultDomain string
+	acmeChallenge     *tls.Config
+
+	// mutex serializes loads. Handshakes read loaded without locking it.
+	mutex    sync.Mutex
+	files    TLSConfig
+	versions map[string]fileVersion
+	loaded   atomic.Pointer[loadedCerts]
+}
+
+// loadedCerts is one consistent set of server certificate, client CA and revocations, swapped in as a whole.
+// certificate is nil with ACME.
+type loadedCerts struct {
+	certificate *tls.Certificate
+	config      *tls.Config
+}
+
+// fileVersion identifies a version of a file well enough to notice that it has been replaced.
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+// newCertReloader loads the certificates in files. metrics may be nil.
+func newCertReloader(files TLSConfig, logger *slog.Logger, metrics *wgrpcd.Metrics) (*certReloader, error) {
+	reloader := &certReloader{
+		logger:  logger,
+		metrics: metrics,
+	}
+	if files.ACME.enabled() {
+		manager, err := newACMEManager(files.ACME, logger)
+		if err != nil {
+			return nil, err
+		}
+		reloader.acme = manager
+		reloader.acmeDefaultDomain = files.ACME.Domains[0]
+		if files.ACME.Challenge == acmeChallengeTLSALPN {
+			// CAs validating tls-alpn-01 don't have a client certificate, and may not speak TLSv1.3.
+			reloader.acmeChallenge = &tls.Config{
+				GetCertificate: manager.GetCertificate,
+				MinVersion:     tls.VersionTLS12,
+				NextProtos:     []string{acme.ALPNProto},
+			}
+		}
+	}
+	err := reloader.Load(files)
+	if err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// Load reads the certificate, key, CA and CRLs from files. With ACME, only the CA and CRLs are read.
+// New connections use them once Load returns. If any of them fail to load, the old ones are kept.
+func (c *certReloader) Load(files TLSConfig) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Remember what was read even if it fails to load, so a bad file is reported once rather than on every check.
+	c.files = files
+	c.versions = statFiles(files)
+
+	// Load the CA certificate
+	trustedCert, err := ioutil.ReadFile(files.CACertFile)
+	if err != nil {
+		return fmt.Errorf("failed to load trusted certificate: %w", err)
+	}
+
+	// Put the CA certificate to certificate pool
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(trustedCert) {
+		return fmt.Errorf("failed to append trusted certificate to certificate pool")
+	}
+
+	var serverCert *tls.Certificate
+	if c.acme == nil {
+		loadedCert, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load server certificate: %w", err)
+		}
+		loadedCert.Leaf, err = x509.ParseCertificate(loadedCert.Certificate[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse server certificate: %w", err)
+		}
+		serverCert = &loadedCert
+	}
+
+	revocations, err := wgrpcd.NewClientCertRevocations(&wgrpcd.ClientCertRevocationsConfig{
+		CACertFilename: files.CACertFile,
+		CRLFilenames:   files.CRLFiles,
+		DeniedSerials:  files.DeniedSerials,
+		Metrics:        c.metrics,
+		Logger:         c.logger,
+	})
+	if err != nil {
+		return err
+	}
+
+	loaded := &loadedCerts{
+		certificate: serverCert,
+	}
+	// Since this is gRPC, we can enforce TLSv1.3.
+	loaded.config = &tls.Config{
+		GetCertificate:        c.getCertificate,
+		ClientCAs:             certPool,
+		ClientAuth:            tls.RequireAndVerifyClientCert,
+		VerifyPeerCertificate: revocations.VerifyPeerCertificate,
+		MinVersion:            tls.VersionTLS13,
+		MaxVersion:            tls.VersionTLS13,
+		NextProtos:            []string{"h2"},
+	}
+	c.loaded.Store(loaded)
+
+	if serverCert != nil {
+		c.logExpiry("loaded server certificate", files.CertFile, serverCert.Leaf.NotAfter)
+	}
+	caExpiry := earliestExpiry(trustedCert)
+	if !caExpiry.IsZero() {
+		c.logExpiry("loaded CA certificate", files.CACertFile, caExpiry)
+	}
+	return nil
+}
+
+func (c *certReloader) logExpiry(msg, filename string, expiry time.Time) {
+	remaining := time.Until(expiry)
+	if remaining < certExpiryWarning {
+		c.logger.Warn(msg+" that expires soon", "file", filename, "expires", expiry, "remaining", remaining.Round(time.Minute))
+		return
+	}
+	c.logger.Info(msg, "file", filename, "expires", expiry)
+}
+
+// Watch checks the certificate, key, CA and CRL files every interval and loads them again when any of them change, until ctx is done.
+// Failures are logged and the certificates that were loaded last stay in use.
+func (c *certReloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		c.mutex.Lock()
+		files := c.files
+		changed := !sameVersions(c.versions, statFiles(files))
+		c.mutex.Unlock()
+		if !changed {
+			continue
+		}
+
+		c.logger.Info("certificate files changed, reloading")
+		err := c.Load(files)
+		if err != nil {
+			c.logger.Error("failed to reload certificates", "error", err)
+		}
+	}
+}
+
+// TLSConfig returns a tls.Config that uses whatever was loaded most recently for each new connection.
+func (c *certReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS13,
+		MaxVersion:         tls.VersionTLS13,
+		GetConfigForClient: c.getConfigForClient,
+	}
+}
+
+func (c *certReloader) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if c.acmeChallenge != nil && isACMEChallenge(hello) {
+		return c.acmeChallenge, nil
+	}
+	return c.loaded.Load().config, nil
+}
+
+func (c *certReloader) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if c.acme != nil {
+		return c.acme.GetCertificate(acmeHello(hello, c.acmeDefaultDomain))
+	}
+	return c.loaded.Load().certificate, nil
+}
+
+// statFiles returns the current version of each file. Files that can't be read are left out.
+func statFiles(files TLSConfig) map[string]fileVersion {
+	versions := map[string]fileVersion{}
+	filenames := append([]string{files.CACertFile}, files.CRLFiles...)
+	if !files.ACME.enabled() {
+		filenames = append(filenames, files.CertFile, files.KeyFile)
+	}
+	for _, filename := range filenames {
+		info, err := os.Stat(filename)
+		if err != nil {
+			continue
+		}
+		versions[filename] = fileVersion{modTime: info.ModTime(), size: info.Size()}
+	}
+	return versions
+}
+
+func sameVersions(a, b map[string]fileVersion) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for filename, version := range a {
+		if other, ok := b[filename]; !ok || !other.modTime.Equal(version.modTime) || other.size != version.size {
+			return false
+		}
+	}
+	return true
+}
+
+// earliestExpiry returns the soonest expiry of the certificates in a PEM bundle, or the zero time if none can be parsed.
+func earliestExpiry(pemCerts []byte) time.Time {
+	var earliest time.Time
+	for {
+		var block *pem.Block
+		block, pemCerts = pem.Decode(pemCerts)
+		if block == nil {
+			return earliest
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		if earliest.IsZero() || cert.NotAfter.Before(earliest) {
+			earliest = cert.NotAfter
+		}
+	}
+}
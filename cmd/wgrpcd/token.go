@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/joncooperworks/wgrpcd"
+)
+
+// tokenCommand runs `wgrpcd token <subcommand>`.
+func tokenCommand(config *Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: wgrpcd token (keygen|issue|revoke) [flags]")
+	}
+
+	switch args[0] {
+	case "keygen":
+		return tokenKeygenCommand(args[1:])
+	case "issue":
+		return tokenIssueCommand(args[1:])
+	case "revoke":
+		return tokenRevokeCommand(config, args[1:])
+	default:
+		return fmt.Errorf("unknown token command %q. Allowed: (keygen, issue, revoke)", args[0])
+	}
+}
+
+// tokenKeygenCommand writes a new Ed25519 key pair for signing tokens.
+func tokenKeygenCommand(args []string) error {
+	flags := flag.NewFlagSet("token keygen", flag.ExitOnError)
+	privateKeyFile := flags.String("key", "token.key", "-key is where the private key that signs tokens is written.")
+	publicKeyFile := flags.String("public-key", "token.pub", "-public-key is where the public key wgrpcd verifies tokens with is written.")
+	flags.Parse(args)
+
+	privatePEM, publicPEM, err := wgrpcd.GenerateTokenKey()
+	if err != nil {
+		return err
+	}
+
+	// O_EXCL keeps an existing key, and every token it signed, from being replaced by accident.
+	for _, file := range []struct {
+		name     string
+		contents []byte
+		perm     os.FileMode
+	}{
+		{*privateKeyFile, privatePEM, 0600},
+		{*publicKeyFile, publicPEM, 0644},
+	} {
+		f, err := os.OpenFile(file.name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, file.perm)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(file.contents)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("wrote %s and %s\n", *privateKeyFile, *publicKeyFile)
+	return nil
+}
+
+// tokenIssueCommand prints a token signed with the private key for a client.
+func tokenIssueCommand(args []string) error {
+	flags := flag.NewFlagSet("token issue", flag.ExitOnError)
+	privateKeyFile := flags.String("key", "token.key", "-key is the private key to sign the token with.")
+	subject := flags.String("subject", "", "-subject is the client identifier the token is issued to.")
+	scopes := flags.String("scopes", "", "-scopes is a comma-separated list of the permissions, roles or device scopes the token grants.")
+	ttl := flags.Duration("ttl", 90*24*time.Hour, "-ttl is how long the token is valid for.")
+	id := flags.String("id", "", "-id is the token's ID, used to revoke it. A random ID is generated by default.")
+	bindCert := flags.String("bind-cert", "", "-bind-cert binds the token to this PEM encoded client certificate, so it is only accepted from a client using it.")
+	flags.Parse(args)
+
+	if *subject == "" {
+		return fmt.Errorf("-subject is required")
+	}
+	if *ttl <= 0 {
+		return fmt.Errorf("-ttl must be positive")
+	}
+
+	privateKey, err := wgrpcd.LoadTokenPrivateKey(*privateKeyFile)
+	if err != nil {
+		return err
+	}
+
+	thumbprint := ""
+	if *bindCert != "" {
+		cert, err := loadCertificate(*bindCert)
+		if err != nil {
+			return err
+		}
+		thumbprint = wgrpcd.CertificateThumbprint(cert)
+	}
+
+	scopeList := []string{}
+	for _, scope := range strings.Split(*scopes, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopeList = append(scopeList, scope)
+		}
+	}
+
+	now := time.Now()
+	token, err := wgrpcd.IssueSignedToken(privateKey, &wgrpcd.SignedToken{
+		ID:        *id,
+		Subject:   *subject,
+		Scopes:    scopeList,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(*ttl),
+
+		CertificateThumbprint: thumbprint,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(token)
+	return nil
+}
+
+// tokenRevokeCommand adds token IDs to the revocation list.
+// A running wgrpcd picks the change up on SIGHUP.
+func tokenRevokeCommand(config *Config, args []string) error {
+	flags := flag.NewFlagSet("token revoke", flag.ExitOnError)
+	filename := flags.String("revoked-tokens", config.Auth.RevokedTokens, "-revoked-tokens is the file listing the IDs of revoked tokens.")
+	flags.Parse(args)
+
+	if *filename == "" {
+		return fmt.Errorf("-revoked-tokens is required")
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: wgrpcd token revoke [-revoked-tokens filename] id...")
+	}
+
+	for _, id := range flags.Args() {
+		err := wgrpcd.RevokeTokenID(*filename, id)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("revoked %s\n", id)
+	}
+	return nil
+}
+
+// loadCertificate reads the first certificate in a PEM file.
+func loadCertificate(filename string) (*x509.Certificate, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, contents = pem.Decode(contents)
+		if block == nil {
+			return nil, fmt.Errorf("no certificate found in %s", filename)
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// loadRevokedTokens reads the revoked token IDs named in the configuration, if any.
+func loadRevokedTokens(auth AuthConfig) ([]string, error) {
+	if auth.RevokedTokens == "" {
+		return []string{}, nil
+	}
+	return wgrpcd.LoadRevokedTokenIDs(auth.RevokedTokens)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// listenUnix listens on the Unix socket in config, replacing a socket left behind by an earlier run, and sets its mode and group.
+func listenUnix(config UnixSocketConfig) (net.Listener, error) {
+	mode, err := parseSocketMode(config.Mode)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only remove sockets, so a mistyped path can't delete an unrelated file.
+	info, err := os.Lstat(config.Path)
+	if err == nil && info.Mode()&os.ModeSocket != 0 {
+		err = os.Remove(config.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to remove old socket: %w", err)
+		}
+	}
+
+	// The socket is created accessible only to wgrpcd's user, so no other process can connect before its mode and group are set.
+	listener, err := listenUnixPrivate(config.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(config.Path, mode)
+	if err == nil && config.Group != "" {
+		var gid int
+		gid, err = lookupGroup(config.Group)
+		if err == nil {
+			err = os.Chown(config.Path, -1, gid)
+		}
+	}
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set permissions on %s: %w", config.Path, err)
+	}
+	return listener, nil
+}
+
+// parseSocketMode parses an octal file mode like "0660".
+func parseSocketMode(mode string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	if m > 0777 {
+		return 0, fmt.Errorf("invalid file mode %s", mode)
+	}
+	return os.FileMode(m), nil
+}
+
+// lookupGroup returns the ID of a group given by name or number.
+func lookupGroup(group string) (int, error) {
+	gid, err := strconv.Atoi(group)
+	if err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
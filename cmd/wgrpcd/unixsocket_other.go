@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import (
+	"net"
+)
+
+// listenUnixPrivate listens on a Unix socket.
+// Platforms without a umask don't give sockets Unix file permissions, so there is nothing to restrict.
+func listenUnixPrivate(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,53 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestListenUnixSetsModeAndKeepsUmask(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wgrpcd.sock")
+	umask := syscall.Umask(0022)
+	defer syscall.Umask(umask)
+
+	listener, err := listenUnix(UnixSocketConfig{Path: path, Mode: "0660"})
+	if err != nil {
+		t.Fatalf("listenUnix: %v", err)
+	}
+	defer listener.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat socket: %v", err)
+	}
+	if info.Mode().Perm() != 0660 {
+		t.Errorf("socket has mode %o, want 660", info.Mode().Perm())
+	}
+	if restored := syscall.Umask(0022); restored != 0022 {
+		t.Errorf("umask is %o after listening, want it restored to 022", restored)
+	}
+}
+
+func TestListenUnixCreatesPrivateSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wgrpcd.sock")
+	umask := syscall.Umask(0)
+	defer syscall.Umask(umask)
+
+	listener, err := listenUnixPrivate(path)
+	if err != nil {
+		t.Fatalf("listenUnixPrivate: %v", err)
+	}
+	defer listener.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat socket: %v", err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		t.Errorf("socket has mode %o, want it closed to other users", info.Mode().Perm())
+	}
+}
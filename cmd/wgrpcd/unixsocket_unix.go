@@ -0,0 +1,16 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenUnixPrivate listens on a Unix socket that only its owner can connect to until listenUnix sets its mode.
+// The umask is process-wide, so this must only be called while wgrpcd is starting up and nothing else is creating files.
+func listenUnixPrivate(path string) (net.Listener, error) {
+	umask := syscall.Umask(0177)
+	defer syscall.Umask(umask)
+	return net.Listen("unix", path)
+}
@@ -2,88 +2,181 @@
 package main
 
 import (
-	"crypto/tls"
-	"crypto/x509"
-	"flag"
-	"io/ioutil"
+	"context"
 	"log"
+	"log/slog"
 	"net"
+	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
 	"path"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/joncooperworks/grpcauth"
 	"github.com/joncooperworks/wgrpcd"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
-var (
-	certFilename        = flag.String("cert-filename", "servercert.pem", "-cert-filename server's SSL certificate.")
-	keyFilename         = flag.String("key-filename", "serverkey.pem", "-key-filename is the server's SSL key.")
-	listenAddress       = flag.String("listen-address", "localhost:15002", "-listen-address specifies the host:port pair to listen on.")
-	caCertFilename      = flag.String("ca-cert", "cacert.pem", "-ca-cert is the CA that client certificates will be signed with.")
-	oauth2Domain        = flag.String("openid-domain", "", "-openid-domain is the domain the OpenID provider gives when setting up a machine-to-machine app.")
-	oauth2APIIdentifier = flag.String("openid-api-identifier", "", "-openid-api-identifier is the API identifier given by the OpenID provider when setting up a machine-to-machine app.")
-	oauth2Provider      = flag.String("openid-provider", "", "-openid-provider enables OAuth2 authentication of clients using OpenID provider's machine-to-machine auth. Allowed: (aws, auth0)")
-)
-
-func init() {
-	flag.Parse()
+func main() {
+	args := os.Args[1:]
+	config, commandArgs, err := loadConfig(args)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
 
-	if *oauth2Provider != "" {
-		if *oauth2Domain == "" || *oauth2APIIdentifier == "" {
-			log.Fatalf("-auth0-domain and -auth0-api-identifier must be set when using auth0.")
+	if len(commandArgs) > 0 {
+		err := runCommand(config, commandArgs)
+		if err != nil {
+			log.Fatalf("%v", err)
 		}
+		return
 	}
-}
 
-func main() {
+	err = config.Validate()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	// The level can be changed by reloading the configuration.
+	level, _ := parseLogLevel(config.Log.Level)
+	logLevel := &slog.LevelVar{}
+	logLevel.Set(level)
+	logger, err := newLogger(os.Stderr, config.Log.Format, logLevel)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	// Send the standard library logger, and the messages below, through the structured logger too.
+	slog.SetDefault(logger)
+
 	log.Println("wgrpcd 0.0.0-alpha")
 	log.Println("This software has not been audited and runs as root.\nVulnerabilities in this can compromise your root account.\nDo not run this in production")
 
-	listener, err := net.Listen("tcp", *listenAddress)
+	notifier := newSDNotifier(logger)
+
+	// Sockets passed by systemd socket activation replace -listen-address and -unix-socket.
+	activated, err := activatedListeners()
 	if err != nil {
-		log.Fatalf("failed to get listener on %s: %v", *listenAddress, err)
+		log.Fatalf("%v", err)
 	}
-
-	defer func() {
-		err = listener.Close()
+	listeners := []net.Listener{}
+	unixListeners := []net.Listener{}
+	for _, listener := range activated {
+		if _, ok := listener.(*net.UnixListener); ok {
+			unixListeners = append(unixListeners, listener)
+		} else {
+			listeners = append(listeners, listener)
+		}
+	}
+	if len(activated) > 0 {
+		logger.Info("using sockets from systemd", "tcp", len(listeners), "unix", len(unixListeners))
+	} else {
+		listener, err := net.Listen("tcp", config.ListenAddress)
 		if err != nil {
-			log.Fatalf("Failed to close listener. %s\n", err)
+			log.Fatalf("failed to get listener on %s: %v", config.ListenAddress, err)
 		}
-	}()
+		listeners = append(listeners, listener)
+	}
+
+	// Metrics are set up first so the TLS config can count rejected client certificates.
+	var metrics *wgrpcd.Metrics
+	if config.Metrics.Address != "" {
+		metrics = wgrpcd.NewMetrics()
+	}
+
+	certs, err := newCertReloader(config.TLS, logger, metrics)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
 
-	// Load the CA certificate
-	trustedCert, err := ioutil.ReadFile(*caCertFilename)
+	peerStore, err := wgrpcd.NewFilePeerStore(config.Stores.Peers)
 	if err != nil {
-		log.Fatalf("failed to load trusted certificate: %v", err)
+		log.Fatalf("failed to load peer store: %v", err)
 	}
 
-	// Put the CA certificate to certificate pool
-	certPool := x509.NewCertPool()
-	if !certPool.AppendCertsFromPEM(trustedCert) {
-		log.Fatalf("failed to append trusted certificate to certificate pool: %v", err)
+	revocationStore, err := wgrpcd.NewFileRevocationStore(config.Stores.Revocations)
+	if err != nil {
+		log.Fatalf("failed to load revocation store: %v", err)
 	}
 
-	serverCert, err := tls.LoadX509KeyPair(*certFilename, *keyFilename)
+	auditLog, err := wgrpcd.NewFileAuditLog(config.Stores.AuditLog)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("failed to load audit log: %v", err)
 	}
 
-	// Create the TLS configuration
-	// Since this is gRPC, we can enforce TLSv1.3.
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{serverCert},
-		ClientCAs:    certPool,
-		MinVersion:   tls.VersionTLS13,
-		MaxVersion:   tls.VersionTLS13,
+	// Closing done ends streams like WatchPeers when wgrpcd shuts down.
+	done := make(chan struct{})
+	serverConfig := &wgrpcd.ServerConfig{
+		TLSConfig:       certs.TLSConfig(),
+		CACertFilename:  config.TLS.CACertFile,
+		Logger:          logger,
+		PeerStore:       peerStore,
+		RevocationStore: revocationStore,
+		AuditLog:        auditLog,
+		Metrics:         metrics,
+
+		RateLimits:                    config.RateLimits,
+		ManagedDevices:                config.Health.ManagedDevices,
+		AuthenticateHealthChecks:      config.Health.Authenticate,
+		RequireCertificateBoundTokens: config.Auth.RequireBoundTokens,
+		Reflection:                    config.Reflection,
+		Done:                          done,
 	}
 
-	config := &wgrpcd.ServerConfig{
-		TLSConfig:      tlsConfig,
-		CACertFilename: *caCertFilename,
+	var clientCertAuth *wgrpcd.ClientCertAuth
+	if config.Auth.ClientCertPolicy != "" {
+		policy, err := wgrpcd.LoadClientCertPolicy(config.Auth.ClientCertPolicy)
+		if err != nil {
+			log.Fatalf("failed to load client certificate policy: %v", err)
+		}
+		clientCertAuth, err = wgrpcd.NewClientCertAuth(policy)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		serverConfig.AuthFunc = clientCertAuth.AuthFunc
 	}
 
-	if *oauth2Provider != "" {
-		oauth2DomainURL, err := url.Parse(*oauth2Domain)
+	var peerCredAuth *wgrpcd.PeerCredAuth
+	if config.UnixSocket.Path != "" && len(activated) == 0 {
+		unixListener, err := listenUnix(config.UnixSocket)
+		if err != nil {
+			log.Fatalf("failed to get listener on %s: %v", config.UnixSocket.Path, err)
+		}
+		unixListeners = append(unixListeners, unixListener)
+	}
+	if len(unixListeners) > 0 {
+		if config.UnixSocket.Policy == "" {
+			log.Fatalf("-unix-socket-policy is required to serve a Unix socket")
+		}
+		policy, err := wgrpcd.LoadPeerCredPolicy(config.UnixSocket.Policy)
+		if err != nil {
+			log.Fatalf("failed to load Unix socket policy: %v", err)
+		}
+		peerCredAuth, err = wgrpcd.NewPeerCredAuth(policy)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		serverConfig.PeerCredAuth = peerCredAuth
+	}
+
+	var signedTokenAuth *wgrpcd.SignedTokenAuth
+	if config.Auth.TokenPublicKey != "" {
+		publicKey, err := wgrpcd.LoadTokenPublicKey(config.Auth.TokenPublicKey)
+		if err != nil {
+			log.Fatalf("failed to load token public key: %v", err)
+		}
+		revokedIDs, err := loadRevokedTokens(config.Auth)
+		if err != nil {
+			log.Fatalf("failed to load revoked tokens: %v", err)
+		}
+		signedTokenAuth = wgrpcd.NewSignedTokenAuth(publicKey, revokedIDs)
+		serverConfig.AuthFunc = signedTokenAuth.AuthFunc
+	}
+
+	if config.Auth.OpenIDProvider != "" {
+		oauth2DomainURL, err := url.Parse(config.Auth.OpenIDDomain)
 		if err != nil {
 			log.Fatalf("invalid auth0 domain: %v", err)
 		}
@@ -92,35 +185,294 @@ func main() {
 		jwksURL, _ := url.Parse(oauth2DomainURL.String())
 		jwksURL.Path = path.Join(jwksURL.Path, ".well-known/jwks.json")
 
-		switch *oauth2Provider {
+		switch config.Auth.OpenIDProvider {
 		case "auth0":
 			auth0 := &grpcauth.Auth0M2M{
 				Domain:        oauth2DomainURL,
-				APIIdentifier: *oauth2APIIdentifier,
+				APIIdentifier: config.Auth.OpenIDAPIIdentifier,
 				JWKSURL:       jwksURL,
 			}
-			config.AuthFunc = auth0.AuthFunc
+			serverConfig.AuthFunc = auth0.AuthFunc
 
 		case "aws":
 			awsCognito := &grpcauth.AWSCognitoM2M{
 				Domain:        oauth2DomainURL,
-				APIIdentifier: *oauth2APIIdentifier,
+				APIIdentifier: config.Auth.OpenIDAPIIdentifier,
 				JWKSURL:       jwksURL,
 			}
-			config.AuthFunc = awsCognito.AuthFunc
+			serverConfig.AuthFunc = awsCognito.AuthFunc
+
+		case "oidc":
+			oidc, err := wgrpcd.NewOIDCProvider(context.Background(), &wgrpcd.OIDCConfig{
+				Issuer:     config.Auth.OpenIDDomain,
+				Audience:   config.Auth.OpenIDAPIIdentifier,
+				ScopeClaim: config.Auth.OpenIDScopeClaim,
+				Logger:     logger,
+			})
+			if err != nil {
+				log.Fatalf("failed to set up OpenID provider: %v", err)
+			}
+			serverConfig.AuthFunc = oidc.AuthFunc
 
 		default:
-			log.Fatalf("Invalid -openid-provider %s. Allowed: (aws, auth0)", *oauth2Provider)
+			log.Fatalf("Invalid -openid-provider %s. Allowed: (aws, auth0, oidc)", config.Auth.OpenIDProvider)
 		}
 	}
 
-	server, err := wgrpcd.NewServer(config)
+	// Client certificate policies and signed tokens are written for wgrpcd, so they can always grant roles and device scopes.
+	// An OpenID provider's scopes may predate them, so they are only read that way when asked for.
+	if serverConfig.AuthFunc != nil && (config.Auth.OpenIDProvider == "" || config.Auth.OpenIDRoles) {
+		serverConfig.PermissionFunc = wgrpcd.RolePermissionFunc
+	}
+
+	// Background work stops when ctx is cancelled, after the gRPC server has stopped.
+	ctx, cancel := context.WithCancel(context.Background())
+	var background sync.WaitGroup
+
+	if config.TLS.WatchInterval > 0 {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			certs.Watch(ctx, config.TLS.WatchInterval)
+		}()
+	}
+
+	var dispatcher *wgrpcd.WebhookDispatcher
+	webhooks, err := config.webhooks()
+	if err != nil {
+		log.Fatalf("failed to load webhooks: %v", err)
+	}
+	if len(webhooks) > 0 || config.Webhooks.File != "" {
+		dispatcher, err = wgrpcd.NewWebhookDispatcher(&wgrpcd.WebhookDispatcherConfig{
+			Webhooks:       webhooks,
+			OutboxFilename: config.Webhooks.Outbox,
+			Logger:         logger,
+		})
+		if err != nil {
+			log.Fatalf("failed to set up webhooks: %v", err)
+		}
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			dispatcher.Run(ctx)
+		}()
+		serverConfig.Webhooks = dispatcher
+	}
+
+	var tracerProvider *sdktrace.TracerProvider
+	if config.Tracing.OTLPEndpoint != "" {
+		tracerProvider, err = newTracerProvider(ctx, config.Tracing.OTLPEndpoint, config.Tracing.OTLPInsecure)
+		if err != nil {
+			log.Fatalf("failed to set up tracing: %v", err)
+		}
+		serverConfig.TracerProvider = tracerProvider
+	}
+
+	server, err := wgrpcd.NewServer(serverConfig)
 	if err != nil {
 		log.Fatalf("%s\n", err)
 	}
 
-	err = server.Serve(listener)
+	var metricsServer *http.Server
+	if serverConfig.Metrics != nil {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", serverConfig.Metrics.Handler())
+		metricsServer = &http.Server{
+			Addr:    config.Metrics.Address,
+			Handler: mux,
+		}
+		go func() {
+			log.Printf("Serving Prometheus metrics on %s", config.Metrics.Address)
+			err := metricsServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Failed to start metrics server. %s.", err)
+			}
+		}()
+	}
+
+	var acmeServer *http.Server
+	if certs.acme != nil && config.TLS.ACME.Challenge == acmeChallengeHTTP {
+		acmeServer = &http.Server{
+			Addr:    config.TLS.ACME.HTTPAddress,
+			Handler: certs.acme.HTTPHandler(http.NotFoundHandler()),
+		}
+		go func() {
+			logger.Info("answering ACME http-01 challenges", "address", config.TLS.ACME.HTTPAddress)
+			err := acmeServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Failed to start ACME challenge server. %s.", err)
+			}
+		}()
+	}
+
+	reloader := &reloadable{
+		args:            args,
+		logger:          logger,
+		logLevel:        logLevel,
+		certs:           certs,
+		dispatcher:      dispatcher,
+		clientCertAuth:  clientCertAuth,
+		signedTokenAuth: signedTokenAuth,
+		peerCredAuth:    peerCredAuth,
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	serveErr := make(chan error, len(listeners)+len(unixListeners))
+	for _, listener := range append(listeners, unixListeners...) {
+		go func(listener net.Listener) {
+			serveErr <- server.Serve(listener)
+		}(listener)
+	}
+	notifier.notify("READY=1\nSTATUS=serving")
+
+	if certs.acme != nil {
+		go certs.obtainACMECertificates(config.TLS.ACME.Domains)
+	}
+
+	if interval := watchdogInterval(); interval > 0 {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			notifier.watchdog(ctx, interval)
+		}()
+	}
+
+	for running := true; running; {
+		select {
+		case err := <-serveErr:
+			log.Fatalf("Failed to start gRPC server. %s.", err)
+
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				notifier.notify("RELOADING=1")
+				reloader.reload()
+				notifier.notify("READY=1")
+				continue
+			}
+			logger.Info("shutting down", "signal", sig.String(), "timeout", config.ShutdownTimeout)
+			running = false
+		}
+	}
+	signal.Stop(signals)
+	notifier.notify("STOPPING=1")
+
+	// Stop accepting requests and wait for the ones in flight, so a peer that was added is always reported to the client that asked for it.
+	close(done)
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(config.ShutdownTimeout):
+		logger.Warn("requests did not finish before the shutdown timeout, closing their connections")
+		server.Stop()
+	}
+
+	cancel()
+	background.Wait()
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancelShutdown()
+	if acmeServer != nil {
+		err := acmeServer.Shutdown(shutdownCtx)
+		if err != nil {
+			logger.Error("failed to stop ACME challenge server", "error", err)
+		}
+	}
+	if metricsServer != nil {
+		err := metricsServer.Shutdown(shutdownCtx)
+		if err != nil {
+			logger.Error("failed to stop metrics server", "error", err)
+		}
+	}
+	if tracerProvider != nil {
+		err := tracerProvider.Shutdown(shutdownCtx)
+		if err != nil {
+			logger.Error("failed to flush traces", "error", err)
+		}
+	}
+	err = auditLog.Close()
+	if err != nil {
+		logger.Error("failed to close audit log", "error", err)
+	}
+	logger.Info("stopped")
+}
+
+// reloadable holds the parts of a running wgrpcd that are reloaded on SIGHUP.
+// Parts that are disabled are nil.
+type reloadable struct {
+	args            []string
+	logger          *slog.Logger
+	logLevel        *slog.LevelVar
+	certs           *certReloader
+	dispatcher      *wgrpcd.WebhookDispatcher
+	clientCertAuth  *wgrpcd.ClientCertAuth
+	signedTokenAuth *wgrpcd.SignedTokenAuth
+	peerCredAuth    *wgrpcd.PeerCredAuth
+}
+
+// reload reads the configuration again after a SIGHUP, and applies the TLS certificates, webhooks, client certificate and Unix socket policies, revoked tokens and log level from it.
+// Other settings need a restart. Anything that fails to load is logged and left as it was.
+func (r *reloadable) reload() {
+	logger := r.logger
+	logger.Info("reloading certificates and configuration")
+
+	config, _, err := loadConfig(r.args)
+	if err == nil {
+		err = config.Validate()
+	}
+	if err != nil {
+		logger.Error("failed to reload configuration", "error", err)
+		return
+	}
+
+	level, _ := parseLogLevel(config.Log.Level)
+	r.logLevel.Set(level)
+
+	err = r.certs.Load(config.TLS)
 	if err != nil {
-		log.Fatalf("Failed to start gRPC server. %s.", err)
+		logger.Error("failed to reload certificates", "error", err)
+	}
+
+	if r.dispatcher != nil {
+		webhooks, err := config.webhooks()
+		if err == nil {
+			err = r.dispatcher.SetWebhooks(webhooks)
+		}
+		if err != nil {
+			logger.Error("failed to reload webhooks", "error", err)
+		}
+	}
+
+	if r.clientCertAuth != nil && config.Auth.ClientCertPolicy != "" {
+		policy, err := wgrpcd.LoadClientCertPolicy(config.Auth.ClientCertPolicy)
+		if err == nil {
+			err = r.clientCertAuth.SetPolicy(policy)
+		}
+		if err != nil {
+			logger.Error("failed to reload client certificate policy", "error", err)
+		}
+	}
+
+	if r.peerCredAuth != nil && config.UnixSocket.Policy != "" {
+		policy, err := wgrpcd.LoadPeerCredPolicy(config.UnixSocket.Policy)
+		if err == nil {
+			err = r.peerCredAuth.SetPolicy(policy)
+		}
+		if err != nil {
+			logger.Error("failed to reload Unix socket policy", "error", err)
+		}
+	}
+
+	if r.signedTokenAuth != nil {
+		revokedIDs, err := loadRevokedTokens(config.Auth)
+		if err != nil {
+			logger.Error("failed to reload revoked tokens", "error", err)
+		} else {
+			r.signedTokenAuth.SetRevokedIDs(revokedIDs)
+		}
 	}
 }
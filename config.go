@@ -4,16 +4,50 @@ import (
 	"crypto/tls"
 
 	"github.com/joncooperworks/grpcauth"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 )
 
-//ServerConfig contains all information a caller needs to create a new wgrpcd.Server.
+// ServerConfig contains all information a caller needs to create a new wgrpcd.Server.
 type ServerConfig struct {
-	TLSConfig      *tls.Config
-	CACertFilename string
-	AuthFunc       grpcauth.AuthFunc
-	PermissionFunc grpcauth.PermissionFunc
-	Logger         Logger
+	TLSConfig       *tls.Config
+	CACertFilename  string
+	AuthFunc        grpcauth.AuthFunc
+	PermissionFunc  grpcauth.PermissionFunc
+	Logger          Logger
+	PeerStore       PeerStore
+	RevocationStore RevocationStore
+	AuditLog        AuditLog
+	Webhooks        *WebhookDispatcher
+	Metrics         *Metrics
+	TracerProvider  trace.TracerProvider
+
+	// ManagedDevices are the Wireguard devices the health service checks for.
+	// If it is empty, the health service only checks that Wireguard can be reached.
+	ManagedDevices []string
+
+	// AuthenticateHealthChecks makes health checks authenticate and hold PermissionHealthCheck or PermissionHealthWatch like any other request.
+	// By default health checks skip authentication, so load balancers don't need credentials.
+	AuthenticateHealthChecks bool
+
+	// PeerCredAuth authenticates clients connecting over a Unix socket by their uid and gid instead of TLS, so the server can be served on a Unix socket listener alongside its TCP one.
+	// Without an AuthFunc, TCP clients keep every permission.
+	// Unix socket clients are always authorized with RolePermissionFunc, so the policy can grant roles and device scopes whatever the PermissionFunc is.
+	PeerCredAuth *PeerCredAuth
+
+	// RequireCertificateBoundTokens refuses tokens that aren't bound to the client's certificate with a cnf.x5t#S256 claim.
+	// Tokens that are bound are always checked against the certificate the client connected with.
+	RequireCertificateBoundTokens bool
+
+	// RateLimits limits how often each client can call wgrpcd and how many changes it can make at once.
+	// Nil means clients aren't limited.
+	RateLimits *RateLimitConfig
+
+	// Reflection registers the gRPC server reflection service, which needs PermissionReflection.
+	Reflection bool
+
+	// Done ends long-lived streams like WatchPeers when it is closed, so grpc.Server.GracefulStop doesn't wait for them.
+	Done <-chan struct{}
 }
 
 // ClientConfig contains all information needed to configure a wgrpcd.Client.
@@ -24,4 +58,5 @@ type ClientConfig struct {
 	ClientKeyBytes  []byte
 	CACertFilename  string
 	Options         []grpc.DialOption
+	TracerProvider  trace.TracerProvider
 }
@@ -0,0 +1,112 @@
+package wgrpcd
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// healthWatchInterval is how often Watch checks whether the health status has changed.
+	healthWatchInterval = 5 * time.Second
+
+	// wireguardRPCService is the service name clients can ask the health service about, besides "" for the whole server.
+	wireguardRPCService = "wgrpcd.WireguardRPC"
+)
+
+// healthServer implements the standard gRPC health service.
+// wgrpcd is serving when it can reach Wireguard through wgctrl and every managed device exists.
+// Like the metrics, the status is read from Wireguard when a client asks for it.
+type healthServer struct {
+	healthpb.UnimplementedHealthServer
+	devices []string
+	logger  Logger
+	done    <-chan struct{}
+}
+
+// status checks Wireguard and returns the serving status of the whole server.
+func (h *healthServer) status() healthpb.HealthCheckResponse_ServingStatus {
+	if len(h.devices) == 0 {
+		_, err := Devices()
+		if err != nil {
+			h.logger.Warn("health check failed to list wireguard devices", logKeyError, err)
+			return healthpb.HealthCheckResponse_NOT_SERVING
+		}
+		return healthpb.HealthCheckResponse_SERVING
+	}
+
+	for _, device := range h.devices {
+		_, err := New(device)
+		if err != nil {
+			h.logger.Warn("health check failed to reach wireguard device", logKeyDevice, device, logKeyError, err)
+			return healthpb.HealthCheckResponse_NOT_SERVING
+		}
+	}
+	return healthpb.HealthCheckResponse_SERVING
+}
+
+// serviceStatus returns the status of a service, and false if wgrpcd doesn't know about it.
+func (h *healthServer) serviceStatus(service string) (healthpb.HealthCheckResponse_ServingStatus, bool) {
+	if service != "" && service != wireguardRPCService {
+		return healthpb.HealthCheckResponse_SERVICE_UNKNOWN, false
+	}
+	if h.shuttingDown() {
+		return healthpb.HealthCheckResponse_NOT_SERVING, true
+	}
+	return h.status(), true
+}
+
+// shuttingDown returns true once the server has started shutting down, so load balancers can stop sending it requests.
+func (h *healthServer) shuttingDown() bool {
+	select {
+	case <-h.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Check returns the current serving status.
+func (h *healthServer) Check(ctx context.Context, request *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	servingStatus, ok := h.serviceStatus(request.GetService())
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "unknown service: %s", request.GetService())
+	}
+
+	response := &healthpb.HealthCheckResponse{
+		Status: servingStatus,
+	}
+	return response, nil
+}
+
+// Watch sends the serving status, then sends it again each time it changes until the client goes away.
+func (h *healthServer) Watch(request *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	ticker := time.NewTicker(healthWatchInterval)
+	defer ticker.Stop()
+
+	var last healthpb.HealthCheckResponse_ServingStatus = -1
+	for {
+		servingStatus, _ := h.serviceStatus(request.GetService())
+		if servingStatus != last {
+			err := stream.Send(&healthpb.HealthCheckResponse{Status: servingStatus})
+			if err != nil {
+				return err
+			}
+			last = servingStatus
+		}
+
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-h.done:
+			if last != healthpb.HealthCheckResponse_NOT_SERVING {
+				stream.Send(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_NOT_SERVING})
+			}
+			return status.Errorf(codes.Unavailable, "server is shutting down")
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package wgrpcd
+
+import (
+	"context"
+
+	"github.com/joncooperworks/grpcauth"
+	"google.golang.org/grpc"
+)
+
+// requestClientKey is the context key for the requestClient filled in by identifyUnaryClient.
+type requestClientKey struct{}
+
+// requestClient carries the authenticated client's identifier from inside the auth interceptor back out to interceptors that run before it, like metrics and auditing.
+type requestClient struct {
+	identifier string
+}
+
+// withRequestClient returns the requestClient an earlier interceptor attached to ctx, or attaches a new one.
+func withRequestClient(ctx context.Context) (context.Context, *requestClient) {
+	client, ok := ctx.Value(requestClientKey{}).(*requestClient)
+	if ok {
+		return ctx, client
+	}
+	client = &requestClient{}
+	return context.WithValue(ctx, requestClientKey{}, client), client
+}
+
+// identifyUnaryClient records the authenticated client for interceptors that run before authentication.
+// It must run after the auth interceptor.
+func identifyUnaryClient(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	identifyRequestClient(ctx)
+	return handler(ctx, req)
+}
+
+// identifyStreamClient is identifyUnaryClient for streaming RPCs.
+func identifyStreamClient(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	identifyRequestClient(stream.Context())
+	return handler(srv, stream)
+}
+
+func identifyRequestClient(ctx context.Context) {
+	client, ok := ctx.Value(requestClientKey{}).(*requestClient)
+	if !ok {
+		return
+	}
+
+	auth, err := grpcauth.GetAuthResult(ctx)
+	if err == nil {
+		client.identifier = auth.ClientIdentifier
+	}
+}
+
+// contextStream is a grpc.ServerStream with its context replaced, so stream interceptors can pass values to the handler.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context returns the replacement context.
+func (c *contextStream) Context() context.Context {
+	return c.ctx
+}
+
+// unaryUnless returns an interceptor that calls interceptor for every method except those in skip.
+func unaryUnless(skip map[string]bool, interceptor grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if skip[info.FullMethod] {
+			return handler(ctx, req)
+		}
+		return interceptor(ctx, req, info, handler)
+	}
+}
+
+// streamUnless is unaryUnless for streaming RPCs.
+func streamUnless(skip map[string]bool, interceptor grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if skip[info.FullMethod] {
+			return handler(srv, stream)
+		}
+		return interceptor(srv, stream, info, handler)
+	}
+}
@@ -0,0 +1,184 @@
+package wgrpcd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const (
+	maxPeerNameLength   = 255
+	maxLabelValueLength = 255
+)
+
+var (
+	labelKeyPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]{0,62}$`)
+	labelSetPattern = regexp.MustCompile(`^(\S+)\s+(in|notin)\s*\(([^()]*)\)$`)
+)
+
+// ValidatePeerMetadata checks that a peer's name and labels can be stored and matched by a LabelSelector.
+// Label keys are up to 63 letters, digits, '.', '_', '/' or '-' starting with a letter or digit.
+// Label values and names are up to 255 printable characters, and label values cannot contain commas.
+func ValidatePeerMetadata(name string, labels map[string]string) error {
+	if len(name) > maxPeerNameLength {
+		return fmt.Errorf("name must be at most %d characters", maxPeerNameLength)
+	}
+	if strings.IndexFunc(name, isNotPrintable) != -1 {
+		return fmt.Errorf("name must only contain printable characters")
+	}
+
+	for key, value := range labels {
+		if !labelKeyPattern.MatchString(key) {
+			return fmt.Errorf("invalid label key '%s'", key)
+		}
+		if len(value) > maxLabelValueLength {
+			return fmt.Errorf("value for label '%s' must be at most %d characters", key, maxLabelValueLength)
+		}
+		if strings.ContainsRune(value, ',') || strings.IndexFunc(value, isNotPrintable) != -1 {
+			return fmt.Errorf("value for label '%s' must be printable and cannot contain commas", key)
+		}
+	}
+	return nil
+}
+
+// labelRequirement is a single comma-separated clause in a LabelSelector.
+type labelRequirement struct {
+	key      string
+	value    string
+	values   []string
+	operator string
+}
+
+const (
+	labelOperatorEquals    = "="
+	labelOperatorNotEquals = "!="
+	labelOperatorExists    = "exists"
+	labelOperatorNotExists = "!exists"
+	labelOperatorIn        = "in"
+	labelOperatorNotIn     = "notin"
+)
+
+// LabelSelector filters peers by their labels.
+// Selectors are comma-separated requirements that must all hold:
+// "key=value" and "key==value" match equal values, "key!=value" matches missing or different values,
+// "key in (a,b)" matches any of the listed values, "key notin (a,b)" matches missing or unlisted values,
+// "key" matches peers that have the label and "!key" matches peers that don't.
+// An empty selector matches everything.
+type LabelSelector struct {
+	requirements []labelRequirement
+}
+
+// ParseLabelSelector parses a selector string in the format described on LabelSelector.
+func ParseLabelSelector(selector string) (*LabelSelector, error) {
+	parsed := &LabelSelector{}
+	if strings.TrimSpace(selector) == "" {
+		return parsed, nil
+	}
+
+	for _, clause := range splitSelector(selector) {
+		clause = strings.TrimSpace(clause)
+		var requirement labelRequirement
+		switch set := labelSetPattern.FindStringSubmatch(clause); {
+		case set != nil:
+			requirement = labelRequirement{key: set[1], operator: set[2]}
+			for _, value := range strings.Split(set[3], ",") {
+				value = strings.TrimSpace(value)
+				if value == "" {
+					return nil, fmt.Errorf("empty value in selector clause '%s'", clause)
+				}
+				requirement.values = append(requirement.values, value)
+			}
+		case strings.ContainsAny(clause, "()"):
+			return nil, fmt.Errorf("invalid selector clause '%s'", clause)
+		case strings.Contains(clause, "!="):
+			parts := strings.SplitN(clause, "!=", 2)
+			requirement = labelRequirement{key: parts[0], value: parts[1], operator: labelOperatorNotEquals}
+		case strings.Contains(clause, "=="):
+			parts := strings.SplitN(clause, "==", 2)
+			requirement = labelRequirement{key: parts[0], value: parts[1], operator: labelOperatorEquals}
+		case strings.Contains(clause, "="):
+			parts := strings.SplitN(clause, "=", 2)
+			requirement = labelRequirement{key: parts[0], value: parts[1], operator: labelOperatorEquals}
+		case strings.HasPrefix(clause, "!"):
+			requirement = labelRequirement{key: clause[1:], operator: labelOperatorNotExists}
+		default:
+			requirement = labelRequirement{key: clause, operator: labelOperatorExists}
+		}
+
+		requirement.key = strings.TrimSpace(requirement.key)
+		requirement.value = strings.TrimSpace(requirement.value)
+		if !labelKeyPattern.MatchString(requirement.key) {
+			return nil, fmt.Errorf("invalid label key in selector clause '%s'", clause)
+		}
+		parsed.requirements = append(parsed.requirements, requirement)
+	}
+	return parsed, nil
+}
+
+// Matches reports whether labels satisfy every requirement in the selector.
+func (l *LabelSelector) Matches(labels map[string]string) bool {
+	for _, requirement := range l.requirements {
+		value, ok := labels[requirement.key]
+		switch requirement.operator {
+		case labelOperatorEquals:
+			if !ok || value != requirement.value {
+				return false
+			}
+		case labelOperatorNotEquals:
+			if ok && value == requirement.value {
+				return false
+			}
+		case labelOperatorExists:
+			if !ok {
+				return false
+			}
+		case labelOperatorNotExists:
+			if ok {
+				return false
+			}
+		case labelOperatorIn:
+			if !ok || !containsString(requirement.values, value) {
+				return false
+			}
+		case labelOperatorNotIn:
+			if ok && containsString(requirement.values, value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// splitSelector splits a selector into clauses on the commas that aren't inside a set of values.
+func splitSelector(selector string) []string {
+	clauses := []string{}
+	depth, start := 0, 0
+	for i, r := range selector {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				clauses = append(clauses, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(clauses, selector[start:])
+}
+
+func isNotPrintable(r rune) bool {
+	return !unicode.IsPrint(r)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
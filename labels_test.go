@@ -0,0 +1,107 @@
+package wgrpcd
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestLabelSelectorMatches(t *testing.T) {
+	labels := map[string]string{"owner": "jon", "env": "staging", "ticket": "OPS-1"}
+	tests := []struct {
+		selector string
+		matches  bool
+	}{
+		{"", true},
+		{"owner=jon", true},
+		{"owner==jon", true},
+		{" owner = jon ", true},
+		{"owner=someone", false},
+		{"team=jon", false},
+		{"env!=prod", true},
+		{"env!=staging", false},
+		{"team!=prod", true},
+		{"env in (dev,staging)", true},
+		{"env in ( dev , staging )", true},
+		{"env in (dev,prod)", false},
+		{"team in (dev)", false},
+		{"env notin (dev,prod)", true},
+		{"env notin (staging)", false},
+		{"team notin (dev)", true},
+		{"ticket", true},
+		{"team", false},
+		{"!team", true},
+		{"!ticket", false},
+		{"owner=jon,env in (dev,staging),ticket", true},
+		{"owner=jon,env in (dev,staging),!ticket", false},
+		{"env in (dev,staging),owner=someone", false},
+	}
+	for _, test := range tests {
+		selector, err := ParseLabelSelector(test.selector)
+		if err != nil {
+			t.Errorf("ParseLabelSelector(%q): %v", test.selector, err)
+			continue
+		}
+		if matches := selector.Matches(labels); matches != test.matches {
+			t.Errorf("%q matched %v, want %v", test.selector, matches, test.matches)
+		}
+	}
+}
+
+func TestParseLabelSelectorRefusesMalformedSelectors(t *testing.T) {
+	for _, selector := range []string{
+		"=jon",
+		"owner=jon,",
+		"owner=jon,,env=prod",
+		"!",
+		"-owner=jon",
+		"owner name=jon",
+		"env in ()",
+		"env in (dev,)",
+		"env in dev,staging",
+		"env in (dev,staging",
+		"env notin (dev))",
+		"env=(dev)",
+	} {
+		if _, err := ParseLabelSelector(selector); err == nil {
+			t.Errorf("ParseLabelSelector(%q) accepted a malformed selector", selector)
+		}
+	}
+}
+
+func TestImportRestoresMetadataWhenDeviceFails(t *testing.T) {
+	fake := useFakeWireguard(t, "wg0")
+	peers := newMemoryPeerStore()
+	client := newTestClient(t, &ServerConfig{PeerStore: peers}, PermissionImport)
+	ctx := context.Background()
+
+	existing := testPublicKey(t)
+	_, err := client.Import(ctx, &ImportRequest{
+		DeviceName: "wg0",
+		Peers:      []*ImportedPeer{{PublicKey: existing.String(), AllowedIPs: []string{"10.0.0.2/32"}, Name: "laptop"}},
+	})
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+
+	fake.mutex.Lock()
+	fake.configureErr = errors.New("device busy")
+	fake.mutex.Unlock()
+	created := testPublicKey(t)
+	for _, publicKey := range []string{existing.String(), created.String()} {
+		_, err = client.Import(ctx, &ImportRequest{
+			DeviceName: "wg0",
+			Peers:      []*ImportedPeer{{PublicKey: publicKey, AllowedIPs: []string{"10.0.0.3/32"}, Name: "renamed"}},
+		})
+		if err == nil {
+			t.Fatal("Import succeeded even though the device couldn't be configured")
+		}
+	}
+
+	if record, _ := peers.Get("wg0", existing.String()); record == nil || record.Name != "laptop" {
+		t.Errorf("got record %+v for the existing peer, want its original metadata", record)
+	}
+	if record, _ := peers.Get("wg0", created.String()); record != nil {
+		t.Errorf("got record %+v for a peer that was never added", record)
+	}
+}
@@ -1,18 +1,23 @@
 package wgrpcd
 
-import "log"
-
-// Logger wraps Go's stdlib logger to allow for more control over logging.
-// An empty logger will log to Go's default logger.
-type Logger struct {
-	*log.Logger
+// Logger is the structured, leveled logger wgrpcd writes to.
+// Each method takes a message followed by alternating keys and values, or slog.Attrs, describing the event.
+// *slog.Logger satisfies Logger, so any slog.Handler can be used to format wgrpcd's logs.
+// A nil Logger in a ServerConfig logs to slog.Default().
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
 }
 
-// Printf forwards the logging call to a custom logger, or the default logger if there is no custom logger.
-func (l *Logger) Printf(format string, args ...interface{}) {
-	if l.Logger != nil {
-		l.Logger.Printf(format, args...)
-	} else {
-		log.Printf(format, args...)
-	}
-}
+// Attribute keys wgrpcd uses in its log records.
+const (
+	logKeyClient       = "client"
+	logKeyDevice       = "device"
+	logKeyPublicKey    = "public_key"
+	logKeyNewPublicKey = "new_public_key"
+	logKeyListenPort   = "listen_port"
+	logKeyPeerCount    = "peers"
+	logKeyError        = "error"
+)
@@ -0,0 +1,218 @@
+package wgrpcd
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	metricsNamespace = "wgrpcd"
+)
+
+// Metrics exports Prometheus metrics about a wgrpcd server's Wireguard devices and gRPC requests.
+// Device and peer metrics are read from Wireguard on every scrape.
+// Request metrics are labelled with the ClientIdentifier of the authenticated client, or an empty string if the client could not be authenticated.
+type Metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	// rejectedClientCerts is incremented by ClientCertRevocations, since handshakes fail before any request is made.
+	rejectedClientCerts *prometheus.CounterVec
+	devices             *deviceCollector
+}
+
+// NewMetrics returns a Metrics with its own Prometheus registry.
+func NewMetrics() *Metrics {
+	metrics := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_total",
+			Help:      "gRPC requests handled, by method, status code and client.",
+		}, []string{"method", "code", "client"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_duration_seconds",
+			Help:      "Time taken to handle gRPC requests, by method and client.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "client"}),
+		rejectedClientCerts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rejected_client_certificates_total",
+			Help:      "TLS handshakes rejected because the client certificate was revoked, by reason.",
+		}, []string{"reason"}),
+		devices: newDeviceCollector(),
+	}
+
+	metrics.registry.MustRegister(
+		metrics.requests,
+		metrics.requestDuration,
+		metrics.rejectedClientCerts,
+		metrics.devices,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return metrics
+}
+
+// Handler returns an http.Handler that serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Registry returns the Prometheus registry metrics are registered with, so callers can add their own collectors.
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+// UnaryServerInterceptor records the count, status code and latency of unary requests.
+// It must run before the auth interceptor so requests rejected during authentication are counted.
+func (m *Metrics) UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	ctx, client := withRequestClient(ctx)
+	resp, err := handler(ctx, req)
+	m.observe(info.FullMethod, client.identifier, err, time.Since(start))
+	return resp, err
+}
+
+// StreamServerInterceptor records the count, status code and duration of streaming requests.
+// Like UnaryServerInterceptor, it must run before the auth interceptor.
+func (m *Metrics) StreamServerInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	ctx, client := withRequestClient(stream.Context())
+	err := handler(srv, &contextStream{ServerStream: stream, ctx: ctx})
+	m.observe(info.FullMethod, client.identifier, err, time.Since(start))
+	return err
+}
+
+func (m *Metrics) observe(method, client string, err error, duration time.Duration) {
+	code := status.Code(err).String()
+	m.requests.WithLabelValues(method, code, client).Inc()
+	m.requestDuration.WithLabelValues(method, client).Observe(duration.Seconds())
+}
+
+// deviceCollector reads device and peer statistics from Wireguard when Prometheus scrapes it.
+type deviceCollector struct {
+	peers             PeerStore
+	devicePeers       *prometheus.Desc
+	deviceReceived    *prometheus.Desc
+	deviceTransmitted *prometheus.Desc
+	peerReceived      *prometheus.Desc
+	peerTransmitted   *prometheus.Desc
+	peerHandshakeAge  *prometheus.Desc
+	scrapeErrors      prometheus.Counter
+}
+
+func newDeviceCollector() *deviceCollector {
+	return &deviceCollector{
+		devicePeers: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "device", "peers"),
+			"Number of peers configured on a Wireguard device.",
+			[]string{"device"}, nil,
+		),
+		deviceReceived: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "device", "receive_bytes_total"),
+			"Bytes received from all peers on a Wireguard device.",
+			[]string{"device"}, nil,
+		),
+		deviceTransmitted: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "device", "transmit_bytes_total"),
+			"Bytes transmitted to all peers on a Wireguard device.",
+			[]string{"device"}, nil,
+		),
+		peerReceived: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "peer", "receive_bytes_total"),
+			"Bytes received from a peer.",
+			[]string{"device", "public_key", "name"}, nil,
+		),
+		peerTransmitted: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "peer", "transmit_bytes_total"),
+			"Bytes transmitted to a peer.",
+			[]string{"device", "public_key", "name"}, nil,
+		),
+		peerHandshakeAge: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "peer", "last_handshake_age_seconds"),
+			"Seconds since the last handshake with a peer. Peers that have never completed a handshake are omitted.",
+			[]string{"device", "public_key", "name"}, nil,
+		),
+		scrapeErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "device_scrape_errors_total",
+			Help:      "Errors reading device statistics from Wireguard.",
+		}),
+	}
+}
+
+// Describe satisfies prometheus.Collector.
+func (d *deviceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- d.devicePeers
+	ch <- d.deviceReceived
+	ch <- d.deviceTransmitted
+	ch <- d.peerReceived
+	ch <- d.peerTransmitted
+	ch <- d.peerHandshakeAge
+	d.scrapeErrors.Describe(ch)
+}
+
+// Collect satisfies prometheus.Collector.
+func (d *deviceCollector) Collect(ch chan<- prometheus.Metric) {
+	defer d.scrapeErrors.Collect(ch)
+
+	devices, err := Devices()
+	if err != nil {
+		d.scrapeErrors.Inc()
+		return
+	}
+
+	now := time.Now()
+	for _, device := range devices {
+		peers, err := device.Peers()
+		if err != nil {
+			d.scrapeErrors.Inc()
+			continue
+		}
+
+		names := d.peerNames(device.DeviceName)
+		var received, transmitted int64
+		for _, peer := range peers {
+			publicKey := peer.PublicKey.String()
+			name := names[publicKey]
+			received += peer.ReceiveBytes
+			transmitted += peer.TransmitBytes
+
+			ch <- prometheus.MustNewConstMetric(d.peerReceived, prometheus.CounterValue, float64(peer.ReceiveBytes), device.DeviceName, publicKey, name)
+			ch <- prometheus.MustNewConstMetric(d.peerTransmitted, prometheus.CounterValue, float64(peer.TransmitBytes), device.DeviceName, publicKey, name)
+			if !peer.LastHandshakeTime.IsZero() {
+				ch <- prometheus.MustNewConstMetric(d.peerHandshakeAge, prometheus.GaugeValue, now.Sub(peer.LastHandshakeTime).Seconds(), device.DeviceName, publicKey, name)
+			}
+		}
+
+		ch <- prometheus.MustNewConstMetric(d.devicePeers, prometheus.GaugeValue, float64(len(peers)), device.DeviceName)
+		ch <- prometheus.MustNewConstMetric(d.deviceReceived, prometheus.CounterValue, float64(received), device.DeviceName)
+		ch <- prometheus.MustNewConstMetric(d.deviceTransmitted, prometheus.CounterValue, float64(transmitted), device.DeviceName)
+	}
+}
+
+// peerNames returns the friendly names of a device's peers by public key.
+func (d *deviceCollector) peerNames(deviceName string) map[string]string {
+	names := map[string]string{}
+	if d.peers == nil {
+		return names
+	}
+
+	records, err := d.peers.List(deviceName)
+	if err != nil {
+		d.scrapeErrors.Inc()
+		return names
+	}
+	for _, record := range records {
+		names[record.PublicKey] = record.Name
+	}
+	return names
+}
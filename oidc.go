@@ -0,0 +1,394 @@
+package wgrpcd
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/joncooperworks/grpcauth"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// oidcDiscoveryPath is where an OpenID provider publishes its configuration, relative to its issuer.
+	oidcDiscoveryPath = "/.well-known/openid-configuration"
+
+	defaultOIDCScopeClaim       = "scope"
+	defaultOIDCIdentifierClaim  = "sub"
+	defaultJWKSRefreshInterval  = time.Hour
+	defaultJWKSMinRefreshPeriod = time.Minute
+	defaultOIDCClockSkew        = time.Minute
+	defaultJWKSFetchTimeout     = 10 * time.Second
+
+	// minOIDCRSAKeyBits is the smallest RSA key accepted from a JWKS. Shorter keys can be factored.
+	minOIDCRSAKeyBits = 2048
+)
+
+// oidcSigningMethods are the JWS algorithms accepted in tokens from an OpenID provider.
+var oidcSigningMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// OIDCConfig configures an OIDCProvider.
+// Issuer and Audience are required. The other fields have defaults that suit most providers.
+type OIDCConfig struct {
+	// Issuer is the provider's issuer URL, like https://keycloak.example.com/realms/wgrpcd.
+	// The provider's configuration is discovered from Issuer + "/.well-known/openid-configuration", and tokens must have it as their iss claim.
+	Issuer string
+
+	// Audience must be one of the token's aud claims.
+	Audience string
+
+	// ScopeClaim is the claim holding the client's permissions, as a space-separated string or an array of strings.
+	// Nested claims are named with dots, like "realm_access.roles" for Keycloak roles. It defaults to "scope".
+	ScopeClaim string
+
+	// IdentifierClaim is the claim used as the client identifier. It defaults to "sub".
+	IdentifierClaim string
+
+	// JWKSRefreshInterval is how long signing keys are cached before they are fetched again. It defaults to an hour.
+	// Keys are also fetched again, at most once a minute, when a token is signed by a key that isn't cached, so rotated keys are picked up straight away.
+	JWKSRefreshInterval time.Duration
+
+	// ClockSkew is how far exp, nbf and iat may be off from this server's clock. It defaults to a minute.
+	ClockSkew time.Duration
+
+	HTTPClient *http.Client
+	Logger     Logger
+}
+
+// OIDCProvider authenticates clients with access tokens from any OpenID Connect provider that supports discovery, like Keycloak, Okta or Dex.
+type OIDCProvider struct {
+	config  OIDCConfig
+	jwksURI string
+	parser  *jwt.Parser
+	// fetchTimeout bounds background key refreshes, which have no caller context to cancel them.
+	fetchTimeout time.Duration
+
+	mutex       sync.Mutex
+	keys        map[string]crypto.PublicKey
+	refreshedAt time.Time
+	attemptedAt time.Time
+	refreshing  chan struct{}
+}
+
+// oidcDiscovery is the part of an OpenID provider's configuration wgrpcd uses.
+type oidcDiscovery struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+// jsonWebKey is an RSA or EC public key from a JWKS.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// NewOIDCProvider discovers the provider's configuration and fetches its signing keys.
+func NewOIDCProvider(ctx context.Context, config *OIDCConfig) (*OIDCProvider, error) {
+	if config.Issuer == "" || config.Audience == "" {
+		return nil, fmt.Errorf("an OpenID provider needs an issuer and an audience")
+	}
+
+	provider := &OIDCProvider{
+		config:       *config,
+		fetchTimeout: defaultJWKSFetchTimeout,
+	}
+	if provider.config.ScopeClaim == "" {
+		provider.config.ScopeClaim = defaultOIDCScopeClaim
+	}
+	if provider.config.IdentifierClaim == "" {
+		provider.config.IdentifierClaim = defaultOIDCIdentifierClaim
+	}
+	if provider.config.JWKSRefreshInterval <= 0 {
+		provider.config.JWKSRefreshInterval = defaultJWKSRefreshInterval
+	}
+	if provider.config.ClockSkew <= 0 {
+		provider.config.ClockSkew = defaultOIDCClockSkew
+	}
+	if provider.config.HTTPClient == nil {
+		provider.config.HTTPClient = &http.Client{Timeout: defaultJWKSFetchTimeout}
+	}
+	if provider.config.Logger == nil {
+		provider.config.Logger = slog.Default()
+	}
+	provider.parser = jwt.NewParser(
+		jwt.WithValidMethods(oidcSigningMethods),
+		jwt.WithIssuer(config.Issuer),
+		jwt.WithAudience(config.Audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(provider.config.ClockSkew),
+	)
+
+	discovery := &oidcDiscovery{}
+	err := provider.getJSON(ctx, strings.TrimSuffix(config.Issuer, "/")+oidcDiscoveryPath, discovery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover OpenID configuration: %w", err)
+	}
+	if discovery.Issuer != config.Issuer {
+		return nil, fmt.Errorf("OpenID configuration is for issuer %q, expected %q", discovery.Issuer, config.Issuer)
+	}
+	if discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("OpenID configuration has no jwks_uri")
+	}
+	provider.jwksURI = discovery.JWKSURI
+
+	keys, err := provider.fetchKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	provider.keys = keys
+	provider.refreshedAt = time.Now()
+	provider.attemptedAt = provider.refreshedAt
+	return provider, nil
+}
+
+// AuthFunc is a grpcauth.AuthFunc that accepts a bearer access token signed by the provider.
+// The token must be signed by one of the provider's keys, be issued by Issuer for Audience, and not have expired.
+func (o *OIDCProvider) AuthFunc(md metadata.MD) (*grpcauth.AuthResult, error) {
+	if len(md["authorization"]) != 1 {
+		return nil, fmt.Errorf("expected JWT in 'authorization' metadata field")
+	}
+	tokenString := strings.TrimPrefix(md["authorization"][0], "Bearer ")
+
+	claims := jwt.MapClaims{}
+	_, err := o.parser.ParseWithClaims(tokenString, claims, o.keyFunc)
+	if err != nil {
+		return nil, err
+	}
+
+	clientIdentifier, _ := lookupClaim(claims, o.config.IdentifierClaim).(string)
+	if clientIdentifier == "" {
+		return nil, fmt.Errorf("token has no %s claim", o.config.IdentifierClaim)
+	}
+
+	return &grpcauth.AuthResult{
+		ClientIdentifier: clientIdentifier,
+		Timestamp:        time.Now(),
+		Permissions:      claimStrings(lookupClaim(claims, o.config.ScopeClaim)),
+	}, nil
+}
+
+// keyFunc returns the provider's key for the token's kid, only allowing algorithms that suit the key's type.
+func (o *OIDCProvider) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, err := o.key(kid)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey:
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+			return key, nil
+		}
+	case *ecdsa.PublicKey:
+		if _, ok := token.Method.(*jwt.SigningMethodECDSA); ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("signing method %v can't be used with key %q", token.Header["alg"], kid)
+}
+
+// key returns a cached signing key, fetching the keys again if they are stale or don't include kid.
+// Keys are fetched without holding the mutex, so other requests aren't held up by a slow provider.
+// Only requests for a key that isn't cached wait for the fetch to finish.
+func (o *OIDCProvider) key(kid string) (crypto.PublicKey, error) {
+	o.mutex.Lock()
+	key, ok := o.keys[kid]
+	// Keys are fetched at most once a minute, so clients can't make wgrpcd hammer the provider with made up key IDs, and a provider that is down isn't asked on every request.
+	canRefresh := time.Since(o.attemptedAt) > defaultJWKSMinRefreshPeriod
+	stale := canRefresh && time.Since(o.refreshedAt) > o.config.JWKSRefreshInterval
+	rotated := canRefresh && !ok
+	refreshing := o.refreshing
+	if (stale || rotated) && refreshing == nil {
+		refreshing = make(chan struct{})
+		o.refreshing = refreshing
+		o.attemptedAt = time.Now()
+		go o.refreshKeys(refreshing)
+	}
+	o.mutex.Unlock()
+
+	if !ok && refreshing != nil {
+		<-refreshing
+		o.mutex.Lock()
+		key, ok = o.keys[kid]
+		o.mutex.Unlock()
+	}
+
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// refreshKeys fetches the provider's signing keys, swaps them in and closes done.
+func (o *OIDCProvider) refreshKeys(done chan struct{}) {
+	defer close(done)
+
+	// The client's timeout can't be relied on, since HTTPClient may be the caller's own.
+	ctx, cancel := context.WithTimeout(context.Background(), o.fetchTimeout)
+	defer cancel()
+	keys, err := o.fetchKeys(ctx)
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.refreshing = nil
+	if err != nil {
+		// The cached keys are still good for tokens signed by them.
+		o.config.Logger.Error("failed to refresh OpenID signing keys", "jwks_uri", o.jwksURI, logKeyError, err)
+		return
+	}
+	o.keys = keys
+	o.refreshedAt = time.Now()
+}
+
+// fetchKeys downloads the provider's JWKS and returns its RSA and EC signing keys by ID.
+func (o *OIDCProvider) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	jwks := &struct {
+		Keys []*jsonWebKey `json:"keys"`
+	}{}
+	err := o.getJSON(ctx, o.jwksURI, jwks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch OpenID signing keys: %w", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			// Providers can publish key types wgrpcd doesn't use, so they are skipped rather than failing the whole set.
+			o.config.Logger.Warn("skipping OpenID signing key", "kid", jwk.Kid, logKeyError, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no usable signing keys at %s", o.jwksURI)
+	}
+	return keys, nil
+}
+
+func (o *OIDCProvider) getJSON(ctx context.Context, url string, v interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	response, err := o.config.HTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("GET %s returned %s: %s", url, response.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+// publicKey converts a JWK to an *rsa.PublicKey or *ecdsa.PublicKey.
+func (j *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(j.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %w", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(j.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exponent: %w", err)
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 || exponent.Int64() < 3 {
+			return nil, fmt.Errorf("invalid exponent")
+		}
+		modulus := new(big.Int).SetBytes(n)
+		if modulus.BitLen() < minOIDCRSAKeyBits {
+			return nil, fmt.Errorf("RSA key is %d bits, at least %d are required", modulus.BitLen(), minOIDCRSAKeyBits)
+		}
+		return &rsa.PublicKey{N: modulus, E: int(exponent.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", j.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x coordinate: %w", err)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(j.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y coordinate: %w", err)
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("point is not on curve %s", j.Crv)
+		}
+		return key, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", j.Kty)
+	}
+}
+
+// lookupClaim returns the claim at a dotted path, like "realm_access.roles", or nil if there isn't one.
+func lookupClaim(claims map[string]interface{}, name string) interface{} {
+	var value interface{} = claims
+	for _, element := range strings.Split(name, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[element]
+	}
+	return value
+}
+
+// claimStrings returns a claim that is a space-separated string or an array of strings as a slice.
+func claimStrings(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		values := []string{}
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return []string{}
+	}
+}
@@ -0,0 +1,477 @@
+package wgrpcd
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc/metadata"
+)
+
+const testAudience = "https://wgrpcd.example.com"
+
+// stubIdP is an OpenID provider serving its configuration and a JWKS that tests can change.
+type stubIdP struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	issuer   string
+	keys     []*jsonWebKey
+	fetches  int
+	jwksGate chan struct{}
+}
+
+func newStubIdP(t *testing.T) *stubIdP {
+	idp := &stubIdP{}
+	mux := http.NewServeMux()
+	mux.HandleFunc(oidcDiscoveryPath, func(w http.ResponseWriter, r *http.Request) {
+		idp.mutex.Lock()
+		defer idp.mutex.Unlock()
+		json.NewEncoder(w).Encode(&oidcDiscovery{Issuer: idp.issuer, JWKSURI: idp.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		idp.mutex.Lock()
+		gate := idp.jwksGate
+		idp.mutex.Unlock()
+		if gate != nil {
+			<-gate
+		}
+
+		idp.mutex.Lock()
+		defer idp.mutex.Unlock()
+		idp.fetches++
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": idp.keys})
+	})
+	idp.Server = httptest.NewServer(mux)
+	idp.issuer = idp.URL
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// publish replaces the keys in the JWKS.
+func (s *stubIdP) publish(keys ...*jsonWebKey) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keys = keys
+}
+
+func (s *stubIdP) fetchCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.fetches
+}
+
+// testSigningKey is a provider's private key and its JWK.
+type testSigningKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	private crypto.Signer
+}
+
+func newRSASigningKey(t *testing.T, kid string) *testSigningKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate RSA key: %v", err)
+	}
+	return &testSigningKey{kid: kid, method: jwt.SigningMethodRS256, private: key}
+}
+
+func newECSigningKey(t *testing.T, kid string) *testSigningKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate EC key: %v", err)
+	}
+	return &testSigningKey{kid: kid, method: jwt.SigningMethodES256, private: key}
+}
+
+func (k *testSigningKey) jwk() *jsonWebKey {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch key := k.private.(type) {
+	case *rsa.PrivateKey:
+		return &jsonWebKey{Kty: "RSA", Kid: k.kid, Use: "sig", N: encode(key.N.Bytes()), E: encode(big.NewInt(int64(key.E)).Bytes())}
+	case *ecdsa.PrivateKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		return &jsonWebKey{Kty: "EC", Kid: k.kid, Crv: "P-256", X: encode(key.X.FillBytes(make([]byte, size))), Y: encode(key.Y.FillBytes(make([]byte, size)))}
+	}
+	return nil
+}
+
+func (k *testSigningKey) sign(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(k.method, claims)
+	token.Header["kid"] = k.kid
+	signed, err := token.SignedString(k.private)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return signed
+}
+
+// validClaims returns claims the stub IdP's provider accepts.
+func validClaims(idp *stubIdP) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":   idp.URL,
+		"aud":   testAudience,
+		"sub":   "billing",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"scope": "provisioner ListPeers",
+	}
+}
+
+func newTestOIDCProvider(t *testing.T, idp *stubIdP, config *OIDCConfig) *OIDCProvider {
+	t.Helper()
+
+	if config == nil {
+		config = &OIDCConfig{}
+	}
+	config.Issuer = idp.URL
+	config.Audience = testAudience
+	config.Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	provider, err := NewOIDCProvider(context.Background(), config)
+	if err != nil {
+		t.Fatalf("NewOIDCProvider: %v", err)
+	}
+	return provider
+}
+
+func bearer(token string) metadata.MD {
+	return metadata.Pairs("authorization", "Bearer "+token)
+}
+
+func TestNewOIDCProviderDiscovery(t *testing.T) {
+	idp := newStubIdP(t)
+	key := newRSASigningKey(t, "rsa")
+	idp.publish(key.jwk())
+	newTestOIDCProvider(t, idp, nil)
+	if idp.fetchCount() != 1 {
+		t.Errorf("got %d JWKS fetches, want 1", idp.fetchCount())
+	}
+
+	idp.mutex.Lock()
+	idp.issuer = "https://someone-else.example.com"
+	idp.mutex.Unlock()
+	_, err := NewOIDCProvider(context.Background(), &OIDCConfig{Issuer: idp.URL, Audience: testAudience})
+	if err == nil {
+		t.Error("expected an error for a configuration naming another issuer")
+	}
+
+	idp.mutex.Lock()
+	idp.issuer = idp.URL
+	idp.mutex.Unlock()
+	idp.publish()
+	_, err = NewOIDCProvider(context.Background(), &OIDCConfig{Issuer: idp.URL, Audience: testAudience})
+	if err == nil {
+		t.Error("expected an error for a JWKS without usable keys")
+	}
+}
+
+func TestOIDCProviderAcceptsValidTokens(t *testing.T) {
+	idp := newStubIdP(t)
+	rsaKey, ecKey := newRSASigningKey(t, "rsa"), newECSigningKey(t, "ec")
+	idp.publish(rsaKey.jwk(), ecKey.jwk())
+	provider := newTestOIDCProvider(t, idp, nil)
+
+	for _, key := range []*testSigningKey{rsaKey, ecKey} {
+		result, err := provider.AuthFunc(bearer(key.sign(t, validClaims(idp))))
+		if err != nil {
+			t.Fatalf("%s token refused: %v", key.kid, err)
+		}
+		if result.ClientIdentifier != "billing" {
+			t.Errorf("got client %q, want billing", result.ClientIdentifier)
+		}
+		if want := []string{"provisioner", "ListPeers"}; !reflect.DeepEqual(result.Permissions, want) {
+			t.Errorf("got permissions %v, want %v", result.Permissions, want)
+		}
+	}
+}
+
+func TestOIDCProviderReadsNestedScopeClaims(t *testing.T) {
+	idp := newStubIdP(t)
+	key := newRSASigningKey(t, "rsa")
+	idp.publish(key.jwk())
+	provider := newTestOIDCProvider(t, idp, &OIDCConfig{ScopeClaim: "realm_access.roles"})
+
+	claims := validClaims(idp)
+	claims["aud"] = []string{"account", testAudience}
+	claims["realm_access"] = map[string]interface{}{"roles": []string{"reader"}}
+	result, err := provider.AuthFunc(bearer(key.sign(t, claims)))
+	if err != nil {
+		t.Fatalf("token refused: %v", err)
+	}
+	if want := []string{"reader"}; !reflect.DeepEqual(result.Permissions, want) {
+		t.Errorf("got permissions %v, want %v", result.Permissions, want)
+	}
+}
+
+func TestOIDCProviderRefusesInvalidTokens(t *testing.T) {
+	idp := newStubIdP(t)
+	key := newRSASigningKey(t, "rsa")
+	idp.publish(key.jwk())
+	provider := newTestOIDCProvider(t, idp, nil)
+
+	with := func(name string, value interface{}) jwt.MapClaims {
+		claims := validClaims(idp)
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+	unpublished := newRSASigningKey(t, "rsa")
+	tests := map[string]string{
+		"expired":           key.sign(t, with("exp", time.Now().Add(-2*time.Minute).Unix())),
+		"no expiry":         key.sign(t, with("exp", nil)),
+		"not valid yet":     key.sign(t, with("nbf", time.Now().Add(2*time.Minute).Unix())),
+		"issued in future":  key.sign(t, with("iat", time.Now().Add(2*time.Minute).Unix())),
+		"wrong issuer":      key.sign(t, with("iss", "https://someone-else.example.com")),
+		"wrong audience":    key.sign(t, with("aud", "https://other.example.com")),
+		"no subject":        key.sign(t, with("sub", nil)),
+		"unpublished key":   unpublished.sign(t, validClaims(idp)),
+		"unsigned":          unsignedToken(t, validClaims(idp)),
+		"HMAC with the JWK": hmacToken(t, key, validClaims(idp)),
+		"not a JWT":         "not-a-jwt",
+	}
+	for name, token := range tests {
+		_, err := provider.AuthFunc(bearer(token))
+		if err == nil {
+			t.Errorf("%s: token was accepted", name)
+		}
+	}
+
+	_, err := provider.AuthFunc(metadata.MD{})
+	if err == nil {
+		t.Error("request without a token was accepted")
+	}
+}
+
+func TestOIDCProviderAllowsClockSkew(t *testing.T) {
+	idp := newStubIdP(t)
+	key := newRSASigningKey(t, "rsa")
+	idp.publish(key.jwk())
+	provider := newTestOIDCProvider(t, idp, nil)
+
+	claims := validClaims(idp)
+	claims["exp"] = time.Now().Add(-30 * time.Second).Unix()
+	claims["iat"] = time.Now().Add(30 * time.Second).Unix()
+	_, err := provider.AuthFunc(bearer(key.sign(t, claims)))
+	if err != nil {
+		t.Errorf("token within the clock skew refused: %v", err)
+	}
+}
+
+// unsignedToken returns a token using the "none" algorithm.
+func unsignedToken(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatalf("failed to create unsigned token: %v", err)
+	}
+	return signed
+}
+
+// hmacToken returns a token signed with HS256, keyed with the JSON of an RSA public key, as in an algorithm confusion attack.
+func hmacToken(t *testing.T, key *testSigningKey, claims jwt.MapClaims) string {
+	t.Helper()
+
+	secret, err := json.Marshal(key.jwk())
+	if err != nil {
+		t.Fatalf("failed to encode JWK: %v", err)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = key.kid
+	signed, err := token.SignedString(secret)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return signed
+}
+
+func TestOIDCProviderPicksUpRotatedKeys(t *testing.T) {
+	idp := newStubIdP(t)
+	oldKey, newKey := newRSASigningKey(t, "2026-09"), newECSigningKey(t, "2026-10")
+	idp.publish(oldKey.jwk())
+	provider := newTestOIDCProvider(t, idp, nil)
+
+	// Unknown keys don't trigger a fetch within a minute of the last one.
+	idp.publish(oldKey.jwk(), newKey.jwk())
+	_, err := provider.AuthFunc(bearer(newKey.sign(t, validClaims(idp))))
+	if err == nil {
+		t.Fatal("token signed by a key fetched less than a minute ago was accepted")
+	}
+	if idp.fetchCount() != 1 {
+		t.Errorf("got %d JWKS fetches, want 1", idp.fetchCount())
+	}
+
+	provider.mutex.Lock()
+	provider.attemptedAt = time.Now().Add(-2 * defaultJWKSMinRefreshPeriod)
+	provider.mutex.Unlock()
+	_, err = provider.AuthFunc(bearer(newKey.sign(t, validClaims(idp))))
+	if err != nil {
+		t.Fatalf("token signed by the new key refused: %v", err)
+	}
+	if idp.fetchCount() != 2 {
+		t.Errorf("got %d JWKS fetches, want 2", idp.fetchCount())
+	}
+
+	// Once the old key is retired, it can't sign tokens.
+	idp.publish(newKey.jwk())
+	provider.mutex.Lock()
+	provider.refreshedAt = time.Now().Add(-2 * defaultJWKSRefreshInterval)
+	provider.attemptedAt = provider.refreshedAt
+	provider.mutex.Unlock()
+	// The stale keys are refreshed in the background, so the first token after they go stale is still checked against them.
+	provider.AuthFunc(bearer(oldKey.sign(t, validClaims(idp))))
+	waitForKeyRefresh(t, provider)
+	_, err = provider.AuthFunc(bearer(oldKey.sign(t, validClaims(idp))))
+	if err == nil {
+		t.Error("token signed by a retired key was accepted")
+	}
+}
+
+func TestOIDCProviderRefreshDoesNotBlockCachedKeys(t *testing.T) {
+	idp := newStubIdP(t)
+	key := newRSASigningKey(t, "rsa")
+	idp.publish(key.jwk())
+	provider := newTestOIDCProvider(t, idp, nil)
+
+	gate := make(chan struct{})
+	idp.mutex.Lock()
+	idp.jwksGate = gate
+	idp.mutex.Unlock()
+	provider.mutex.Lock()
+	provider.refreshedAt = time.Now().Add(-2 * defaultJWKSRefreshInterval)
+	provider.attemptedAt = provider.refreshedAt
+	provider.mutex.Unlock()
+
+	// The stale keys start a refresh that hangs until the gate is opened.
+	finished := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := provider.AuthFunc(bearer(key.sign(t, validClaims(idp))))
+			finished <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-finished:
+			if err != nil {
+				t.Errorf("token signed by a cached key refused: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("request waited for the JWKS to be fetched")
+		}
+	}
+
+	close(gate)
+	waitForKeyRefresh(t, provider)
+	if idp.fetchCount() != 2 {
+		t.Errorf("got %d JWKS fetches, want 2", idp.fetchCount())
+	}
+}
+
+// waitForKeyRefresh waits for a background refresh of the provider's keys to finish.
+func waitForKeyRefresh(t *testing.T, provider *OIDCProvider) {
+	t.Helper()
+
+	provider.mutex.Lock()
+	refreshing := provider.refreshing
+	provider.mutex.Unlock()
+	if refreshing == nil {
+		return
+	}
+	select {
+	case <-refreshing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("keys were never refreshed")
+	}
+}
+
+func TestOIDCProviderSkipsShortRSAKeys(t *testing.T) {
+	private, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("failed to generate RSA key: %v", err)
+	}
+	short := &testSigningKey{kid: "short", method: jwt.SigningMethodRS256, private: private}
+	if _, err := short.jwk().publicKey(); err == nil {
+		t.Error("1024 bit RSA key was accepted")
+	}
+
+	idp := newStubIdP(t)
+	idp.publish(short.jwk())
+	_, err = NewOIDCProvider(context.Background(), &OIDCConfig{
+		Issuer:   idp.URL,
+		Audience: testAudience,
+		Logger:   slog.New(slog.NewTextHandler(ioutil.Discard, nil)),
+	})
+	if err == nil {
+		t.Error("provider was created with only a short RSA key")
+	}
+
+	key := newRSASigningKey(t, "rsa")
+	idp.publish(short.jwk(), key.jwk())
+	provider := newTestOIDCProvider(t, idp, nil)
+	_, err = provider.AuthFunc(bearer(short.sign(t, validClaims(idp))))
+	if err == nil {
+		t.Error("token signed by a short RSA key was accepted")
+	}
+	_, err = provider.AuthFunc(bearer(key.sign(t, validClaims(idp))))
+	if err != nil {
+		t.Errorf("token signed by a 2048 bit RSA key refused: %v", err)
+	}
+}
+
+func TestOIDCProviderRefreshTimesOut(t *testing.T) {
+	idp := newStubIdP(t)
+	key := newRSASigningKey(t, "rsa")
+	idp.publish(key.jwk())
+	// The HTTP client has no timeout of its own, so only the refresh's context can stop it.
+	provider := newTestOIDCProvider(t, idp, &OIDCConfig{HTTPClient: &http.Client{}})
+	provider.fetchTimeout = 50 * time.Millisecond
+
+	gate := make(chan struct{})
+	idp.mutex.Lock()
+	idp.jwksGate = gate
+	idp.mutex.Unlock()
+	// The stub can't shut down while a request waits on the gate.
+	t.Cleanup(func() { close(gate) })
+	provider.mutex.Lock()
+	provider.refreshedAt = time.Now().Add(-2 * defaultJWKSRefreshInterval)
+	provider.attemptedAt = provider.refreshedAt
+	provider.mutex.Unlock()
+
+	_, err := provider.AuthFunc(bearer(key.sign(t, validClaims(idp))))
+	if err != nil {
+		t.Fatalf("token signed by a cached key refused: %v", err)
+	}
+	waitForKeyRefresh(t, provider)
+
+	provider.mutex.Lock()
+	refreshing := provider.refreshing
+	provider.mutex.Unlock()
+	if refreshing != nil {
+		t.Error("a refresh is still running after it timed out")
+	}
+	_, err = provider.AuthFunc(bearer(key.sign(t, validClaims(idp))))
+	if err != nil {
+		t.Errorf("cached key was dropped after a refresh timed out: %v", err)
+	}
+}
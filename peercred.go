@@ -0,0 +1,305 @@
+package wgrpcd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/user"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/joncooperworks/grpcauth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// Metadata keys identifyPeerCred puts the uid and gid of a process connected over a Unix socket under, for PeerCredAuth to read.
+// Any values the client sends itself are removed first.
+const (
+	peerCredUIDKey = "x-wgrpcd-peer-uid"
+	peerCredGIDKey = "x-wgrpcd-peer-gid"
+)
+
+// PeerCredInfo is the credentials.AuthInfo of a connection over a Unix socket, holding the credentials of the process that connected.
+type PeerCredInfo struct {
+	credentials.CommonAuthInfo
+	UID uint32
+	GID uint32
+	PID int32
+}
+
+// AuthType returns "peercred".
+func (PeerCredInfo) AuthType() string {
+	return "peercred"
+}
+
+// peerCredCredentials are TransportCredentials that use TLS for TCP connections, and read the peer's credentials with SO_PEERCRED for Unix socket connections.
+// Only processes on the same host can connect to a Unix socket, so those connections don't need TLS.
+type peerCredCredentials struct {
+	credentials.TransportCredentials
+}
+
+// ServerHandshake reads the peer's credentials for Unix socket connections and performs the TLS handshake for everything else.
+func (p *peerCredCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return p.TransportCredentials.ServerHandshake(conn)
+	}
+
+	info, err := peerCred(unixConn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to read Unix socket peer credentials: %w", err)
+	}
+	info.CommonAuthInfo = credentials.CommonAuthInfo{SecurityLevel: credentials.PrivacyAndIntegrity}
+	return conn, info, nil
+}
+
+// Clone returns a copy of the credentials.
+func (p *peerCredCredentials) Clone() credentials.TransportCredentials {
+	return &peerCredCredentials{TransportCredentials: p.TransportCredentials.Clone()}
+}
+
+// identifyPeerCred replaces peerCredUIDKey and peerCredGIDKey in the request metadata with the credentials of a process connected over a Unix socket.
+// Processes using a Unix socket don't need to send an authorization token, so an empty one is added for the auth interceptor if they don't.
+// It must run before the auth interceptor.
+func identifyPeerCred(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		md = metadata.MD{}
+	}
+	md = md.Copy()
+	md.Delete(peerCredUIDKey)
+	md.Delete(peerCredGIDKey)
+
+	p, ok := peer.FromContext(ctx)
+	if ok {
+		if info, ok := p.AuthInfo.(*PeerCredInfo); ok {
+			md.Set(peerCredUIDKey, strconv.FormatUint(uint64(info.UID), 10))
+			md.Set(peerCredGIDKey, strconv.FormatUint(uint64(info.GID), 10))
+			if len(md.Get("authorization")) == 0 {
+				md.Set("authorization", "")
+			}
+		}
+	}
+	return metadata.NewIncomingContext(ctx, md)
+}
+
+// identifyPeerCredUnary is identifyPeerCred for unary RPCs.
+func identifyPeerCredUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return handler(identifyPeerCred(ctx), req)
+}
+
+// identifyPeerCredStream is identifyPeerCred for streaming RPCs.
+func identifyPeerCredStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &contextStream{ServerStream: stream, ctx: identifyPeerCred(stream.Context())})
+}
+
+// PeerCredGrant gives processes running as User, or with Group as their primary group, the permissions in Permissions.
+// User and Group can be names or numeric IDs. A grant names one or the other.
+type PeerCredGrant struct {
+	User        string   `json:"user,omitempty"`
+	Group       string   `json:"group,omitempty"`
+	Permissions []string `json:"permissions"`
+
+	uid, gid uint32
+}
+
+// PeerCredPolicy maps the users and groups of processes connecting over a Unix socket to the permissions they hold.
+// A process gets the permissions of every grant it matches, and none if it matches no grant.
+type PeerCredPolicy struct {
+	Grants []*PeerCredGrant `json:"grants"`
+}
+
+// LoadPeerCredPolicy reads a PeerCredPolicy from a JSON file, looking up the users and groups it names.
+func LoadPeerCredPolicy(filename string) (*PeerCredPolicy, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &PeerCredPolicy{}
+	err = json.Unmarshal(contents, policy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Unix socket policy %s: %w", filename, err)
+	}
+	err = policy.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid Unix socket policy %s: %w", filename, err)
+	}
+	return policy, nil
+}
+
+// Validate checks every grant names a user or group that exists and has at least one permission, and looks up their IDs.
+func (p *PeerCredPolicy) Validate() error {
+	for i, grant := range p.Grants {
+		if (grant.User == "") == (grant.Group == "") {
+			return fmt.Errorf("grant %d must have a user or a group", i)
+		}
+		if len(grant.Permissions) == 0 {
+			return fmt.Errorf("grant %d has no permissions", i)
+		}
+
+		var err error
+		if grant.User != "" {
+			grant.uid, err = lookupID(grant.User, func(name string) (string, error) {
+				u, err := user.Lookup(name)
+				if err != nil {
+					return "", err
+				}
+				return u.Uid, nil
+			})
+		} else {
+			grant.gid, err = lookupID(grant.Group, func(name string) (string, error) {
+				g, err := user.LookupGroup(name)
+				if err != nil {
+					return "", err
+				}
+				return g.Gid, nil
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("grant %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// lookupID returns nameOrID as a number if it is one, or looks it up by name.
+func lookupID(nameOrID string, lookup func(string) (string, error)) (uint32, error) {
+	id, err := strconv.ParseUint(nameOrID, 10, 32)
+	if err == nil {
+		return uint32(id), nil
+	}
+	idString, err := lookup(nameOrID)
+	if err != nil {
+		return 0, err
+	}
+	id, err = strconv.ParseUint(idString, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%s has non-numeric ID %s", nameOrID, idString)
+	}
+	return uint32(id), nil
+}
+
+// Permissions returns the sorted permissions granted to a process running as uid with primary group gid.
+func (p *PeerCredPolicy) Permissions(uid, gid uint32) []string {
+	permissions := map[string]bool{}
+	for _, grant := range p.Grants {
+		if (grant.User != "" && grant.uid == uid) || (grant.Group != "" && grant.gid == gid) {
+			for _, permission := range grant.Permissions {
+				permissions[permission] = true
+			}
+		}
+	}
+
+	sorted := make([]string, 0, len(permissions))
+	for permission := range permissions {
+		sorted = append(sorted, permission)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// PeerCredAuth authenticates processes connecting over a Unix socket by the uid and gid the kernel reports for them, and authorizes them with a PeerCredPolicy.
+// Set it as ServerConfig.PeerCredAuth and serve the gRPC server on a Unix socket listener as well as the TCP one.
+// Clients connecting over TCP still use TLS and the AuthFunc.
+type PeerCredAuth struct {
+	mutex  sync.RWMutex
+	policy *PeerCredPolicy
+}
+
+// NewPeerCredAuth returns a PeerCredAuth using policy.
+func NewPeerCredAuth(policy *PeerCredPolicy) (*PeerCredAuth, error) {
+	auth := &PeerCredAuth{}
+	err := auth.SetPolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+// SetPolicy replaces the policy used for requests that haven't been authenticated yet.
+func (p *PeerCredAuth) SetPolicy(policy *PeerCredPolicy) error {
+	err := policy.Validate()
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.policy = policy
+	return nil
+}
+
+// AuthFunc is a grpcauth.AuthFunc that identifies a process connected over a Unix socket by its user.
+// Processes matching no grant are authenticated with no permissions, so they are refused with PermissionDenied naming their user.
+func (p *PeerCredAuth) AuthFunc(md metadata.MD) (*grpcauth.AuthResult, error) {
+	uids, gids := md.Get(peerCredUIDKey), md.Get(peerCredGIDKey)
+	if len(uids) != 1 || len(gids) != 1 {
+		return nil, fmt.Errorf("no Unix socket peer credentials")
+	}
+	uid, err := strconv.ParseUint(uids[0], 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(gids[0], 10, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mutex.RLock()
+	policy := p.policy
+	p.mutex.RUnlock()
+
+	return &grpcauth.AuthResult{
+		ClientIdentifier: peerCredIdentifier(uids[0]),
+		Timestamp:        time.Now(),
+		Permissions:      policy.Permissions(uint32(uid), uint32(gid)),
+	}, nil
+}
+
+// peerCredIdentifier names a process by its user, like "unix:www-data", or its uid if the user can't be looked up.
+func peerCredIdentifier(uid string) string {
+	u, err := user.LookupId(uid)
+	if err != nil {
+		return "unix:uid=" + uid
+	}
+	return "unix:" + u.Username
+}
+
+// isPeerCred returns true if a request came over a Unix socket.
+func isPeerCred(ctx context.Context) bool {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return false
+	}
+	_, ok = p.AuthInfo.(*PeerCredInfo)
+	return ok
+}
+
+// peerCredOrUnary authorizes unary requests that came over a Unix socket with peerCredAuth, and all others with auth.
+func peerCredOrUnary(peerCredAuth, auth grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if isPeerCred(ctx) {
+			return peerCredAuth(ctx, req, info, handler)
+		}
+		return auth(ctx, req, info, handler)
+	}
+}
+
+// peerCredOrStream authorizes streams that came over a Unix socket with peerCredAuth, and all others with auth.
+func peerCredOrStream(peerCredAuth, auth grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if isPeerCred(stream.Context()) {
+			return peerCredAuth(srv, stream, info, handler)
+		}
+		return auth(srv, stream, info, handler)
+	}
+}
@@ -0,0 +1,28 @@
+package wgrpcd
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerCred reads the credentials of the process at the other end of a Unix socket with SO_PEERCRED.
+// The kernel records them when the process connects, so the process can't forge them.
+func peerCred(conn *net.UnixConn) (*PeerCredInfo, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var ucred *syscall.Ucred
+	var sockoptErr error
+	err = rawConn.Control(func(fd uintptr) {
+		ucred, sockoptErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockoptErr != nil {
+		return nil, sockoptErr
+	}
+	return &PeerCredInfo{UID: ucred.Uid, GID: ucred.Gid, PID: ucred.Pid}, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package wgrpcd
+
+import (
+	"fmt"
+	"net"
+)
+
+// peerCred is only supported on Linux, where SO_PEERCRED is available.
+func peerCred(conn *net.UnixConn) (*PeerCredInfo, error) {
+	return nil, fmt.Errorf("Unix socket peer credentials are only supported on Linux")
+}
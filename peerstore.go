@@ -0,0 +1,236 @@
+package wgrpcd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// PeerRecord is the information wgrpcd keeps about a peer that Wireguard itself has no room for.
+// Records are keyed by device name and public key.
+// Suspended peers are not on the device, so their record also holds everything needed to restore them.
+type PeerRecord struct {
+	DeviceName string            `json:"deviceName"`
+	PublicKey  string            `json:"publicKey"`
+	Name       string            `json:"name,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Suspended  *SuspendedPeer    `json:"suspended,omitempty"`
+}
+
+// SuspendedPeer is the device configuration of a peer saved by SuspendPeer.
+type SuspendedPeer struct {
+	AllowedIPs                  []string      `json:"allowedIPs"`
+	PresharedKey                string        `json:"presharedKey,omitempty"`
+	Endpoint                    string        `json:"endpoint,omitempty"`
+	PersistentKeepaliveInterval time.Duration `json:"persistentKeepaliveInterval,omitempty"`
+	LastHandshakeTime           time.Time     `json:"lastHandshakeTime"`
+	SuspendedAt                 time.Time     `json:"suspendedAt"`
+}
+
+// PeerConfig returns the wgtypes.PeerConfig that puts a suspended peer back on its device.
+func (s *SuspendedPeer) PeerConfig(publicKey wgtypes.Key) (*wgtypes.PeerConfig, error) {
+	allowedIPs, err := StringsToIPNet(s.AllowedIPs)
+	if err != nil {
+		return nil, err
+	}
+
+	peerConfig := &wgtypes.PeerConfig{
+		PublicKey:                   publicKey,
+		AllowedIPs:                  allowedIPs,
+		PersistentKeepaliveInterval: &s.PersistentKeepaliveInterval,
+	}
+	if s.PresharedKey != "" {
+		presharedKey, err := wgtypes.ParseKey(s.PresharedKey)
+		if err != nil {
+			return nil, err
+		}
+		peerConfig.PresharedKey = &presharedKey
+	}
+	if s.Endpoint != "" {
+		endpoint, err := net.ResolveUDPAddr("udp", s.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		peerConfig.Endpoint = endpoint
+	}
+	return peerConfig, nil
+}
+
+// PeerStore persists PeerRecords for a wgrpcd server.
+// Get returns nil and no error if there is no record for the peer.
+type PeerStore interface {
+	Get(deviceName, publicKey string) (*PeerRecord, error)
+	Put(record *PeerRecord) error
+	Delete(deviceName, publicKey string) error
+	List(deviceName string) ([]*PeerRecord, error)
+}
+
+// FilePeerStore is a PeerStore that keeps records in memory and writes them to a JSON file after every change.
+// A FilePeerStore with an empty filename is never written to disk.
+type FilePeerStore struct {
+	filename string
+	mutex    sync.Mutex
+	records  map[string]*PeerRecord
+}
+
+// filePeerStoreContents is the on-disk format of a FilePeerStore.
+type filePeerStoreContents struct {
+	Peers []*PeerRecord `json:"peers"`
+}
+
+// NewFilePeerStore returns a FilePeerStore loaded from filename.
+// A missing file is treated as an empty store and will be created on the first write.
+func NewFilePeerStore(filename string) (*FilePeerStore, error) {
+	store := newMemoryPeerStore()
+	if filename == "" {
+		return store, nil
+	}
+	store.filename = filename
+
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, err
+	}
+
+	var decoded filePeerStoreContents
+	err = json.Unmarshal(contents, &decoded)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, record := range decoded.Peers {
+		store.records[peerRecordKey(record.DeviceName, record.PublicKey)] = record
+	}
+	return store, nil
+}
+
+// newMemoryPeerStore returns a FilePeerStore that is never written to disk.
+func newMemoryPeerStore() *FilePeerStore {
+	return &FilePeerStore{
+		records: map[string]*PeerRecord{},
+	}
+}
+
+// Get returns the record for a peer on a device, or nil if there isn't one.
+func (f *FilePeerStore) Get(deviceName, publicKey string) (*PeerRecord, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	record, ok := f.records[peerRecordKey(deviceName, publicKey)]
+	if !ok {
+		return nil, nil
+	}
+	return record.copy(), nil
+}
+
+// Put creates or replaces the record for a peer.
+// The store is left unchanged if the record can't be saved.
+func (f *FilePeerStore) Put(record *PeerRecord) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	key := peerRecordKey(record.DeviceName, record.PublicKey)
+	previous, existed := f.records[key]
+	f.records[key] = record.copy()
+	err := f.save()
+	if err != nil {
+		if existed {
+			f.records[key] = previous
+		} else {
+			delete(f.records, key)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes the record for a peer, if one exists.
+// The record is kept if the store can't be saved.
+func (f *FilePeerStore) Delete(deviceName, publicKey string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	key := peerRecordKey(deviceName, publicKey)
+	previous, ok := f.records[key]
+	if !ok {
+		return nil
+	}
+	delete(f.records, key)
+	err := f.save()
+	if err != nil {
+		f.records[key] = previous
+		return err
+	}
+	return nil
+}
+
+// List returns all records for a device ordered by public key.
+func (f *FilePeerStore) List(deviceName string) ([]*PeerRecord, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	records := []*PeerRecord{}
+	for _, record := range f.records {
+		if record.DeviceName == deviceName {
+			records = append(records, record.copy())
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].PublicKey < records[j].PublicKey
+	})
+	return records, nil
+}
+
+// save writes the store to disk.
+// Callers must hold f.mutex.
+func (f *FilePeerStore) save() error {
+	if f.filename == "" {
+		return nil
+	}
+
+	contents := filePeerStoreContents{Peers: []*PeerRecord{}}
+	for _, record := range f.records {
+		contents.Peers = append(contents.Peers, record)
+	}
+	sort.Slice(contents.Peers, func(i, j int) bool {
+		if contents.Peers[i].DeviceName != contents.Peers[j].DeviceName {
+			return contents.Peers[i].DeviceName < contents.Peers[j].DeviceName
+		}
+		return contents.Peers[i].PublicKey < contents.Peers[j].PublicKey
+	})
+
+	b, err := json.MarshalIndent(contents, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.filename, b, 0600)
+}
+
+func (r *PeerRecord) copy() *PeerRecord {
+	record := *r
+	if r.Labels != nil {
+		record.Labels = make(map[string]string, len(r.Labels))
+		for k, v := range r.Labels {
+			record.Labels[k] = v
+		}
+	}
+	if r.Suspended != nil {
+		suspended := *r.Suspended
+		suspended.AllowedIPs = append([]string{}, r.Suspended.AllowedIPs...)
+		record.Suspended = &suspended
+	}
+	return &record
+}
+
+func peerRecordKey(deviceName, publicKey string) string {
+	return deviceName + "/" + publicKey
+}
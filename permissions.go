@@ -16,9 +16,43 @@ const (
 	// PermissionRemovePeer allows a client to remove a peer from the interface.
 	PermissionRemovePeer = "/wgrpcd.WireguardRPC/RemovePeer"
 
+	// PermissionImport allows a client to add many peers to a device at once.
+	PermissionImport = "/wgrpcd.WireguardRPC/Import"
+
 	// PermissionListPeers allows a client to list active peers.
 	PermissionListPeers = "/wgrpcd.WireguardRPC/ListPeers"
 
+	// PermissionWatchPeers allows a client to stream changes to peers as they happen.
+	PermissionWatchPeers = "/wgrpcd.WireguardRPC/WatchPeers"
+
 	// PermissionListDevices allows a client to list active Wireguard interfaces on a host.
 	PermissionListDevices = "/wgrpcd.WireguardRPC/Devices"
+
+	// PermissionSuspendPeer allows a client to take a peer off the interface while keeping its configuration.
+	PermissionSuspendPeer = "/wgrpcd.WireguardRPC/SuspendPeer"
+
+	// PermissionResumePeer allows a client to put a suspended peer back on the interface.
+	PermissionResumePeer = "/wgrpcd.WireguardRPC/ResumePeer"
+
+	// PermissionListRevokedKeys allows a client to view the denylist of revoked public keys.
+	PermissionListRevokedKeys = "/wgrpcd.WireguardRPC/ListRevokedKeys"
+
+	// PermissionLiftRevocation allows a client to remove a public key from the denylist so it can be added to a device again.
+	// It should be granted separately from the permissions that revoke keys.
+	PermissionLiftRevocation = "/wgrpcd.WireguardRPC/LiftRevocation"
+
+	// PermissionQueryAudit allows a client to read the audit log.
+	// The audit log names every client and peer key that has changed, so it should only be granted to auditors and admins.
+	PermissionQueryAudit = "/wgrpcd.WireguardRPC/QueryAudit"
+
+	// PermissionHealthCheck allows a client to check the server's health.
+	// Health checks only need it when ServerConfig.AuthenticateHealthChecks is set.
+	PermissionHealthCheck = "/grpc.health.v1.Health/Check"
+
+	// PermissionHealthWatch allows a client to stream the server's health.
+	// Health checks only need it when ServerConfig.AuthenticateHealthChecks is set.
+	PermissionHealthWatch = "/grpc.health.v1.Health/Watch"
+
+	// PermissionReflection allows a client to list the server's services and their protobuf definitions with gRPC server reflection, as grpcurl does.
+	PermissionReflection = "/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo"
 )
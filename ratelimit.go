@@ -0,0 +1,267 @@
+package wgrpcd
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joncooperworks/grpcauth"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// RetryAfterKey is the metadata key of the number of seconds a rate limited client should wait before trying again.
+// It is sent in the trailer of ResourceExhausted errors, which also carry an errdetails.RetryInfo.
+const RetryAfterKey = "retry-after"
+
+// rateLimitPruneInterval is how often token buckets that have refilled are forgotten, so clients that stop calling don't hold memory.
+const rateLimitPruneInterval = time.Minute
+
+// RateLimit is a token bucket: a client can make Burst calls at once, then Rate calls a second after that.
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// RateLimitConfig limits how often each client can call wgrpcd, keyed by its ClientIdentifier.
+// Calls over a limit are refused with ResourceExhausted and told when to retry.
+type RateLimitConfig struct {
+	// Default limits each client's calls to every method that doesn't have its own limit. Nil means no limit.
+	Default *RateLimit `yaml:"default"`
+
+	// Methods limits each client's calls to particular methods, named like "ListPeers" or "/wgrpcd.WireguardRPC/ListPeers".
+	// Each method has its own bucket, so a client listing peers doesn't use up its allowance for creating them.
+	Methods map[string]*RateLimit `yaml:"methods"`
+
+	// MaxConcurrentMutations caps how many calls that change a device each client can have in flight at once. Zero means no cap.
+	MaxConcurrentMutations int `yaml:"maxConcurrentMutations"`
+}
+
+// Validate checks every limit allows at least one call.
+func (c *RateLimitConfig) Validate() error {
+	if c.Default != nil {
+		err := c.Default.validate()
+		if err != nil {
+			return fmt.Errorf("default: %w", err)
+		}
+	}
+	for method, limit := range c.Methods {
+		if limit == nil {
+			return fmt.Errorf("%s: has no limit", method)
+		}
+		err := limit.validate()
+		if err != nil {
+			return fmt.Errorf("%s: %w", method, err)
+		}
+	}
+	if c.MaxConcurrentMutations < 0 {
+		return fmt.Errorf("maxConcurrentMutations must not be negative")
+	}
+	return nil
+}
+
+func (r *RateLimit) validate() error {
+	if r.Rate <= 0 {
+		return fmt.Errorf("rate must be positive")
+	}
+	if r.Burst < 1 {
+		return fmt.Errorf("burst must be at least 1")
+	}
+	return nil
+}
+
+// tokenBucket is one client's allowance for one method.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type bucketKey struct {
+	client string
+	method string
+}
+
+// rateLimiter enforces a RateLimitConfig.
+type rateLimiter struct {
+	defaultLimit  *RateLimit
+	methodLimits  map[string]*RateLimit
+	maxConcurrent int
+	logger        Logger
+	now           func() time.Time
+
+	mutex     sync.Mutex
+	buckets   map[bucketKey]*tokenBucket
+	inFlight  map[string]int
+	lastPrune time.Time
+}
+
+func newRateLimiter(config *RateLimitConfig, logger Logger) (*rateLimiter, error) {
+	err := config.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate limits: %w", err)
+	}
+
+	methodLimits := map[string]*RateLimit{}
+	for method, limit := range config.Methods {
+		if !strings.HasPrefix(method, "/") {
+			method = scopePrefix + method
+		}
+		methodLimits[method] = limit
+	}
+	return &rateLimiter{
+		defaultLimit:  config.Default,
+		methodLimits:  methodLimits,
+		maxConcurrent: config.MaxConcurrentMutations,
+		logger:        logger,
+		now:           time.Now,
+		buckets:       map[bucketKey]*tokenBucket{},
+		inFlight:      map[string]int{},
+		lastPrune:     time.Now(),
+	}, nil
+}
+
+// limit returns the limit for method, or nil if it is unlimited.
+func (r *rateLimiter) limit(method string) *RateLimit {
+	if limit, ok := r.methodLimits[method]; ok {
+		return limit
+	}
+	return r.defaultLimit
+}
+
+// allow takes a token from the client's bucket for method.
+// If the bucket is empty, it returns how long until a token is available.
+func (r *rateLimiter) allow(client, method string) (bool, time.Duration) {
+	limit := r.limit(method)
+	if limit == nil {
+		return true, 0
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := r.now()
+	if now.Sub(r.lastPrune) > rateLimitPruneInterval {
+		r.prune(now)
+	}
+
+	key := bucketKey{client: client, method: method}
+	bucket, ok := r.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), updated: now}
+		r.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens+now.Sub(bucket.updated).Seconds()*limit.Rate)
+	bucket.updated = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - bucket.tokens) / limit.Rate * float64(time.Second))
+}
+
+// prune forgets buckets that have refilled, since a new bucket starts full anyway.
+// It must be called with the mutex held.
+func (r *rateLimiter) prune(now time.Time) {
+	for key, bucket := range r.buckets {
+		limit := r.limit(key.method)
+		if limit == nil || bucket.tokens+now.Sub(bucket.updated).Seconds()*limit.Rate >= float64(limit.Burst) {
+			delete(r.buckets, key)
+		}
+	}
+	r.lastPrune = now
+}
+
+// acquire counts a mutating call the client has in flight, returning false if it already has the maximum.
+// Callers that acquire must release.
+func (r *rateLimiter) acquire(client string) bool {
+	if r.maxConcurrent == 0 {
+		return true
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.inFlight[client] >= r.maxConcurrent {
+		return false
+	}
+	r.inFlight[client]++
+	return true
+}
+
+func (r *rateLimiter) release(client string) {
+	if r.maxConcurrent == 0 {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.inFlight[client]--
+	if r.inFlight[client] <= 0 {
+		delete(r.inFlight, client)
+	}
+}
+
+// resourceExhausted returns a ResourceExhausted error telling the client to retry after retryAfter.
+// setTrailer sends the retry-after metadata for clients that don't read error details.
+func resourceExhausted(setTrailer func(metadata.MD), retryAfter time.Duration, format string, a ...interface{}) error {
+	seconds := int64(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	setTrailer(metadata.Pairs(RetryAfterKey, strconv.FormatInt(seconds, 10)))
+
+	st := status.Newf(codes.ResourceExhausted, format, a...)
+	detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(time.Duration(seconds) * time.Second)})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// UnaryServerInterceptor refuses calls over the client's rate limit, and mutating calls over its concurrency cap.
+// It must run after the auth interceptor. Calls that skip authentication, like health checks, aren't limited.
+func (r *rateLimiter) UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	auth, err := grpcauth.GetAuthResult(ctx)
+	if err != nil {
+		return handler(ctx, req)
+	}
+
+	setTrailer := func(md metadata.MD) { grpc.SetTrailer(ctx, md) }
+	allowed, retryAfter := r.allow(auth.ClientIdentifier, info.FullMethod)
+	if !allowed {
+		r.logger.Debug("rate limited request", logKeyClient, auth.ClientIdentifier, "method", info.FullMethod, "retry_after", retryAfter)
+		return nil, resourceExhausted(setTrailer, retryAfter, "rate limit exceeded for %s, retry after %s", info.FullMethod, retryAfter.Round(time.Millisecond))
+	}
+
+	if auditedMethods[info.FullMethod] {
+		if !r.acquire(auth.ClientIdentifier) {
+			r.logger.Debug("too many concurrent requests", logKeyClient, auth.ClientIdentifier, "method", info.FullMethod)
+			return nil, resourceExhausted(setTrailer, time.Second, "too many concurrent requests that change devices, at most %d allowed", r.maxConcurrent)
+		}
+		defer r.release(auth.ClientIdentifier)
+	}
+	return handler(ctx, req)
+}
+
+// StreamServerInterceptor refuses streams opened over the client's rate limit.
+func (r *rateLimiter) StreamServerInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	auth, err := grpcauth.GetAuthResult(stream.Context())
+	if err != nil {
+		return handler(srv, stream)
+	}
+
+	allowed, retryAfter := r.allow(auth.ClientIdentifier, info.FullMethod)
+	if !allowed {
+		r.logger.Debug("rate limited request", logKeyClient, auth.ClientIdentifier, "method", info.FullMethod, "retry_after", retryAfter)
+		return resourceExhausted(stream.SetTrailer, retryAfter, "rate limit exceeded for %s, retry after %s", info.FullMethod, retryAfter.Round(time.Millisecond))
+	}
+	return handler(srv, stream)
+}
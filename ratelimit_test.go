@@ -0,0 +1,224 @@
+package wgrpcd
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/joncooperworks/grpcauth"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// testClock is a clock for a rateLimiter that only moves when the test advances it.
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestRateLimiter(t *testing.T, config *RateLimitConfig) (*rateLimiter, *testClock) {
+	t.Helper()
+
+	limiter, err := newRateLimiter(config, slog.New(slog.NewTextHandler(ioutil.Discard, nil)))
+	if err != nil {
+		t.Fatalf("newRateLimiter: %v", err)
+	}
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	limiter.now = clock.Now
+	limiter.lastPrune = clock.now
+	return limiter, clock
+}
+
+func TestRateLimiterBurstAndRefill(t *testing.T) {
+	limiter, clock := newTestRateLimiter(t, &RateLimitConfig{
+		Default: &RateLimit{Rate: 2, Burst: 3},
+	})
+
+	for i := 0; i < 3; i++ {
+		if allowed, _ := limiter.allow("client", PermissionListPeers); !allowed {
+			t.Fatalf("call %d of the burst was refused", i+1)
+		}
+	}
+	allowed, retryAfter := limiter.allow("client", PermissionListPeers)
+	if allowed {
+		t.Fatal("call over the burst was allowed")
+	}
+	if retryAfter != 500*time.Millisecond {
+		t.Errorf("got retry after %v, want 500ms at 2 calls a second", retryAfter)
+	}
+
+	// Other clients and methods have their own buckets.
+	if allowed, _ := limiter.allow("other", PermissionListPeers); !allowed {
+		t.Error("another client was limited by the first client's calls")
+	}
+	if allowed, _ := limiter.allow("client", PermissionListDevices); !allowed {
+		t.Error("another method was limited by calls to ListPeers")
+	}
+
+	clock.advance(250 * time.Millisecond)
+	allowed, retryAfter = limiter.allow("client", PermissionListPeers)
+	if allowed {
+		t.Error("call was allowed before a token refilled")
+	}
+	if retryAfter != 250*time.Millisecond {
+		t.Errorf("got retry after %v, want 250ms", retryAfter)
+	}
+
+	clock.advance(250 * time.Millisecond)
+	if allowed, _ := limiter.allow("client", PermissionListPeers); !allowed {
+		t.Error("call was refused once a token refilled")
+	}
+
+	// The bucket never holds more than the burst, however long the client waits.
+	clock.advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		if allowed, _ := limiter.allow("client", PermissionListPeers); !allowed {
+			t.Fatalf("call %d of the refilled burst was refused", i+1)
+		}
+	}
+	if allowed, _ := limiter.allow("client", PermissionListPeers); allowed {
+		t.Error("bucket refilled past its burst")
+	}
+}
+
+func TestRateLimiterMethodLimits(t *testing.T) {
+	limiter, _ := newTestRateLimiter(t, &RateLimitConfig{
+		Methods: map[string]*RateLimit{"CreatePeer": {Rate: 1, Burst: 1}},
+	})
+
+	limiter.allow("client", PermissionCreatePeer)
+	if allowed, _ := limiter.allow("client", PermissionCreatePeer); allowed {
+		t.Error("CreatePeer wasn't limited by its own limit")
+	}
+	for i := 0; i < 10; i++ {
+		if allowed, _ := limiter.allow("client", PermissionListPeers); !allowed {
+			t.Fatal("method without a limit was limited")
+		}
+	}
+}
+
+func TestRateLimiterPrunesRefilledBuckets(t *testing.T) {
+	limiter, clock := newTestRateLimiter(t, &RateLimitConfig{
+		Default: &RateLimit{Rate: 1, Burst: 2},
+		Methods: map[string]*RateLimit{"CreatePeer": {Rate: 0.001, Burst: 1}},
+	})
+
+	limiter.allow("idle", PermissionListPeers)
+	limiter.allow("slow", PermissionCreatePeer)
+	clock.advance(rateLimitPruneInterval + time.Second)
+	limiter.allow("active", PermissionListPeers)
+
+	if _, ok := limiter.buckets[bucketKey{client: "idle", method: PermissionListPeers}]; ok {
+		t.Error("refilled bucket wasn't pruned")
+	}
+	if _, ok := limiter.buckets[bucketKey{client: "slow", method: PermissionCreatePeer}]; !ok {
+		t.Error("bucket that hasn't refilled was pruned")
+	}
+	if allowed, _ := limiter.allow("slow", PermissionCreatePeer); allowed {
+		t.Error("pruning gave a client its allowance back early")
+	}
+}
+
+func TestResourceExhaustedRoundsRetryAfterUp(t *testing.T) {
+	tests := []struct {
+		retryAfter time.Duration
+		seconds    string
+	}{
+		{100 * time.Millisecond, "1"},
+		{time.Second, "1"},
+		{1200 * time.Millisecond, "2"},
+		{0, "1"},
+	}
+	for _, test := range tests {
+		var trailer metadata.MD
+		err := resourceExhausted(func(md metadata.MD) { trailer = md }, test.retryAfter, "rate limited")
+		if status.Code(err) != codes.ResourceExhausted {
+			t.Fatalf("got %v, want %v", err, codes.ResourceExhausted)
+		}
+		if got := trailer.Get(RetryAfterKey); len(got) != 1 || got[0] != test.seconds {
+			t.Errorf("retry after %v: got %s %q, want %q", test.retryAfter, RetryAfterKey, got, test.seconds)
+		}
+
+		details := status.Convert(err).Details()
+		if len(details) != 1 {
+			t.Fatalf("got details %v, want a RetryInfo", details)
+		}
+		retryInfo, ok := details[0].(*errdetails.RetryInfo)
+		if !ok {
+			t.Fatalf("got details %T, want a RetryInfo", details[0])
+		}
+		if got := retryInfo.GetRetryDelay().AsDuration().String(); got != test.seconds+"s" {
+			t.Errorf("retry after %v: got RetryInfo delay %s, want %ss", test.retryAfter, got, test.seconds)
+		}
+	}
+}
+
+// authenticatedContext returns a context authenticated by grpcauth as client, as interceptors after the auth interceptor see it.
+func authenticatedContext(t *testing.T, client string, permissions ...string) context.Context {
+	t.Helper()
+
+	authority := grpcauth.NewAuthority(func(md metadata.MD) (*grpcauth.AuthResult, error) {
+		return &grpcauth.AuthResult{ClientIdentifier: client, Timestamp: time.Now(), Permissions: permissions}, nil
+	}, RolePermissionFunc)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer token"))
+	var authenticated context.Context
+	_, err := authority.UnaryServerInterceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: PermissionCreatePeer}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		authenticated = ctx
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("failed to authenticate: %v", err)
+	}
+	return authenticated
+}
+
+func TestRateLimiterReleasesConcurrentMutations(t *testing.T) {
+	limiter, _ := newTestRateLimiter(t, &RateLimitConfig{MaxConcurrentMutations: 1})
+	ctx := authenticatedContext(t, "client", RoleAdmin)
+	createPeer := &grpc.UnaryServerInfo{FullMethod: PermissionCreatePeer}
+	listPeers := &grpc.UnaryServerInfo{FullMethod: PermissionListPeers}
+	ok := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	}
+	errFailed := errors.New("failed")
+
+	_, err := limiter.UnaryServerInterceptor(ctx, nil, createPeer, func(ctx context.Context, req interface{}) (interface{}, error) {
+		_, err := limiter.UnaryServerInterceptor(ctx, nil, createPeer, ok)
+		if status.Code(err) != codes.ResourceExhausted {
+			t.Errorf("second concurrent mutation got %v, want %v", err, codes.ResourceExhausted)
+		}
+		_, err = limiter.UnaryServerInterceptor(authenticatedContext(t, "other", RoleAdmin), nil, createPeer, ok)
+		if err != nil {
+			t.Errorf("another client's mutation was refused: %v", err)
+		}
+		_, err = limiter.UnaryServerInterceptor(ctx, nil, listPeers, ok)
+		if err != nil {
+			t.Errorf("call that doesn't change a device was refused: %v", err)
+		}
+		return nil, errFailed
+	})
+	if !errors.Is(err, errFailed) {
+		t.Fatalf("got %v, want the handler's error", err)
+	}
+
+	if len(limiter.inFlight) != 0 {
+		t.Errorf("got calls in flight %v after the handler failed, want none", limiter.inFlight)
+	}
+	_, err = limiter.UnaryServerInterceptor(ctx, nil, createPeer, ok)
+	if err != nil {
+		t.Errorf("mutation after a failed one was refused: %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+package wgrpcd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Revocation is a tombstone for a public key that has been removed or rekeyed.
+// wgrpcd refuses to add a revoked key to any device until the revocation is lifted.
+type Revocation struct {
+	PublicKey  string    `json:"publicKey"`
+	DeviceName string    `json:"deviceName"`
+	Reason     string    `json:"reason"`
+	RevokedBy  string    `json:"revokedBy"`
+	RevokedAt  time.Time `json:"revokedAt"`
+}
+
+// RevocationStore persists the denylist of revoked public keys.
+// Get returns nil and no error if the key has not been revoked.
+// Lift returns false if the key was not revoked.
+type RevocationStore interface {
+	Revoke(revocation *Revocation) error
+	Get(publicKey string) (*Revocation, error)
+	List() ([]*Revocation, error)
+	Lift(publicKey string) (bool, error)
+}
+
+// FileRevocationStore is a RevocationStore that keeps revocations in memory and writes them to a JSON file after every change.
+// A FileRevocationStore with an empty filename is never written to disk.
+type FileRevocationStore struct {
+	filename string
+	mutex    sync.Mutex
+	revoked  map[string]*Revocation
+}
+
+// fileRevocationStoreContents is the on-disk format of a FileRevocationStore.
+type fileRevocationStoreContents struct {
+	RevokedKeys []*Revocation `json:"revokedKeys"`
+}
+
+// NewFileRevocationStore returns a FileRevocationStore loaded from filename.
+// A missing file is treated as an empty denylist and will be created on the first write.
+func NewFileRevocationStore(filename string) (*FileRevocationStore, error) {
+	store := newMemoryRevocationStore()
+	if filename == "" {
+		return store, nil
+	}
+	store.filename = filename
+
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, err
+	}
+
+	var decoded fileRevocationStoreContents
+	err = json.Unmarshal(contents, &decoded)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, revoked := range decoded.RevokedKeys {
+		store.revoked[revoked.PublicKey] = revoked
+	}
+	return store, nil
+}
+
+// newMemoryRevocationStore returns a FileRevocationStore that is never written to disk.
+func newMemoryRevocationStore() *FileRevocationStore {
+	return &FileRevocationStore{
+		revoked: map[string]*Revocation{},
+	}
+}
+
+// Revoke adds a key to the denylist, replacing any earlier revocation of the same key.
+// The denylist is left unchanged if it can't be saved.
+func (f *FileRevocationStore) Revoke(revocation *Revocation) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	previous, existed := f.revoked[revocation.PublicKey]
+	r := *revocation
+	f.revoked[revocation.PublicKey] = &r
+	err := f.save()
+	if err != nil {
+		if existed {
+			f.revoked[revocation.PublicKey] = previous
+		} else {
+			delete(f.revoked, revocation.PublicKey)
+		}
+		return err
+	}
+	return nil
+}
+
+// Get returns the revocation for a key, or nil if it hasn't been revoked.
+func (f *FileRevocationStore) Get(publicKey string) (*Revocation, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	revoked, ok := f.revoked[publicKey]
+	if !ok {
+		return nil, nil
+	}
+	r := *revoked
+	return &r, nil
+}
+
+// List returns every revoked key, oldest first.
+func (f *FileRevocationStore) List() ([]*Revocation, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.sorted(), nil
+}
+
+// Lift removes a key from the denylist.
+// The key stays revoked if the denylist can't be saved.
+func (f *FileRevocationStore) Lift(publicKey string) (bool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	previous, ok := f.revoked[publicKey]
+	if !ok {
+		return false, nil
+	}
+	delete(f.revoked, publicKey)
+	err := f.save()
+	if err != nil {
+		f.revoked[publicKey] = previous
+		return false, err
+	}
+	return true, nil
+}
+
+// sorted returns copies of all revocations ordered by revocation time.
+// Callers must hold f.mutex.
+func (f *FileRevocationStore) sorted() []*Revocation {
+	revocations := []*Revocation{}
+	for _, revoked := range f.revoked {
+		r := *revoked
+		revocations = append(revocations, &r)
+	}
+	sort.Slice(revocations, func(i, j int) bool {
+		if !revocations[i].RevokedAt.Equal(revocations[j].RevokedAt) {
+			return revocations[i].RevokedAt.Before(revocations[j].RevokedAt)
+		}
+		return revocations[i].PublicKey < revocations[j].PublicKey
+	})
+	return revocations
+}
+
+// save writes the denylist to disk.
+// Callers must hold f.mutex.
+func (f *FileRevocationStore) save() error {
+	if f.filename == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(fileRevocationStoreContents{RevokedKeys: f.sorted()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.filename, b, 0600)
+}
+
+// proto converts a Revocation to its wire format.
+func (r *Revocation) proto() *RevokedKey {
+	return &RevokedKey{
+		PublicKey:  r.PublicKey,
+		DeviceName: r.DeviceName,
+		Reason:     r.Reason,
+		RevokedBy:  r.RevokedBy,
+		RevokedAt:  r.RevokedAt.Unix(),
+	}
+}
@@ -0,0 +1,204 @@
+package wgrpcd
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// otherKeySpelling returns a different base64 encoding of key that still decodes to it.
+// The last character before the padding carries two bits that canonical encoders leave as zero, but decoders ignore.
+func otherKeySpelling(t *testing.T, key wgtypes.Key) string {
+	t.Helper()
+
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+	canonical := key.String()
+	last := strings.IndexByte(alphabet, canonical[42])
+	spelling := canonical[:42] + string(alphabet[last|1]) + canonical[43:]
+
+	parsed, err := wgtypes.ParseKey(spelling)
+	if err != nil || parsed != key || spelling == canonical {
+		t.Fatalf("%s is not another spelling of %s", spelling, canonical)
+	}
+	return spelling
+}
+
+// brokenFilename returns a filename in a directory that doesn't exist, so saving to it fails.
+func brokenFilename(t *testing.T) string {
+	return filepath.Join(t.TempDir(), "missing", "store.json")
+}
+
+func TestImportRefusesRevokedKeysInAnySpelling(t *testing.T) {
+	fake := useFakeWireguard(t, "wg0")
+	revoked := testPublicKey(t)
+	revocations := newMemoryRevocationStore()
+	err := revocations.Revoke(&Revocation{PublicKey: revoked.String(), DeviceName: "wg0", RevokedAt: time.Now()})
+	if err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	client := newTestClient(t, &ServerConfig{RevocationStore: revocations}, PermissionImport)
+
+	_, err = client.Import(context.Background(), &ImportRequest{
+		DeviceName: "wg0",
+		Peers: []*ImportedPeer{
+			{PublicKey: testPublicKey(t).String(), AllowedIPs: []string{"10.0.0.2/32"}},
+			{PublicKey: otherKeySpelling(t, revoked), AllowedIPs: []string{"10.0.0.3/32"}},
+		},
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("got %v, want %v", err, codes.FailedPrecondition)
+	}
+	if device, _ := fake.Device("wg0"); len(device.Peers) != 0 {
+		t.Errorf("import with a revoked key added %d peers", len(device.Peers))
+	}
+}
+
+func TestResumePeerRefusesRevokedKeysInAnySpelling(t *testing.T) {
+	fake := useFakeWireguard(t, "wg0")
+	revocations := newMemoryRevocationStore()
+	client := newTestClient(t, &ServerConfig{RevocationStore: revocations}, PermissionImport, PermissionSuspendPeer, PermissionResumePeer)
+	ctx := context.Background()
+
+	publicKey := testPublicKey(t)
+	_, err := client.Import(ctx, &ImportRequest{
+		DeviceName: "wg0",
+		Peers:      []*ImportedPeer{{PublicKey: publicKey.String(), AllowedIPs: []string{"10.0.0.2/32"}}},
+	})
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	_, err = client.SuspendPeer(ctx, &SuspendPeerRequest{DeviceName: "wg0", PublicKey: publicKey.String()})
+	if err != nil {
+		t.Fatalf("SuspendPeer: %v", err)
+	}
+
+	err = revocations.Revoke(&Revocation{PublicKey: publicKey.String(), DeviceName: "wg0", RevokedAt: time.Now()})
+	if err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+	_, err = client.ResumePeer(ctx, &ResumePeerRequest{DeviceName: "wg0", PublicKey: otherKeySpelling(t, publicKey)})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("got %v, want %v", err, codes.FailedPrecondition)
+	}
+	if fake.peer("wg0", publicKey) != nil {
+		t.Error("revoked peer was resumed")
+	}
+}
+
+// CreatePeer generates its own keys, so there is no caller-supplied key for it to refuse.
+
+func TestRekeyPeerLeavesPeerWhenRevocationFails(t *testing.T) {
+	fake := useFakeWireguard(t, "wg0")
+	peers := newMemoryPeerStore()
+	revocations := newMemoryRevocationStore()
+	client := newTestClient(t, &ServerConfig{PeerStore: peers, RevocationStore: revocations}, PermissionImport, PermissionRekeyPeer)
+	ctx := context.Background()
+
+	publicKey := testPublicKey(t)
+	_, err := client.Import(ctx, &ImportRequest{
+		DeviceName: "wg0",
+		Peers:      []*ImportedPeer{{PublicKey: publicKey.String(), AllowedIPs: []string{"10.0.0.2/32"}, Name: "laptop"}},
+	})
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+
+	revocations.filename = brokenFilename(t)
+	_, err = client.RekeyPeer(ctx, &RekeyPeerRequest{DeviceName: "wg0", PublicKey: publicKey.String(), AllowedIPs: []string{"10.0.0.2/32"}})
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("got %v, want %v", err, codes.Internal)
+	}
+
+	if fake.peer("wg0", publicKey) == nil {
+		t.Error("peer was removed from the device even though its key couldn't be revoked")
+	}
+	records, err := peers.List("wg0")
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(records) != 1 || records[0].PublicKey != publicKey.String() || records[0].Name != "laptop" {
+		t.Errorf("got peer records %+v, want only the original peer", records)
+	}
+	if revocation, _ := revocations.Get(publicKey.String()); revocation != nil {
+		t.Error("key was revoked even though the denylist couldn't be saved")
+	}
+}
+
+func TestRevocationStoreUnchangedWhenSaveFails(t *testing.T) {
+	store, err := NewFileRevocationStore(filepath.Join(t.TempDir(), "revoked.json"))
+	if err != nil {
+		t.Fatalf("NewFileRevocationStore: %v", err)
+	}
+	original := &Revocation{PublicKey: "kept", DeviceName: "wg0", Reason: "original", RevokedAt: time.Now()}
+	err = store.Revoke(original)
+	if err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+
+	store.filename = brokenFilename(t)
+	err = store.Revoke(&Revocation{PublicKey: "new", DeviceName: "wg0", RevokedAt: time.Now()})
+	if err == nil {
+		t.Fatal("Revoke succeeded without saving")
+	}
+	if revocation, _ := store.Get("new"); revocation != nil {
+		t.Error("unsaved revocation was kept")
+	}
+
+	err = store.Revoke(&Revocation{PublicKey: "kept", DeviceName: "wg0", Reason: "replacement", RevokedAt: time.Now()})
+	if err == nil {
+		t.Fatal("Revoke succeeded without saving")
+	}
+	if revocation, _ := store.Get("kept"); revocation == nil || revocation.Reason != "original" {
+		t.Errorf("got revocation %+v, want the original one", revocation)
+	}
+
+	lifted, err := store.Lift("kept")
+	if err == nil || lifted {
+		t.Fatal("Lift succeeded without saving")
+	}
+	if revocation, _ := store.Get("kept"); revocation == nil {
+		t.Error("revocation was lifted even though the denylist couldn't be saved")
+	}
+}
+
+func TestPeerStoreUnchangedWhenSaveFails(t *testing.T) {
+	store, err := NewFilePeerStore(filepath.Join(t.TempDir(), "peers.json"))
+	if err != nil {
+		t.Fatalf("NewFilePeerStore: %v", err)
+	}
+	err = store.Put(&PeerRecord{DeviceName: "wg0", PublicKey: "kept", Name: "original"})
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	store.filename = brokenFilename(t)
+	err = store.Put(&PeerRecord{DeviceName: "wg0", PublicKey: "new"})
+	if err == nil {
+		t.Fatal("Put succeeded without saving")
+	}
+	if record, _ := store.Get("wg0", "new"); record != nil {
+		t.Error("unsaved record was kept")
+	}
+
+	err = store.Put(&PeerRecord{DeviceName: "wg0", PublicKey: "kept", Name: "replacement"})
+	if err == nil {
+		t.Fatal("Put succeeded without saving")
+	}
+	if record, _ := store.Get("wg0", "kept"); record == nil || record.Name != "original" {
+		t.Errorf("got record %+v, want the original one", record)
+	}
+
+	err = store.Delete("wg0", "kept")
+	if err == nil {
+		t.Fatal("Delete succeeded without saving")
+	}
+	if record, _ := store.Get("wg0", "kept"); record == nil {
+		t.Error("record was deleted even though the store couldn't be saved")
+	}
+}
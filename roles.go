@@ -0,0 +1,201 @@
+package wgrpcd
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/joncooperworks/grpcauth"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Roles bundle permissions so clients can be granted a role instead of listing every method.
+// A role is granted by a permission or scope naming it, either on its own like "provisioner" or after the API identifier like "/wgrpcd.WireguardRPC/provisioner", as AWS Cognito sends scopes.
+const (
+	// RoleReader can look at devices, peers and the denylist, and check the server's health.
+	RoleReader = "reader"
+
+	// RoleProvisioner can also add, rekey, remove, suspend and resume peers.
+	RoleProvisioner = "provisioner"
+
+	// RoleAdmin can call every method, including changing a device's listen port, lifting revocations and reading the audit log.
+	RoleAdmin = "admin"
+)
+
+// scopePrefix is the API identifier OpenID providers like AWS Cognito put before each scope.
+const scopePrefix = "/wgrpcd.WireguardRPC/"
+
+var (
+	readerPermissions = []string{
+		PermissionListPeers,
+		PermissionWatchPeers,
+		PermissionListDevices,
+		PermissionListRevokedKeys,
+		PermissionHealthCheck,
+		PermissionHealthWatch,
+		PermissionReflection,
+	}
+
+	provisionerPermissions = append([]string{
+		PermissionCreatePeer,
+		PermissionRekeyPeer,
+		PermissionRemovePeer,
+		PermissionImport,
+		PermissionSuspendPeer,
+		PermissionResumePeer,
+	}, readerPermissions...)
+
+	adminPermissions = append([]string{
+		PermissionChangeListenPort,
+		PermissionLiftRevocation,
+		PermissionQueryAudit,
+	}, provisionerPermissions...)
+
+	rolePermissions = map[string][]string{
+		RoleReader:      readerPermissions,
+		RoleProvisioner: provisionerPermissions,
+		RoleAdmin:       adminPermissions,
+	}
+)
+
+// RolePermissions returns the sorted permissions a role grants, or nil if there is no such role.
+func RolePermissions(role string) []string {
+	permissions, ok := rolePermissions[role]
+	if !ok {
+		return nil
+	}
+	sorted := append([]string{}, permissions...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// rolesGranting returns the roles that grant a permission, least privileged first.
+// A permission restricted to a device gives roles restricted to the same device.
+func rolesGranting(permission string) []string {
+	permission, device, restricted := strings.Cut(permission, deviceScopeSeparator)
+	suffix := ""
+	if restricted {
+		suffix = deviceScopeSeparator + device
+	}
+
+	roles := []string{}
+	for _, role := range []string{RoleReader, RoleProvisioner, RoleAdmin} {
+		for _, p := range rolePermissions[role] {
+			if p == permission {
+				roles = append(roles, role+suffix)
+				break
+			}
+		}
+	}
+	return roles
+}
+
+// RolePermissionFunc is a grpcauth.PermissionFunc that allows a method if the client holds its permission, or a role that grants it.
+// Permissions restricted to devices, like "CreatePeer@wg1", allow the method here, and the device is checked once the request has been read.
+// Set it as ServerConfig.PermissionFunc to let clients be granted roles, method names without the API identifier and device scopes.
+// Without it, clients need each method's full name as a permission, so an OpenID provider's existing scopes can't grant more than they did before.
+func RolePermissionFunc(permissions []string, methodName string) bool {
+	for _, permission := range permissions {
+		if parseScope(permission).grants(methodName) {
+			return true
+		}
+	}
+	return false
+}
+
+// Keys in the metadata of the ErrorInfo attached to PermissionDenied errors.
+const (
+	permissionDeniedDomain     = "wgrpcd"
+	permissionDeniedReason     = "MISSING_PERMISSION"
+	errorInfoRequiredScope     = "requiredScope"
+	errorInfoGrantingRoles     = "grantingRoles"
+	errorInfoClientIdentifier  = "clientIdentifier"
+	errorInfoClientPermissions = "clientPermissions"
+)
+
+// describePermissionDenied adds an errdetails.ErrorInfo to the PermissionDenied errors grpcauth returns, naming the scope the method requires and the roles that grant it.
+// The message is left as it was, so clients that parse it keep working.
+func describePermissionDenied(err error) error {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.PermissionDenied {
+		return err
+	}
+
+	var denied grpcauth.PermissionDeniedError
+	if json.Unmarshal([]byte(st.Message()), &denied) != nil {
+		return err
+	}
+
+	detailed, detailsErr := st.WithDetails(&errdetails.ErrorInfo{
+		Reason: permissionDeniedReason,
+		Domain: permissionDeniedDomain,
+		Metadata: map[string]string{
+			errorInfoRequiredScope:     denied.PermissionRequested,
+			errorInfoGrantingRoles:     strings.Join(rolesGranting(denied.PermissionRequested), ","),
+			errorInfoClientIdentifier:  denied.ClientIdentifier,
+			errorInfoClientPermissions: strings.Join(denied.ClientPermissions, ","),
+		},
+	})
+	if detailsErr != nil {
+		return err
+	}
+	return detailed.Err()
+}
+
+// describeUnaryPermissionDenied wraps an auth interceptor so its PermissionDenied errors carry details.
+func describeUnaryPermissionDenied(interceptor grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		handled := false
+		resp, err := interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			handled = true
+			return handler(ctx, req)
+		})
+		if handled {
+			// The error came from the handler, not from authorization.
+			return resp, err
+		}
+		return resp, describePermissionDenied(err)
+	}
+}
+
+// describeStreamPermissionDenied is describeUnaryPermissionDenied for streaming RPCs.
+func describeStreamPermissionDenied(interceptor grpc.StreamServerInterceptor) grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		handled := false
+		err := interceptor(srv, stream, info, func(srv interface{}, stream grpc.ServerStream) error {
+			handled = true
+			return handler(srv, stream)
+		})
+		if handled {
+			return err
+		}
+		return describePermissionDenied(err)
+	}
+}
+
+// RequiredScope returns the scope a client was missing when err is a PermissionDenied error from wgrpcd, and the roles that grant it.
+// It returns an empty scope for any other error.
+func RequiredScope(err error) (string, []string) {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.PermissionDenied {
+		return "", nil
+	}
+
+	for _, detail := range st.Details() {
+		info, ok := detail.(*errdetails.ErrorInfo)
+		if !ok || info.GetDomain() != permissionDeniedDomain || info.GetReason() != permissionDeniedReason {
+			continue
+		}
+
+		var roles []string
+		if granting := info.GetMetadata()[errorInfoGrantingRoles]; granting != "" {
+			roles = strings.Split(granting, ",")
+		}
+		return info.GetMetadata()[errorInfoRequiredScope], roles
+	}
+	return "", nil
+}
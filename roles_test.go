@@ -0,0 +1,94 @@
+package wgrpcd
+
+import (
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/joncooperworks/grpcauth"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestRolePermissionFunc(t *testing.T) {
+	tests := []struct {
+		permission string
+		method     string
+		allowed    bool
+	}{
+		{PermissionCreatePeer, PermissionCreatePeer, true},
+		{"CreatePeer", PermissionCreatePeer, true},
+		{"CreatePeer@wg-*", PermissionCreatePeer, true},
+		{RoleProvisioner, PermissionCreatePeer, true},
+		{scopePrefix + RoleProvisioner, PermissionCreatePeer, true},
+		{RoleReader, PermissionCreatePeer, false},
+		{RoleProvisioner, PermissionQueryAudit, false},
+		{RoleAdmin, PermissionQueryAudit, true},
+		{"ListPeers", PermissionCreatePeer, false},
+	}
+	for _, test := range tests {
+		allowed := RolePermissionFunc([]string{test.permission}, test.method)
+		if allowed != test.allowed {
+			t.Errorf("RolePermissionFunc(%q, %q) = %v, want %v", test.permission, test.method, allowed, test.allowed)
+		}
+	}
+}
+
+// staticAuth authenticates every request as a client holding permissions.
+func staticAuth(permissions ...string) grpcauth.AuthFunc {
+	return func(md metadata.MD) (*grpcauth.AuthResult, error) {
+		return &grpcauth.AuthResult{
+			ClientIdentifier: "test-client",
+			Timestamp:        time.Now(),
+			Permissions:      permissions,
+		}, nil
+	}
+}
+
+// checkHealthPermission calls the health service on a server authorizing clients with the given permissions and PermissionFunc, and returns the status code.
+// Health checks are authenticated, and ask about an unknown service so they fail with NotFound without reaching Wireguard once they are allowed.
+func checkHealthPermission(t *testing.T, permissionFunc grpcauth.PermissionFunc, permissions ...string) codes.Code {
+	t.Helper()
+
+	serverConfig, clientConfig := testTLSConfigs(t)
+	rpcServer, err := NewServer(&ServerConfig{
+		TLSConfig:                serverConfig,
+		AuthFunc:                 staticAuth(permissions...),
+		PermissionFunc:           permissionFunc,
+		Logger:                   slog.New(slog.NewTextHandler(ioutil.Discard, nil)),
+		AuthenticateHealthChecks: true,
+	})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	conn := dialTest(t, serveTest(t, rpcServer), clientConfig)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer token")
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: "unknown"})
+	return status.Code(err)
+}
+
+func TestDefaultPermissionFuncRequiresFullMethodNames(t *testing.T) {
+	for _, permission := range []string{RoleAdmin, RoleReader, "Check", "/grpc.health.v1.Health/Check@wg0"} {
+		code := checkHealthPermission(t, nil, permission)
+		if code != codes.PermissionDenied {
+			t.Errorf("permission %q got %v, want %v", permission, code, codes.PermissionDenied)
+		}
+	}
+
+	code := checkHealthPermission(t, nil, PermissionHealthCheck)
+	if code != codes.NotFound {
+		t.Errorf("permission %q got %v, want the request to be allowed", PermissionHealthCheck, code)
+	}
+}
+
+func TestRolePermissionFuncAllowsRoles(t *testing.T) {
+	code := checkHealthPermission(t, RolePermissionFunc, RoleReader)
+	if code != codes.NotFound {
+		t.Errorf("role %q got %v, want the request to be allowed", RoleReader, code)
+	}
+}
@@ -0,0 +1,135 @@
+package wgrpcd
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"strings"
+
+	"github.com/joncooperworks/grpcauth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// deviceScopeSeparator separates a permission or role from the device pattern it is restricted to, as in "CreatePeer@wg-customer-*".
+const deviceScopeSeparator = "@"
+
+// scope is a permission or role, optionally restricted to devices whose names match a pattern as used by path.Match.
+type scope struct {
+	name          string
+	devicePattern string
+}
+
+// parseScope splits a permission like "/wgrpcd.WireguardRPC/CreatePeer@wg1" or "provisioner@wg-customer-*" into its name and device pattern.
+func parseScope(permission string) scope {
+	name, devicePattern, _ := strings.Cut(permission, deviceScopeSeparator)
+	return scope{name: name, devicePattern: devicePattern}
+}
+
+// grants returns true if the scope allows methodName on some device.
+// The name can be a full method permission, a method name on its own like "CreatePeer", or a role.
+func (s scope) grants(methodName string) bool {
+	if s.name == methodName || scopePrefix+s.name == methodName {
+		return true
+	}
+
+	role := strings.TrimPrefix(s.name, scopePrefix)
+	for _, permission := range rolePermissions[role] {
+		if permission == methodName {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesDevice returns true if the scope applies to deviceName.
+func (s scope) matchesDevice(deviceName string) bool {
+	if s.devicePattern == "" {
+		return true
+	}
+	matched, _ := path.Match(s.devicePattern, deviceName)
+	return matched
+}
+
+// deviceRestricted returns true if any of the permissions is restricted to certain devices.
+// Clients without device restrictions, including those authorized by a custom PermissionFunc, can act on every device.
+func deviceRestricted(permissions []string) bool {
+	for _, permission := range permissions {
+		if strings.Contains(permission, deviceScopeSeparator) {
+			return true
+		}
+	}
+	return false
+}
+
+// DeviceAuthorized returns true if permissions allow methodName to act on deviceName.
+func DeviceAuthorized(permissions []string, methodName, deviceName string) bool {
+	if !deviceRestricted(permissions) {
+		return true
+	}
+	for _, permission := range permissions {
+		s := parseScope(permission)
+		if s.grants(methodName) && s.matchesDevice(deviceName) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeDevice refuses a request for a device the client's permissions don't cover.
+func authorizeDevice(ctx context.Context, methodName string, req interface{}) error {
+	r, ok := req.(interface{ GetDeviceName() string })
+	if !ok {
+		return nil
+	}
+
+	auth, err := grpcauth.GetAuthResult(ctx)
+	if err != nil {
+		// Methods that skip authentication, like health checks, name no device.
+		return nil
+	}
+	return checkDevice(auth, methodName, r.GetDeviceName())
+}
+
+// checkDevice returns a PermissionDenied error if the client's permissions don't allow methodName on deviceName.
+func checkDevice(auth *grpcauth.AuthResult, methodName, deviceName string) error {
+	if DeviceAuthorized(auth.Permissions, methodName, deviceName) {
+		return nil
+	}
+
+	b, _ := json.Marshal(&grpcauth.PermissionDeniedError{
+		ClientIdentifier:    auth.ClientIdentifier,
+		PermissionRequested: methodName + deviceScopeSeparator + deviceName,
+		ClientPermissions:   auth.Permissions,
+	})
+	return describePermissionDenied(status.Errorf(codes.PermissionDenied, string(b)))
+}
+
+// authorizeDeviceUnary checks the device named by a unary request against the client's permissions.
+// It must run after the auth interceptor.
+func authorizeDeviceUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	err := authorizeDevice(ctx, info.FullMethod, req)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// authorizeDeviceStream checks the device named by each message a client streams, as the handler receives it.
+func authorizeDeviceStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &deviceAuthorizingStream{ServerStream: stream, methodName: info.FullMethod})
+}
+
+type deviceAuthorizingStream struct {
+	grpc.ServerStream
+	methodName string
+}
+
+func (d *deviceAuthorizingStream) RecvMsg(m interface{}) error {
+	err := d.ServerStream.RecvMsg(m)
+	if err != nil {
+		return err
+	}
+	return authorizeDevice(d.Context(), d.methodName, m)
+}
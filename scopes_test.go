@@ -0,0 +1,105 @@
+package wgrpcd
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDeviceAuthorized(t *testing.T) {
+	tests := []struct {
+		permissions []string
+		device      string
+		authorized  bool
+	}{
+		{[]string{PermissionCreatePeer}, "wg0", true},
+		{[]string{"CreatePeer@wg-*"}, "wg-customer-1", true},
+		{[]string{"CreatePeer@wg-*"}, "wg0", false},
+		{[]string{"CreatePeer@wg0"}, "wg0", true},
+		{[]string{"CreatePeer@wg0"}, "wg01", false},
+		{[]string{RoleProvisioner + "@wg-*"}, "wg-customer-1", true},
+		{[]string{RoleReader + "@wg-*"}, "wg-customer-1", false},
+		// An unrestricted permission for another method doesn't lift the restriction.
+		{[]string{"CreatePeer@wg-*", PermissionListPeers}, "wg0", false},
+		{[]string{"CreatePeer@wg-*", "CreatePeer@wg0"}, "wg0", true},
+	}
+	for _, test := range tests {
+		authorized := DeviceAuthorized(test.permissions, PermissionCreatePeer, test.device)
+		if authorized != test.authorized {
+			t.Errorf("DeviceAuthorized(%q, CreatePeer, %q) = %v, want %v", test.permissions, test.device, authorized, test.authorized)
+		}
+	}
+}
+
+func TestDeviceScopeRefusesOtherDevices(t *testing.T) {
+	fake := useFakeWireguard(t, "wg0", "wg-customer-1")
+	client := newTestClient(t, &ServerConfig{PermissionFunc: RolePermissionFunc}, "CreatePeer@wg-*", "WatchPeers@wg-*")
+	ctx := context.Background()
+
+	_, err := client.CreatePeer(ctx, &CreatePeerRequest{DeviceName: "wg0", AllowedIPs: []string{"10.0.0.2/32"}})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("CreatePeer on wg0 got %v, want %v", err, codes.PermissionDenied)
+	}
+	if device, _ := fake.Device("wg0"); len(device.Peers) != 0 {
+		t.Errorf("CreatePeer added %d peers to wg0", len(device.Peers))
+	}
+	_, err = client.CreatePeer(ctx, &CreatePeerRequest{DeviceName: "wg-customer-1", AllowedIPs: []string{"10.0.0.2/32"}})
+	if err != nil {
+		t.Errorf("CreatePeer on wg-customer-1: %v", err)
+	}
+
+	stream, err := client.WatchPeers(ctx, &WatchPeersRequest{DeviceName: "wg0"})
+	if err != nil {
+		t.Fatalf("WatchPeers: %v", err)
+	}
+	_, err = stream.Recv()
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("WatchPeers on wg0 got %v, want %v", err, codes.PermissionDenied)
+	}
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err = client.WatchPeers(watchCtx, &WatchPeersRequest{DeviceName: "wg-customer-1"})
+	if err != nil {
+		t.Fatalf("WatchPeers: %v", err)
+	}
+	event, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("WatchPeers on wg-customer-1: %v", err)
+	}
+	if event.GetType() != PeerEvent_SNAPSHOT {
+		t.Errorf("got %v, want the peer created on wg-customer-1", event.GetType())
+	}
+}
+
+func TestDeviceScopeFiltersListings(t *testing.T) {
+	useFakeWireguard(t, "wg0", "wg-customer-1", "wg-customer-2")
+	revocations := newMemoryRevocationStore()
+	for _, device := range []string{"wg0", "wg-customer-1"} {
+		err := revocations.Revoke(&Revocation{PublicKey: testPublicKey(t).String(), DeviceName: device})
+		if err != nil {
+			t.Fatalf("Revoke: %v", err)
+		}
+	}
+	client := newTestClient(t, &ServerConfig{PermissionFunc: RolePermissionFunc, RevocationStore: revocations}, RoleReader+"@wg-customer-*")
+	ctx := context.Background()
+
+	devices, err := client.Devices(ctx, &DevicesRequest{})
+	if err != nil {
+		t.Fatalf("Devices: %v", err)
+	}
+	if want := []string{"wg-customer-1", "wg-customer-2"}; !reflect.DeepEqual(devices.GetDevices(), want) {
+		t.Errorf("got devices %q, want %q", devices.GetDevices(), want)
+	}
+
+	revoked, err := client.ListRevokedKeys(ctx, &ListRevokedKeysRequest{})
+	if err != nil {
+		t.Fatalf("ListRevokedKeys: %v", err)
+	}
+	if len(revoked.GetRevokedKeys()) != 1 || revoked.GetRevokedKeys()[0].GetDeviceName() != "wg-customer-1" {
+		t.Errorf("got revoked keys %v, want only the one revoked on wg-customer-1", revoked.GetRevokedKeys())
+	}
+}
@@ -2,13 +2,21 @@ package wgrpcd
 
 import (
 	"context"
+	"errors"
+	"log/slog"
+	"net"
 	"os"
+	"time"
 
 	"github.com/joncooperworks/grpcauth"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/trace"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
 	"google.golang.org/grpc/status"
 )
 
@@ -19,7 +27,13 @@ const (
 // Server implements the operations exposed in the profobuf definitions for the gRPC server.
 type Server struct {
 	UnimplementedWireguardRPCServer
-	logger Logger
+	logger      Logger
+	peers       PeerStore
+	revocations RevocationStore
+	audit       AuditLog
+	webhooks    *WebhookDispatcher
+	tracer      trace.Tracer
+	done        <-chan struct{}
 }
 
 // CreatePeer adds a new Wireguard peer to the VPN.
@@ -29,7 +43,7 @@ func (s *Server) CreatePeer(ctx context.Context, request *CreatePeerRequest) (*C
 		return nil, err
 	}
 
-	wireguard, err := New(request.GetDeviceName())
+	wireguard, err := s.newWireguard(ctx, request.GetDeviceName())
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, status.Errorf(codes.NotFound, "that wireguard device does not exist: %s", request.GetDeviceName())
@@ -42,26 +56,53 @@ func (s *Server) CreatePeer(ctx context.Context, request *CreatePeerRequest) (*C
 		return nil, status.Errorf(codes.InvalidArgument, "an ip address in AllowedIPs is invalid, error: %v", err)
 	}
 
+	err = ValidatePeerMetadata(request.GetName(), request.GetLabels())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid peer metadata: %v", err)
+	}
+
 	key, err := wgtypes.GeneratePrivateKey()
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "error generating private key")
 	}
 
 	publicKey := key.PublicKey()
+	record := &PeerRecord{
+		DeviceName: wireguard.DeviceName,
+		PublicKey:  publicKey.String(),
+		Name:       request.GetName(),
+		Labels:     request.GetLabels(),
+	}
+	err = s.peers.Put(record)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error saving peer metadata: %v", err)
+	}
+
 	peerConfig, err := wireguard.AddNewPeer(allowedIPs, publicKey)
 	if err != nil {
+		s.deletePeerRecord(record.DeviceName, record.PublicKey)
 		if os.IsNotExist(err) {
 			return nil, status.Errorf(codes.NotFound, "that wireguard device does not exist")
 		}
 		return nil, status.Errorf(codes.Internal, "error adding peer to wireguard interface: %v", err)
 	}
 
-	s.logger.Printf("Client '%s' added peer '%s'", auth.ClientIdentifier, publicKey.String())
+	s.logger.Info("added peer", logKeyClient, auth.ClientIdentifier, logKeyDevice, request.GetDeviceName(), logKeyPublicKey, publicKey.String())
+	s.notify(&WebhookEvent{
+		Type:             WebhookPeerCreated,
+		ClientIdentifier: auth.ClientIdentifier,
+		DeviceName:       record.DeviceName,
+		PublicKey:        record.PublicKey,
+		Name:             record.Name,
+		Labels:           record.Labels,
+	})
 	response := &CreatePeerResponse{
 		PublicKey:       peerConfig.PublicKey.String(),
 		PrivateKey:      key.String(),
 		AllowedIPs:      IPNetsToStrings(allowedIPs),
 		ServerPublicKey: wireguard.ServerPublicKey.String(),
+		Name:            record.Name,
+		Labels:          record.Labels,
 	}
 	return response, nil
 }
@@ -73,7 +114,7 @@ func (s *Server) RekeyPeer(ctx context.Context, request *RekeyPeerRequest) (*Rek
 		return nil, err
 	}
 
-	wireguard, err := New(request.GetDeviceName())
+	wireguard, err := s.newWireguard(ctx, request.GetDeviceName())
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, status.Errorf(codes.NotFound, "that wireguard device does not exist")
@@ -96,22 +137,65 @@ func (s *Server) RekeyPeer(ctx context.Context, request *RekeyPeerRequest) (*Rek
 		return nil, status.Errorf(codes.InvalidArgument, "invalid public key: %v", err)
 	}
 
-	s.logger.Printf("Client '%s' attempting to rekey peer '%s'", auth.ClientIdentifier, publicKey.String())
+	s.logger.Debug("rekeying peer", logKeyClient, auth.ClientIdentifier, logKeyDevice, request.GetDeviceName(), logKeyPublicKey, publicKey.String())
+
+	// The peer's name and labels follow it to its new key.
+	oldRecord, err := s.peers.Get(wireguard.DeviceName, publicKey.String())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error loading peer metadata: %v", err)
+	}
+	if oldRecord != nil && oldRecord.Suspended != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "peer '%s' is suspended and must be resumed before it can be rekeyed", publicKey.String())
+	}
+
+	record := &PeerRecord{
+		DeviceName: wireguard.DeviceName,
+		PublicKey:  key.PublicKey().String(),
+	}
+	if oldRecord != nil {
+		record.Name = oldRecord.Name
+		record.Labels = oldRecord.Labels
+	}
+	err = s.peers.Put(record)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error saving peer metadata: %v", err)
+	}
+
+	// The old key is denylisted before it leaves the device so there is never a moment where it can be imported back.
+	previousRevocation, err := s.revoke(auth, wireguard.DeviceName, publicKey, "replaced by RekeyPeer")
+	if err != nil {
+		s.deletePeerRecord(record.DeviceName, record.PublicKey)
+		return nil, err
+	}
 
 	peerConfig, err := wireguard.RekeyClient(allowedIPs, publicKey, key.PublicKey())
 	if err != nil {
+		s.deletePeerRecord(record.DeviceName, record.PublicKey)
+		s.undoRevoke(publicKey, previousRevocation)
 		if os.IsNotExist(err) {
 			return nil, status.Errorf(codes.NotFound, "that wireguard device does not exist")
 		}
 		return nil, status.Errorf(codes.Internal, "error rekeying peer: %v", err)
 	}
-
-	s.logger.Printf("Client '%s' rekeyed peer '%s'", auth.ClientIdentifier, publicKey.String())
+	s.deletePeerRecord(wireguard.DeviceName, publicKey.String())
+
+	s.logger.Info("rekeyed peer", logKeyClient, auth.ClientIdentifier, logKeyDevice, request.GetDeviceName(), logKeyPublicKey, publicKey.String(), logKeyNewPublicKey, record.PublicKey)
+	s.notify(&WebhookEvent{
+		Type:             WebhookPeerRekeyed,
+		ClientIdentifier: auth.ClientIdentifier,
+		DeviceName:       record.DeviceName,
+		PublicKey:        record.PublicKey,
+		OldPublicKey:     publicKey.String(),
+		Name:             record.Name,
+		Labels:           record.Labels,
+	})
 	response := &RekeyPeerResponse{
 		PublicKey:       peerConfig.PublicKey.String(),
 		PrivateKey:      key.String(),
 		AllowedIPs:      IPNetsToStrings(allowedIPs),
 		ServerPublicKey: wireguard.ServerPublicKey.String(),
+		Name:            record.Name,
+		Labels:          record.Labels,
 	}
 	return response, nil
 }
@@ -123,26 +207,46 @@ func (s *Server) RemovePeer(ctx context.Context, request *RemovePeerRequest) (*R
 		return nil, err
 	}
 
-	wireguard := &Wireguard{
+	wireguard := s.wireguard(ctx, &Wireguard{
 		DeviceName: request.GetDeviceName(),
-	}
+	})
 
 	publicKey, err := wgtypes.ParseKey(request.GetPublicKey())
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "invalid public key: %v", err)
 	}
 
-	s.logger.Printf("Client '%s' attempting to remove peer '%s'", auth.ClientIdentifier, publicKey.String())
+	s.logger.Debug("removing peer", logKeyClient, auth.ClientIdentifier, logKeyDevice, request.GetDeviceName(), logKeyPublicKey, publicKey.String())
+
+	previousRevocation, err := s.revoke(auth, wireguard.DeviceName, publicKey, "removed by RemovePeer")
+	if err != nil {
+		return nil, err
+	}
 
 	err = wireguard.RemovePeer(publicKey)
 	if err != nil {
+		s.undoRevoke(publicKey, previousRevocation)
 		if os.IsNotExist(err) {
 			return nil, status.Errorf(codes.NotFound, "that wireguard device does not exist")
 		}
 		return nil, status.Errorf(codes.Internal, "error removing peer: %v", err)
 	}
 
-	s.logger.Printf("Client '%s' removed peer '%s'", auth.ClientIdentifier, publicKey.String())
+	event := &WebhookEvent{
+		Type:             WebhookPeerRemoved,
+		ClientIdentifier: auth.ClientIdentifier,
+		DeviceName:       wireguard.DeviceName,
+		PublicKey:        publicKey.String(),
+	}
+	record, err := s.peers.Get(wireguard.DeviceName, publicKey.String())
+	if err == nil && record != nil {
+		event.Name = record.Name
+		event.Labels = record.Labels
+	}
+	s.deletePeerRecord(wireguard.DeviceName, publicKey.String())
+
+	s.logger.Info("removed peer", logKeyClient, auth.ClientIdentifier, logKeyDevice, request.GetDeviceName(), logKeyPublicKey, publicKey.String())
+	s.notify(event)
 
 	response := &RemovePeerResponse{
 		Removed: true,
@@ -157,12 +261,17 @@ func (s *Server) ListPeers(ctx context.Context, request *ListPeersRequest) (*Lis
 		return nil, err
 	}
 
-	s.logger.Printf("Client '%s' listing peers", auth.ClientIdentifier)
+	s.logger.Debug("listing peers", logKeyClient, auth.ClientIdentifier, logKeyDevice, request.GetDeviceName())
 
-	wireguard := &Wireguard{
-		DeviceName: request.GetDeviceName(),
+	selector, err := ParseLabelSelector(request.GetLabelSelector())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid label selector: %v", err)
 	}
 
+	wireguard := s.wireguard(ctx, &Wireguard{
+		DeviceName: request.GetDeviceName(),
+	})
+
 	devicePeers, err := wireguard.Peers()
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -171,16 +280,40 @@ func (s *Server) ListPeers(ctx context.Context, request *ListPeersRequest) (*Lis
 		return nil, status.Errorf(codes.Internal, "error listing peers: %v", err)
 	}
 
-	s.logger.Printf("Client '%s' retrieved peers", auth.ClientIdentifier)
+	s.logger.Info("listed peers", logKeyClient, auth.ClientIdentifier, logKeyDevice, request.GetDeviceName())
+
+	records, err := s.peers.List(wireguard.DeviceName)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error loading peer metadata: %v", err)
+	}
+	recordsByKey := map[string]*PeerRecord{}
+	for _, record := range records {
+		recordsByKey[record.PublicKey] = record
+	}
 
 	peers := []*Peer{}
+	livePeers := map[string]bool{}
 	for _, dp := range devicePeers {
+		livePeers[dp.PublicKey.String()] = true
+		peer := devicePeer(dp, recordsByKey[dp.PublicKey.String()])
+		if !selector.Matches(peer.Labels) {
+			continue
+		}
+		peers = append(peers, peer)
+	}
+
+	// Suspended peers are not on the device, but they still belong to it.
+	for _, record := range records {
+		if record.Suspended == nil || livePeers[record.PublicKey] || !selector.Matches(record.Labels) {
+			continue
+		}
 		peer := &Peer{
-			PublicKey:        dp.PublicKey.String(),
-			AllowedIPs:       IPNetsToStrings(dp.AllowedIPs),
-			ReceivedBytes:    dp.ReceiveBytes,
-			TransmittedBytes: dp.TransmitBytes,
-			LastSeen:         dp.LastHandshakeTime.Unix(),
+			PublicKey:  record.PublicKey,
+			AllowedIPs: record.Suspended.AllowedIPs,
+			LastSeen:   record.Suspended.LastHandshakeTime.Unix(),
+			Name:       record.Name,
+			Labels:     record.Labels,
+			Suspended:  true,
 		}
 		peers = append(peers, peer)
 	}
@@ -199,11 +332,11 @@ func (s *Server) ChangeListenPort(ctx context.Context, request *ChangeListenPort
 		return nil, err
 	}
 
-	s.logger.Printf("Client '%s' changing listen port", auth.ClientIdentifier)
+	s.logger.Debug("changing listen port", logKeyClient, auth.ClientIdentifier, logKeyDevice, request.GetDeviceName())
 
-	wireguard := &Wireguard{
+	wireguard := s.wireguard(ctx, &Wireguard{
 		DeviceName: request.GetDeviceName(),
-	}
+	})
 
 	port := int(request.GetListenPort())
 	if port < 0 || port > maxPort {
@@ -217,7 +350,7 @@ func (s *Server) ChangeListenPort(ctx context.Context, request *ChangeListenPort
 		return nil, status.Errorf(codes.Internal, "error changing listen port: %v", err)
 	}
 
-	s.logger.Printf("Client '%s' changed listen port", auth.ClientIdentifier)
+	s.logger.Info("changed listen port", logKeyClient, auth.ClientIdentifier, logKeyDevice, request.GetDeviceName(), logKeyListenPort, port)
 
 	response := &ChangeListenPortResponse{
 		NewListenPort: int32(wireguard.ListenPort),
@@ -232,18 +365,21 @@ func (s *Server) Devices(ctx context.Context, request *DevicesRequest) (*Devices
 		return nil, err
 	}
 
-	s.logger.Printf("Client '%s' looking up devices", auth.ClientIdentifier)
+	s.logger.Debug("listing devices", logKeyClient, auth.ClientIdentifier)
 
-	devices, err := Devices()
+	devices, err := s.devices(ctx)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "error listing devices: %v", err)
 	}
 
-	s.logger.Printf("Client '%s' looked up devices", auth.ClientIdentifier)
+	s.logger.Info("listed devices", logKeyClient, auth.ClientIdentifier)
 
+	// Clients whose permissions are restricted to some devices only see those devices.
 	deviceNames := []string{}
 	for _, device := range devices {
-		deviceNames = append(deviceNames, device.DeviceName)
+		if DeviceAuthorized(auth.Permissions, PermissionListDevices, device.DeviceName) {
+			deviceNames = append(deviceNames, device.DeviceName)
+		}
 	}
 	response := &DevicesResponse{
 		Devices: deviceNames,
@@ -258,8 +394,8 @@ func (s *Server) Import(ctx context.Context, request *ImportRequest) (*ImportRes
 		return nil, err
 	}
 
-	s.logger.Printf("Client '%s' importing peers", auth.ClientIdentifier)
-	wireguard, err := New(request.GetDeviceName())
+	s.logger.Debug("importing peers", logKeyClient, auth.ClientIdentifier, logKeyDevice, request.GetDeviceName(), logKeyPeerCount, len(request.GetPeers()))
+	wireguard, err := s.newWireguard(ctx, request.GetDeviceName())
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, status.Errorf(codes.NotFound, "that wireguard device does not exist: %s", request.GetDeviceName())
@@ -267,6 +403,24 @@ func (s *Server) Import(ctx context.Context, request *ImportRequest) (*ImportRes
 		return nil, status.Errorf(codes.Internal, "error creating peer: %v", err)
 	}
 
+	// Check every peer before touching the device, so a bad or revoked key can't leave the import half applied.
+	// Keys are checked against the denylist once parsed, since base64 allows more than one spelling of the same key.
+	type importedPeer struct {
+		allowedIPs []net.IPNet
+		publicKey  wgtypes.Key
+		record     *PeerRecord
+		previous   *PeerRecord
+		created    bool
+	}
+	devicePeers, err := wireguard.Peers()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error listing peers: %v", err)
+	}
+	onDevice := map[wgtypes.Key]bool{}
+	for _, peer := range devicePeers {
+		onDevice[peer.PublicKey] = true
+	}
+	imports := make([]*importedPeer, 0, len(request.Peers))
 	for _, peer := range request.Peers {
 		allowedIPs, err := StringsToIPNet(peer.AllowedIPs)
 		if err != nil {
@@ -277,19 +431,440 @@ func (s *Server) Import(ctx context.Context, request *ImportRequest) (*ImportRes
 		if err != nil {
 			return nil, status.Errorf(codes.InvalidArgument, "Invalid public key in list: %v", peer.PublicKey)
 		}
-		_, err = wireguard.AddNewPeer(allowedIPs, publicKey)
+
+		err = ValidatePeerMetadata(peer.GetName(), peer.GetLabels())
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid metadata for peer %v: %v", peer.PublicKey, err)
+		}
+
+		err = s.checkNotRevoked(publicKey)
+		if err != nil {
+			return nil, err
+		}
+
+		oldRecord, err := s.peers.Get(wireguard.DeviceName, publicKey.String())
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "error loading peer metadata: %v", err)
+		}
+		if oldRecord != nil && oldRecord.Suspended != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "peer '%s' is suspended and must be resumed or removed before it can be imported", publicKey.String())
+		}
+
+		// Re-importing a peer keeps the metadata it already has unless the import replaces it.
+		record := &PeerRecord{
+			DeviceName: wireguard.DeviceName,
+			PublicKey:  publicKey.String(),
+		}
+		if oldRecord != nil {
+			record.Name = oldRecord.Name
+			record.Labels = oldRecord.Labels
+		}
+		if peer.GetName() != "" {
+			record.Name = peer.GetName()
+		}
+		if len(peer.GetLabels()) > 0 {
+			record.Labels = peer.GetLabels()
+		}
+
+		// Only peers that weren't already known are new. Re-importing one mustn't announce it again, or wait for a first handshake it has already had.
+		created := oldRecord == nil && !onDevice[publicKey]
+		onDevice[publicKey] = true
+
+		imports = append(imports, &importedPeer{
+			allowedIPs: allowedIPs,
+			publicKey:  publicKey,
+			record:     record,
+			previous:   oldRecord,
+			created:    created,
+		})
+	}
+
+	for _, peer := range imports {
+		err = s.peers.Put(peer.record)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "error saving metadata for peer %v: %v", peer.publicKey.String(), err)
+		}
+
+		_, err = wireguard.AddNewPeer(peer.allowedIPs, peer.publicKey)
 		if err != nil {
+			s.restorePeerRecord(peer.previous, peer.record)
 			if os.IsNotExist(err) {
 				return nil, status.Errorf(codes.NotFound, "that wireguard device does not exist")
 			}
 			return nil, status.Errorf(codes.Internal, "error adding peer to wireguard interface: %v", err)
 		}
+
+		if !peer.created {
+			continue
+		}
+		s.notify(&WebhookEvent{
+			Type:             WebhookPeerCreated,
+			ClientIdentifier: auth.ClientIdentifier,
+			DeviceName:       peer.record.DeviceName,
+			PublicKey:        peer.record.PublicKey,
+			Name:             peer.record.Name,
+			Labels:           peer.record.Labels,
+		})
 	}
-	
+
 	response := &ImportResponse{}
 	return response, nil
 }
 
+// SuspendPeer takes a peer off the Wireguard interface and saves its configuration so ResumePeer can restore it.
+func (s *Server) SuspendPeer(ctx context.Context, request *SuspendPeerRequest) (*SuspendPeerResponse, error) {
+	auth, err := s.authResult(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	wireguard := s.wireguard(ctx, &Wireguard{
+		DeviceName: request.GetDeviceName(),
+	})
+
+	publicKey, err := wgtypes.ParseKey(request.GetPublicKey())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid public key: %v", err)
+	}
+
+	s.logger.Debug("suspending peer", logKeyClient, auth.ClientIdentifier, logKeyDevice, request.GetDeviceName(), logKeyPublicKey, publicKey.String())
+
+	devicePeer, err := wireguard.Peer(publicKey)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "that wireguard device does not exist")
+		}
+		if errors.Is(err, ErrPeerNotFound) {
+			return nil, status.Errorf(codes.NotFound, "peer '%s' is not active on that device", publicKey.String())
+		}
+		return nil, status.Errorf(codes.Internal, "error suspending peer: %v", err)
+	}
+
+	oldRecord, err := s.peers.Get(wireguard.DeviceName, publicKey.String())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error loading peer metadata: %v", err)
+	}
+	record := &PeerRecord{
+		DeviceName: wireguard.DeviceName,
+		PublicKey:  publicKey.String(),
+	}
+	if oldRecord != nil {
+		record.Name = oldRecord.Name
+		record.Labels = oldRecord.Labels
+	}
+	record.Suspended = &SuspendedPeer{
+		AllowedIPs:                  IPNetsToStrings(devicePeer.AllowedIPs),
+		PersistentKeepaliveInterval: devicePeer.PersistentKeepaliveInterval,
+		LastHandshakeTime:           devicePeer.LastHandshakeTime,
+		SuspendedAt:                 time.Now(),
+	}
+	if devicePeer.PresharedKey != (wgtypes.Key{}) {
+		record.Suspended.PresharedKey = devicePeer.PresharedKey.String()
+	}
+	if devicePeer.Endpoint != nil {
+		record.Suspended.Endpoint = devicePeer.Endpoint.String()
+	}
+
+	// Save the configuration before touching the device so a failure can never lose it.
+	err = s.peers.Put(record)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error saving peer configuration: %v", err)
+	}
+
+	err = wireguard.RemovePeer(publicKey)
+	if err != nil {
+		s.restorePeerRecord(oldRecord, record)
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "that wireguard device does not exist")
+		}
+		return nil, status.Errorf(codes.Internal, "error suspending peer: %v", err)
+	}
+
+	s.logger.Info("suspended peer", logKeyClient, auth.ClientIdentifier, logKeyDevice, request.GetDeviceName(), logKeyPublicKey, publicKey.String())
+
+	response := &SuspendPeerResponse{
+		Suspended: true,
+	}
+	return response, nil
+}
+
+// ResumePeer puts a suspended peer back on the Wireguard interface with the same key and configuration it had when it was suspended.
+func (s *Server) ResumePeer(ctx context.Context, request *ResumePeerRequest) (*ResumePeerResponse, error) {
+	auth, err := s.authResult(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	wireguard := s.wireguard(ctx, &Wireguard{
+		DeviceName: request.GetDeviceName(),
+	})
+
+	publicKey, err := wgtypes.ParseKey(request.GetPublicKey())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid public key: %v", err)
+	}
+
+	s.logger.Debug("resuming peer", logKeyClient, auth.ClientIdentifier, logKeyDevice, request.GetDeviceName(), logKeyPublicKey, publicKey.String())
+
+	record, err := s.peers.Get(wireguard.DeviceName, publicKey.String())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error loading peer configuration: %v", err)
+	}
+	if record == nil || record.Suspended == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "peer '%s' is not suspended", publicKey.String())
+	}
+
+	err = s.checkNotRevoked(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	peerConfig, err := record.Suspended.PeerConfig(publicKey)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "saved configuration for peer '%s' is invalid: %v", publicKey.String(), err)
+	}
+
+	err = wireguard.RestorePeer(*peerConfig)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "that wireguard device does not exist")
+		}
+		return nil, status.Errorf(codes.Internal, "error resuming peer: %v", err)
+	}
+
+	suspended := record.Suspended
+	record.Suspended = nil
+	err = s.peers.Put(record)
+	if err != nil {
+		// The peer is live again, so put it back into the suspended state rather than leaving it on the device.
+		record.Suspended = suspended
+		removeErr := wireguard.RemovePeer(publicKey)
+		if removeErr != nil {
+			s.logger.Error("failed to re-suspend peer after error saving its state", logKeyDevice, request.GetDeviceName(), logKeyPublicKey, publicKey.String(), logKeyError, removeErr)
+		}
+		return nil, status.Errorf(codes.Internal, "error saving peer configuration: %v", err)
+	}
+
+	s.logger.Info("resumed peer", logKeyClient, auth.ClientIdentifier, logKeyDevice, request.GetDeviceName(), logKeyPublicKey, publicKey.String())
+
+	response := &ResumePeerResponse{
+		Resumed: true,
+	}
+	return response, nil
+}
+
+// ListRevokedKeys returns the denylist of public keys that cannot be added to any device.
+func (s *Server) ListRevokedKeys(ctx context.Context, request *ListRevokedKeysRequest) (*ListRevokedKeysResponse, error) {
+	auth, err := s.authResult(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s.logger.Info("listed revoked keys", logKeyClient, auth.ClientIdentifier)
+
+	revocations, err := s.revocations.List()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error listing revoked keys: %v", err)
+	}
+
+	response := &ListRevokedKeysResponse{
+		RevokedKeys: []*RevokedKey{},
+	}
+	for _, revocation := range revocations {
+		if DeviceAuthorized(auth.Permissions, PermissionListRevokedKeys, revocation.DeviceName) {
+			response.RevokedKeys = append(response.RevokedKeys, revocation.proto())
+		}
+	}
+	return response, nil
+}
+
+// LiftRevocation removes a public key from the denylist so it can be added to a device again.
+func (s *Server) LiftRevocation(ctx context.Context, request *LiftRevocationRequest) (*LiftRevocationResponse, error) {
+	auth, err := s.authResult(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, err := wgtypes.ParseKey(request.GetPublicKey())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid public key: %v", err)
+	}
+
+	s.logger.Debug("lifting revocation", logKeyClient, auth.ClientIdentifier, logKeyPublicKey, publicKey.String())
+
+	// Clients whose permissions are restricted to some devices can only lift revocations made on those devices.
+	revocation, err := s.revocations.Get(publicKey.String())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error loading revocation: %v", err)
+	}
+	if revocation == nil {
+		return nil, status.Errorf(codes.NotFound, "key '%s' is not revoked", publicKey.String())
+	}
+	err = checkDevice(auth, PermissionLiftRevocation, revocation.DeviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	lifted, err := s.revocations.Lift(publicKey.String())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error lifting revocation: %v", err)
+	}
+	if !lifted {
+		return nil, status.Errorf(codes.NotFound, "key '%s' is not revoked", publicKey.String())
+	}
+
+	s.logger.Info("lifted revocation", logKeyClient, auth.ClientIdentifier, logKeyPublicKey, publicKey.String())
+
+	response := &LiftRevocationResponse{
+		Lifted: true,
+	}
+	return response, nil
+}
+
+// QueryAudit returns entries from the audit log, oldest first.
+func (s *Server) QueryAudit(ctx context.Context, request *QueryAuditRequest) (*QueryAuditResponse, error) {
+	auth, err := s.authResult(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.GetLimit() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "limit must not be negative")
+	}
+
+	query := &AuditQuery{
+		DeviceName:       request.GetDeviceName(),
+		PublicKey:        request.GetPublicKey(),
+		ClientIdentifier: request.GetClientIdentifier(),
+		Method:           request.GetMethod(),
+		Limit:            int(request.GetLimit()),
+	}
+	if request.GetSince() != 0 {
+		query.Since = time.Unix(request.GetSince(), 0)
+	}
+	if request.GetUntil() != 0 {
+		query.Until = time.Unix(request.GetUntil(), 0)
+	}
+
+	s.logger.Info("queried audit log", logKeyClient, auth.ClientIdentifier)
+
+	entries, err := s.audit.Query(query)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error querying audit log: %v", err)
+	}
+
+	response := &QueryAuditResponse{
+		Records: []*AuditRecord{},
+	}
+	for _, entry := range entries {
+		response.Records = append(response.Records, entry.proto())
+	}
+	return response, nil
+}
+
+// devicePeer converts a peer on a device, and its record if it has one, to its wire format.
+func devicePeer(dp wgtypes.Peer, record *PeerRecord) *Peer {
+	peer := &Peer{
+		PublicKey:        dp.PublicKey.String(),
+		AllowedIPs:       IPNetsToStrings(dp.AllowedIPs),
+		ReceivedBytes:    dp.ReceiveBytes,
+		TransmittedBytes: dp.TransmitBytes,
+		LastSeen:         dp.LastHandshakeTime.Unix(),
+		Endpoint:         endpointString(dp),
+	}
+	if record != nil {
+		peer.Name = record.Name
+		peer.Labels = record.Labels
+	}
+	return peer
+}
+
+// checkNotRevoked returns a FailedPrecondition status if publicKey is on the denylist.
+// It takes a parsed key so the denylist is always checked with the key's canonical encoding.
+func (s *Server) checkNotRevoked(publicKey wgtypes.Key) error {
+	revoked, err := s.revocations.Get(publicKey.String())
+	if err != nil {
+		return status.Errorf(codes.Internal, "error checking revoked keys: %v", err)
+	}
+	if revoked != nil {
+		return status.Errorf(codes.FailedPrecondition, "key '%s' was revoked at %s (%s) and cannot be added to a device", publicKey, revoked.RevokedAt.Format(time.RFC3339), revoked.Reason)
+	}
+	return nil
+}
+
+// revoke adds a key to the denylist on behalf of the authenticated client.
+// A key that is already revoked keeps its original revocation, which is returned so undoRevoke can leave it in place.
+func (s *Server) revoke(auth *grpcauth.AuthResult, deviceName string, publicKey wgtypes.Key, reason string) (*Revocation, error) {
+	previous, err := s.revocations.Get(publicKey.String())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error checking revoked keys: %v", err)
+	}
+	if previous != nil {
+		return previous, nil
+	}
+
+	revocation := &Revocation{
+		PublicKey:  publicKey.String(),
+		DeviceName: deviceName,
+		Reason:     reason,
+		RevokedBy:  auth.ClientIdentifier,
+		RevokedAt:  time.Now(),
+	}
+	err = s.revocations.Revoke(revocation)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error revoking key: %v", err)
+	}
+	return nil, nil
+}
+
+// undoRevoke undoes revoke when the device change it guarded fails.
+// A key that was already revoked before stays revoked.
+func (s *Server) undoRevoke(publicKey wgtypes.Key, previous *Revocation) {
+	if previous != nil {
+		return
+	}
+
+	_, err := s.revocations.Lift(publicKey.String())
+	if err != nil {
+		s.logger.Error("failed to lift revocation", logKeyPublicKey, publicKey.String(), logKeyError, err)
+	}
+}
+
+// restorePeerRecord puts back the record a peer had before a failed operation replaced it with attempted.
+func (s *Server) restorePeerRecord(previous, attempted *PeerRecord) {
+	if previous == nil {
+		s.deletePeerRecord(attempted.DeviceName, attempted.PublicKey)
+		return
+	}
+
+	err := s.peers.Put(previous)
+	if err != nil {
+		s.logger.Error("failed to restore peer metadata", logKeyDevice, previous.DeviceName, logKeyPublicKey, previous.PublicKey, logKeyError, err)
+	}
+}
+
+// deletePeerRecord removes a peer's stored metadata.
+// Failures are logged rather than returned because the change to the device has already been made.
+func (s *Server) deletePeerRecord(deviceName, publicKey string) {
+	err := s.peers.Delete(deviceName, publicKey)
+	if err != nil {
+		s.logger.Error("failed to delete peer metadata", logKeyDevice, deviceName, logKeyPublicKey, publicKey, logKeyError, err)
+	}
+}
+
+// notify queues a webhook event if webhooks are configured.
+// Failures are logged rather than returned because the change to the device has already been made.
+func (s *Server) notify(event *WebhookEvent) {
+	if s.webhooks == nil {
+		return
+	}
+
+	err := s.webhooks.Notify(event)
+	if err != nil {
+		s.logger.Error("failed to queue webhook event", "event", event.Type, logKeyDevice, event.DeviceName, logKeyPublicKey, event.PublicKey, logKeyError, err)
+	}
+}
+
 func (s *Server) authResult(ctx context.Context) (*grpcauth.AuthResult, error) {
 	auth, err := grpcauth.GetAuthResult(ctx)
 	if err != nil {
@@ -303,21 +878,131 @@ func NewServer(config *ServerConfig) (*grpc.Server, error) {
 	// Create a new TLS credentials based on the TLS configuration and return a gRPC server configured with this.
 	cred := credentials.NewTLS(config.TLSConfig)
 
-	var authFunc grpcauth.AuthFunc
-	var permissionFunc grpcauth.PermissionFunc
-	if config.AuthFunc != nil {
-		authFunc = config.AuthFunc
-	} else {
-		config.Logger.Printf("WARNING: running wgrpcd using only client certificate auth")
+	var logger Logger = slog.Default()
+	if config.Logger != nil {
+		logger = config.Logger
+	}
+
+	// Without a PermissionFunc, grpcauth only allows a method if the client holds its full name as a permission.
+	authFunc := config.AuthFunc
+	permissionFunc := config.PermissionFunc
+	if authFunc == nil {
+		logger.Warn("running wgrpcd using only client certificate auth")
 		authFunc = NoAuth
-		permissionFunc = grpcauth.NoPermissions
+		if permissionFunc == nil {
+			permissionFunc = grpcauth.NoPermissions
+		}
+	} else {
+		authFunc = bindTokensToCertificates(authFunc, config.RequireCertificateBoundTokens)
 	}
 	authority := grpcauth.NewAuthority(authFunc, permissionFunc)
+	unaryAuth := describeUnaryPermissionDenied(authority.UnaryServerInterceptor)
+	streamAuth := describeStreamPermissionDenied(authority.StreamServerInterceptor)
+	if config.PeerCredAuth != nil {
+		// Unix socket policies are written for wgrpcd, so they can always grant roles and device scopes.
+		cred = &peerCredCredentials{TransportCredentials: cred}
+		peerCredAuthority := grpcauth.NewAuthority(config.PeerCredAuth.AuthFunc, RolePermissionFunc)
+		unaryAuth = peerCredOrUnary(describeUnaryPermissionDenied(peerCredAuthority.UnaryServerInterceptor), unaryAuth)
+		streamAuth = peerCredOrStream(describeStreamPermissionDenied(peerCredAuthority.StreamServerInterceptor), streamAuth)
+	}
+
+	auditLog := config.AuditLog
+	if auditLog == nil {
+		logger.Warn("the audit log will not be persisted without an AuditLog")
+		auditLog = newMemoryAuditLog()
+	}
+	auditor := &auditor{
+		log:    auditLog,
+		logger: logger,
+	}
+
+	// Load balancers usually can't authenticate, so health checks skip authentication unless asked not to.
+	unauthenticated := map[string]bool{}
+	if !config.AuthenticateHealthChecks {
+		unauthenticated[PermissionHealthCheck] = true
+		unauthenticated[PermissionHealthWatch] = true
+	}
+
+	// Tracing runs first so the server span covers authentication and carries the client's trace context.
+	// Metrics and auditing run before authentication so refused requests are counted and recorded,
+	// and learn which client made the request from identifyUnaryClient.
+	// identifyClientCert passes the client certificate's identity to the AuthFunc for ClientCertAuth, and its thumbprint for checking certificate-bound tokens.
+	// identifyPeerCred does the same for the uid and gid of processes connected over a Unix socket.
+	// Rate limits are applied per client once it is known, and authorizeDevice checks permissions restricted to some devices.
+	// Streams go through the same interceptors, except auditing, since no streaming RPC changes anything.
+	tp := tracerProvider(config.TracerProvider)
+	unaryInterceptors := []grpc.UnaryServerInterceptor{
+		otelgrpc.UnaryServerInterceptor(otelgrpc.WithTracerProvider(tp), otelgrpc.WithPropagators(tracePropagator())),
+	}
+	streamInterceptors := []grpc.StreamServerInterceptor{
+		otelgrpc.StreamServerInterceptor(otelgrpc.WithTracerProvider(tp), otelgrpc.WithPropagators(tracePropagator())),
+	}
+	if config.Metrics != nil {
+		unaryInterceptors = append(unaryInterceptors, config.Metrics.UnaryServerInterceptor)
+		streamInterceptors = append(streamInterceptors, config.Metrics.StreamServerInterceptor)
+	}
+	unaryInterceptors = append(unaryInterceptors,
+		auditor.UnaryServerInterceptor,
+		identifyClientCertUnary,
+		identifyPeerCredUnary,
+		unaryUnless(unauthenticated, unaryAuth),
+		identifyUnaryClient,
+	)
+	streamInterceptors = append(streamInterceptors,
+		identifyClientCertStream,
+		identifyPeerCredStream,
+		streamUnless(unauthenticated, streamAuth),
+		identifyStreamClient,
+	)
+	if config.RateLimits != nil {
+		limiter, err := newRateLimiter(config.RateLimits, logger)
+		if err != nil {
+			return nil, err
+		}
+		unaryInterceptors = append(unaryInterceptors, limiter.UnaryServerInterceptor)
+		streamInterceptors = append(streamInterceptors, limiter.StreamServerInterceptor)
+	}
+	unaryInterceptors = append(unaryInterceptors, authorizeDeviceUnary)
+	streamInterceptors = append(streamInterceptors, authorizeDeviceStream)
 
 	rpcServer := grpc.NewServer(
 		grpc.Creds(cred),
-		grpc.UnaryInterceptor(authority.UnaryServerInterceptor),
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
+		grpc.ChainStreamInterceptor(streamInterceptors...),
 	)
-	RegisterWireguardRPCServer(rpcServer, &Server{logger: config.Logger})
+	peerStore := config.PeerStore
+	if peerStore == nil {
+		logger.Warn("peer metadata will not be persisted without a PeerStore")
+		peerStore = newMemoryPeerStore()
+	}
+
+	revocationStore := config.RevocationStore
+	if revocationStore == nil {
+		logger.Warn("revoked keys will not be persisted without a RevocationStore")
+		revocationStore = newMemoryRevocationStore()
+	}
+
+	if config.Metrics != nil {
+		config.Metrics.devices.peers = peerStore
+	}
+
+	healthpb.RegisterHealthServer(rpcServer, &healthServer{
+		devices: config.ManagedDevices,
+		logger:  logger,
+		done:    config.Done,
+	})
+	if config.Reflection {
+		reflection.Register(rpcServer)
+	}
+
+	RegisterWireguardRPCServer(rpcServer, &Server{
+		logger:      logger,
+		peers:       peerStore,
+		revocations: revocationStore,
+		audit:       auditLog,
+		webhooks:    config.Webhooks,
+		tracer:      tp.Tracer(tracerName),
+		done:        config.Done,
+	})
 	return rpcServer, nil
 }
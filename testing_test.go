@@ -0,0 +1,319 @@
+package wgrpcd
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// testCertificate issues a certificate for template signed by parent, or self-signed if parent is nil.
+func testCertificate(t *testing.T, template *x509.Certificate, parent *tls.Certificate) *tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Minute)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	issuer, signer := template, interface{}(key)
+	if parent != nil {
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+}
+
+// testTLSConfigs returns the TLS configuration of a server requiring client certificates and of a client it trusts, both issued by a throwaway CA.
+func testTLSConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+	t.Helper()
+
+	ca := testCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "wgrpcd test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	server := testCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	client := testCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "test-client"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{*server},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+	clientConfig := &tls.Config{
+		Certificates: []tls.Certificate{*client},
+		RootCAs:      pool,
+		ServerName:   "127.0.0.1",
+		MinVersion:   tls.VersionTLS12,
+	}
+	return serverConfig, clientConfig
+}
+
+// serveTest starts rpcServer on a local port and returns its address.
+// The server is stopped when the test ends.
+func serveTest(t *testing.T, rpcServer *grpc.Server) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go rpcServer.Serve(listener)
+	t.Cleanup(rpcServer.Stop)
+	return listener.Addr().String()
+}
+
+// dialTest connects to a server started by serveTest.
+func dialTest(t *testing.T, address string, clientConfig *tls.Config, options ...grpc.DialOption) *grpc.ClientConn {
+	t.Helper()
+
+	options = append(options, grpc.WithTransportCredentials(credentials.NewTLS(clientConfig)))
+	conn, err := grpc.Dial(address, options...)
+	if err != nil {
+		t.Fatalf("failed to dial %s: %v", address, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// testToken sends a bearer token with every request, since grpcauth refuses requests without one before calling the AuthFunc.
+type testToken struct{}
+
+func (testToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer token"}, nil
+}
+
+func (testToken) RequireTransportSecurity() bool {
+	return true
+}
+
+// newTestClient serves wgrpcd with config and returns a client for it.
+// The TLS configuration and logger are filled in, and unless config has an AuthFunc, every request is authenticated with permissions.
+func newTestClient(t *testing.T, config *ServerConfig, permissions ...string) WireguardRPCClient {
+	t.Helper()
+
+	serverConfig, clientConfig := testTLSConfigs(t)
+	config.TLSConfig = serverConfig
+	if config.Logger == nil {
+		config.Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	}
+	if config.AuthFunc == nil {
+		config.AuthFunc = staticAuth(permissions...)
+	}
+	rpcServer, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	conn := dialTest(t, serveTest(t, rpcServer), clientConfig, grpc.WithPerRPCCredentials(testToken{}))
+	return NewWireguardRPCClient(conn)
+}
+
+// fakeWireguard keeps Wireguard devices in memory, so the server can be tested without creating real ones.
+type fakeWireguard struct {
+	mutex   sync.Mutex
+	devices map[string]*wgtypes.Device
+	// configureErr, if set, is returned by ConfigureDevice without changing the device.
+	configureErr error
+}
+
+// useFakeWireguard makes Wireguard use a fakeWireguard with the named devices until the test ends.
+func useFakeWireguard(t *testing.T, deviceNames ...string) *fakeWireguard {
+	t.Helper()
+
+	fake := &fakeWireguard{devices: map[string]*wgtypes.Device{}}
+	for _, name := range deviceNames {
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			t.Fatalf("failed to generate key: %v", err)
+		}
+		fake.devices[name] = &wgtypes.Device{
+			Name:       name,
+			PrivateKey: key,
+			PublicKey:  key.PublicKey(),
+			ListenPort: 51820,
+		}
+	}
+
+	previous := newWireguardClient
+	newWireguardClient = func() (wireguardClient, error) {
+		return fake, nil
+	}
+	t.Cleanup(func() {
+		newWireguardClient = previous
+	})
+	return fake
+}
+
+func (f *fakeWireguard) Close() error {
+	return nil
+}
+
+func (f *fakeWireguard) Devices() ([]*wgtypes.Device, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	devices := []*wgtypes.Device{}
+	for _, device := range f.devices {
+		devices = append(devices, copyDevice(device))
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Name < devices[j].Name
+	})
+	return devices, nil
+}
+
+func (f *fakeWireguard) Device(name string) (*wgtypes.Device, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	device, ok := f.devices[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return copyDevice(device), nil
+}
+
+// ConfigureDevice applies the parts of config that Wireguard uses.
+func (f *fakeWireguard) ConfigureDevice(name string, config wgtypes.Config) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.configureErr != nil {
+		return f.configureErr
+	}
+	device, ok := f.devices[name]
+	if !ok {
+		return os.ErrNotExist
+	}
+	if config.ListenPort != nil {
+		device.ListenPort = *config.ListenPort
+	}
+	if config.ReplacePeers {
+		device.Peers = nil
+	}
+	for _, peerConfig := range config.Peers {
+		index := -1
+		for i, peer := range device.Peers {
+			if peer.PublicKey == peerConfig.PublicKey {
+				index = i
+			}
+		}
+		if peerConfig.Remove {
+			if index >= 0 {
+				device.Peers = append(device.Peers[:index], device.Peers[index+1:]...)
+			}
+			continue
+		}
+		if index < 0 {
+			device.Peers = append(device.Peers, wgtypes.Peer{PublicKey: peerConfig.PublicKey})
+			index = len(device.Peers) - 1
+		}
+		peer := &device.Peers[index]
+		if peerConfig.ReplaceAllowedIPs {
+			peer.AllowedIPs = nil
+		}
+		peer.AllowedIPs = append(peer.AllowedIPs, peerConfig.AllowedIPs...)
+		if peerConfig.Endpoint != nil {
+			peer.Endpoint = peerConfig.Endpoint
+		}
+		if peerConfig.PresharedKey != nil {
+			peer.PresharedKey = *peerConfig.PresharedKey
+		}
+		if peerConfig.PersistentKeepaliveInterval != nil {
+			peer.PersistentKeepaliveInterval = *peerConfig.PersistentKeepaliveInterval
+		}
+	}
+	return nil
+}
+
+// peer returns a copy of a peer on a device, or nil if there is no such peer.
+func (f *fakeWireguard) peer(deviceName string, publicKey wgtypes.Key) *wgtypes.Peer {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for _, peer := range f.devices[deviceName].Peers {
+		if peer.PublicKey == publicKey {
+			return &peer
+		}
+	}
+	return nil
+}
+
+// handshake records a handshake from a peer, as if it had connected.
+func (f *fakeWireguard) handshake(deviceName string, publicKey wgtypes.Key, at time.Time) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	peers := f.devices[deviceName].Peers
+	for i := range peers {
+		if peers[i].PublicKey == publicKey {
+			peers[i].LastHandshakeTime = at
+		}
+	}
+}
+
+func copyDevice(device *wgtypes.Device) *wgtypes.Device {
+	c := *device
+	c.Peers = make([]wgtypes.Peer, len(device.Peers))
+	for i, peer := range device.Peers {
+		c.Peers[i] = peer
+		c.Peers[i].AllowedIPs = append([]net.IPNet{}, peer.AllowedIPs...)
+	}
+	return &c
+}
+
+// testPublicKey returns a new random Wireguard public key.
+func testPublicKey(t *testing.T) wgtypes.Key {
+	t.Helper()
+
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	return key.PublicKey()
+}
@@ -0,0 +1,340 @@
+package wgrpcd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joncooperworks/grpcauth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// signedTokenHeader is the JOSE header of every signed token, so tokens can be read by any JWT library that supports EdDSA.
+var signedTokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"EdDSA","typ":"JWT"}`))
+
+// SignedToken is a credential wgrpcd can verify with a local Ed25519 public key, without an OpenID provider.
+// It is encoded as a JWT signed with EdDSA.
+type SignedToken struct {
+	// ID identifies the token so it can be revoked. IssueSignedToken generates one if it is empty.
+	ID string
+
+	// Subject is the client identifier of the token's holder.
+	Subject string
+
+	// Scopes are the permissions, roles or device scopes the token grants.
+	Scopes []string
+
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+
+	// CertificateThumbprint binds the token to a client certificate, as returned by CertificateThumbprint.
+	// A bound token is only accepted from a client connecting with that certificate.
+	CertificateThumbprint string
+}
+
+// signedTokenClaims are the JWT claims a SignedToken is encoded as.
+type signedTokenClaims struct {
+	ID           string             `json:"jti"`
+	Subject      string             `json:"sub"`
+	Scope        string             `json:"scope"`
+	IssuedAt     int64              `json:"iat"`
+	ExpiresAt    int64              `json:"exp"`
+	Confirmation *tokenConfirmation `json:"cnf,omitempty"`
+}
+
+// IssueSignedToken signs token with privateKey.
+// Tokens must have a subject and an expiry.
+func IssueSignedToken(privateKey ed25519.PrivateKey, token *SignedToken) (string, error) {
+	if token.Subject == "" {
+		return "", fmt.Errorf("token has no subject")
+	}
+	if token.ExpiresAt.IsZero() {
+		return "", fmt.Errorf("token has no expiry")
+	}
+
+	id := token.ID
+	if id == "" {
+		b := make([]byte, 16)
+		_, err := rand.Read(b)
+		if err != nil {
+			return "", err
+		}
+		id = hex.EncodeToString(b)
+	}
+	issuedAt := token.IssuedAt
+	if issuedAt.IsZero() {
+		issuedAt = time.Now()
+	}
+
+	claims := &signedTokenClaims{
+		ID:        id,
+		Subject:   token.Subject,
+		Scope:     strings.Join(token.Scopes, " "),
+		IssuedAt:  issuedAt.Unix(),
+		ExpiresAt: token.ExpiresAt.Unix(),
+	}
+	if token.CertificateThumbprint != "" {
+		claims.Confirmation = &tokenConfirmation{CertificateThumbprint: token.CertificateThumbprint}
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := signedTokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature := ed25519.Sign(privateKey, []byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// ParseSignedToken checks tokenString was signed by publicKey and hasn't expired.
+func ParseSignedToken(publicKey ed25519.PublicKey, tokenString string) (*SignedToken, error) {
+	parts := strings.Split(tokenString, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	// Only tokens signed the way IssueSignedToken signs them are accepted, so the header can't pick the algorithm.
+	if parts[0] != signedTokenHeader {
+		return nil, fmt.Errorf("unsupported token header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %w", err)
+	}
+	if !ed25519.Verify(publicKey, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, fmt.Errorf("invalid token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+	claims := &signedTokenClaims{}
+	err = json.Unmarshal(payload, claims)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+
+	token := &SignedToken{
+		ID:        claims.ID,
+		Subject:   claims.Subject,
+		Scopes:    strings.Fields(claims.Scope),
+		IssuedAt:  time.Unix(claims.IssuedAt, 0),
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+	}
+	if claims.Confirmation != nil {
+		token.CertificateThumbprint = claims.Confirmation.CertificateThumbprint
+	}
+	if token.ID == "" || token.Subject == "" {
+		return nil, fmt.Errorf("token has no ID or subject")
+	}
+	if claims.ExpiresAt == 0 || time.Now().After(token.ExpiresAt) {
+		return nil, fmt.Errorf("token has expired")
+	}
+	return token, nil
+}
+
+// SignedTokenAuth authenticates clients with SignedTokens verified against a local Ed25519 public key.
+// Each client can be given its own token, and a token can be revoked by its ID without affecting the others.
+type SignedTokenAuth struct {
+	publicKey ed25519.PublicKey
+
+	mutex   sync.RWMutex
+	revoked map[string]bool
+}
+
+// NewSignedTokenAuth returns a SignedTokenAuth that accepts tokens signed by publicKey, except those with an ID in revokedIDs.
+func NewSignedTokenAuth(publicKey ed25519.PublicKey, revokedIDs []string) *SignedTokenAuth {
+	auth := &SignedTokenAuth{publicKey: publicKey}
+	auth.SetRevokedIDs(revokedIDs)
+	return auth
+}
+
+// SetRevokedIDs replaces the IDs of tokens that are no longer accepted.
+func (s *SignedTokenAuth) SetRevokedIDs(revokedIDs []string) {
+	revoked := map[string]bool{}
+	for _, id := range revokedIDs {
+		revoked[id] = true
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.revoked = revoked
+}
+
+// AuthFunc is a grpcauth.AuthFunc that accepts a bearer SignedToken that hasn't expired or been revoked.
+func (s *SignedTokenAuth) AuthFunc(md metadata.MD) (*grpcauth.AuthResult, error) {
+	if len(md["authorization"]) != 1 {
+		return nil, fmt.Errorf("expected token in 'authorization' metadata field")
+	}
+
+	token, err := ParseSignedToken(s.publicKey, strings.TrimPrefix(md["authorization"][0], "Bearer "))
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.RLock()
+	revoked := s.revoked[token.ID]
+	s.mutex.RUnlock()
+	if revoked {
+		return nil, fmt.Errorf("token %s has been revoked", token.ID)
+	}
+
+	return &grpcauth.AuthResult{
+		ClientIdentifier: token.Subject,
+		Timestamp:        time.Now(),
+		Permissions:      token.Scopes,
+	}, nil
+}
+
+// LoadRevokedTokenIDs reads a revocation list with one token ID per line.
+// Blank lines and lines starting with # are ignored, and a missing file revokes nothing.
+func LoadRevokedTokenIDs(filename string) ([]string, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ids = append(ids, line)
+	}
+	return ids, scanner.Err()
+}
+
+// RevokeTokenID adds id to the revocation list in filename, creating it if needed.
+func RevokeTokenID(filename, id string) error {
+	id = strings.TrimSpace(id)
+	if id == "" || strings.ContainsAny(id, "\r\n") {
+		return fmt.Errorf("invalid token ID %q", id)
+	}
+
+	ids, err := LoadRevokedTokenIDs(filename)
+	if err != nil {
+		return err
+	}
+	for _, revoked := range ids {
+		if revoked == id {
+			return nil
+		}
+	}
+
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(contents) > 0 && contents[len(contents)-1] != '\n' {
+		contents = append(contents, '\n')
+	}
+	contents = append(contents, id+"\n"...)
+	return writeFileAtomic(filename, contents, 0644)
+}
+
+// GenerateTokenKey returns a new Ed25519 signing key for SignedTokens as PEM encoded PKCS #8 private and PKIX public keys.
+func GenerateTokenKey() ([]byte, []byte, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}),
+		nil
+}
+
+// LoadTokenPrivateKey reads a PEM encoded PKCS #8 Ed25519 private key written by GenerateTokenKey.
+func LoadTokenPrivateKey(filename string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(filename, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key in %s: %w", filename, err)
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 private key", filename)
+	}
+	return privateKey, nil
+}
+
+// LoadTokenPublicKey reads a PEM encoded PKIX Ed25519 public key written by GenerateTokenKey.
+func LoadTokenPublicKey(filename string) (ed25519.PublicKey, error) {
+	der, err := readPEM(filename, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key in %s: %w", filename, err)
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 public key", filename)
+	}
+	return publicKey, nil
+}
+
+// readPEM returns the contents of the first PEM block of blockType in filename.
+func readPEM(filename, blockType string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, contents = pem.Decode(contents)
+		if block == nil {
+			return nil, fmt.Errorf("no %s found in %s", blockType, filename)
+		}
+		if block.Type == blockType {
+			return block.Bytes, nil
+		}
+	}
+}
+
+// SignedTokenCredentials sends a SignedToken with every call, for use in ClientConfig.Options.
+func SignedTokenCredentials(token string) grpc.DialOption {
+	return grpc.WithPerRPCCredentials(signedTokenCredentials(token))
+}
+
+type signedTokenCredentials string
+
+func (s signedTokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(s)}, nil
+}
+
+func (s signedTokenCredentials) RequireTransportSecurity() bool {
+	return true
+}
@@ -0,0 +1,261 @@
+package wgrpcd
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+func newTestTokenKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	return publicKey, privateKey
+}
+
+// signTestToken signs claims under header, without the checks IssueSignedToken makes.
+func signTestToken(t *testing.T, privateKey ed25519.PrivateKey, header string, claims map[string]interface{}) string {
+	t.Helper()
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("failed to encode claims: %v", err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature := ed25519.Sign(privateKey, []byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestSignedTokenRoundTrip(t *testing.T) {
+	publicKey, privateKey := newTestTokenKey(t)
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	tokenString, err := IssueSignedToken(privateKey, &SignedToken{
+		Subject:               "deploy-bot",
+		Scopes:                []string{RoleProvisioner, "ListPeers@wg0"},
+		ExpiresAt:             expiresAt,
+		CertificateThumbprint: "thumbprint",
+	})
+	if err != nil {
+		t.Fatalf("IssueSignedToken: %v", err)
+	}
+
+	token, err := ParseSignedToken(publicKey, tokenString)
+	if err != nil {
+		t.Fatalf("ParseSignedToken: %v", err)
+	}
+	if token.ID == "" {
+		t.Error("token was not given an ID")
+	}
+	if token.Subject != "deploy-bot" {
+		t.Errorf("got subject %q, want deploy-bot", token.Subject)
+	}
+	if !reflect.DeepEqual(token.Scopes, []string{RoleProvisioner, "ListPeers@wg0"}) {
+		t.Errorf("got scopes %q", token.Scopes)
+	}
+	if !token.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("got expiry %v, want %v", token.ExpiresAt, expiresAt)
+	}
+	if token.CertificateThumbprint != "thumbprint" {
+		t.Errorf("got certificate thumbprint %q, want thumbprint", token.CertificateThumbprint)
+	}
+}
+
+func TestParseSignedTokenRefusesTamperedTokens(t *testing.T) {
+	publicKey, privateKey := newTestTokenKey(t)
+	tokenString, err := IssueSignedToken(privateKey, &SignedToken{
+		Subject:   "reader",
+		Scopes:    []string{RoleReader},
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("IssueSignedToken: %v", err)
+	}
+	parts := strings.Split(tokenString, ".")
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatalf("failed to decode payload: %v", err)
+	}
+	escalated := strings.Replace(string(payload), RoleReader, RoleAdmin, 1)
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatalf("failed to decode signature: %v", err)
+	}
+	signature[0] ^= 0xff
+	_, otherKey := newTestTokenKey(t)
+	otherToken, err := IssueSignedToken(otherKey, &SignedToken{Subject: "reader", ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("IssueSignedToken: %v", err)
+	}
+
+	tests := map[string]string{
+		"tampered payload":   parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(escalated)) + "." + parts[2],
+		"tampered signature": parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(signature),
+		"missing signature":  parts[0] + "." + parts[1] + ".",
+		"other signing key":  otherToken,
+		"not a token":        "token",
+	}
+	for name, tokenString := range tests {
+		_, err := ParseSignedToken(publicKey, tokenString)
+		if err == nil {
+			t.Errorf("%s: token was accepted", name)
+		}
+	}
+}
+
+func TestParseSignedTokenRefusesOtherHeaders(t *testing.T) {
+	publicKey, privateKey := newTestTokenKey(t)
+	claims := map[string]interface{}{
+		"jti": "id",
+		"sub": "client",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+
+	headers := []string{
+		`{"alg":"none","typ":"JWT"}`,
+		`{"alg":"HS256","typ":"JWT"}`,
+		`{"typ":"JWT","alg":"EdDSA"}`,
+		`{"alg":"EdDSA","typ":"JWT","kid":"other"}`,
+	}
+	for _, header := range headers {
+		_, err := ParseSignedToken(publicKey, signTestToken(t, privateKey, header, claims))
+		if err == nil {
+			t.Errorf("token with header %s was accepted", header)
+		}
+	}
+
+	_, err := ParseSignedToken(publicKey, signTestToken(t, privateKey, `{"alg":"EdDSA","typ":"JWT"}`, claims))
+	if err != nil {
+		t.Errorf("token with the expected header was refused: %v", err)
+	}
+}
+
+func TestParseSignedTokenRequiresClaims(t *testing.T) {
+	publicKey, privateKey := newTestTokenKey(t)
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"jti": "id",
+			"sub": "client",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+	}
+
+	tests := map[string]func(claims map[string]interface{}){
+		"expired":     func(claims map[string]interface{}) { claims["exp"] = time.Now().Add(-time.Minute).Unix() },
+		"missing exp": func(claims map[string]interface{}) { delete(claims, "exp") },
+		"missing jti": func(claims map[string]interface{}) { delete(claims, "jti") },
+		"missing sub": func(claims map[string]interface{}) { delete(claims, "sub") },
+	}
+	for name, change := range tests {
+		claims := valid()
+		change(claims)
+		_, err := ParseSignedToken(publicKey, signTestToken(t, privateKey, `{"alg":"EdDSA","typ":"JWT"}`, claims))
+		if err == nil {
+			t.Errorf("%s: token was accepted", name)
+		}
+	}
+}
+
+func TestIssueSignedTokenRequiresSubjectAndExpiry(t *testing.T) {
+	_, privateKey := newTestTokenKey(t)
+
+	_, err := IssueSignedToken(privateKey, &SignedToken{ExpiresAt: time.Now().Add(time.Hour)})
+	if err == nil {
+		t.Error("token without a subject was issued")
+	}
+	_, err = IssueSignedToken(privateKey, &SignedToken{Subject: "client"})
+	if err == nil {
+		t.Error("token without an expiry was issued")
+	}
+}
+
+func TestSignedTokenAuthRefusesRevokedTokens(t *testing.T) {
+	publicKey, privateKey := newTestTokenKey(t)
+	issue := func(id string) metadata.MD {
+		tokenString, err := IssueSignedToken(privateKey, &SignedToken{
+			ID:        id,
+			Subject:   "client-" + id,
+			Scopes:    []string{RoleReader},
+			ExpiresAt: time.Now().Add(time.Hour),
+		})
+		if err != nil {
+			t.Fatalf("IssueSignedToken: %v", err)
+		}
+		return metadata.Pairs("authorization", "Bearer "+tokenString)
+	}
+
+	auth := NewSignedTokenAuth(publicKey, []string{"revoked"})
+	_, err := auth.AuthFunc(issue("revoked"))
+	if err == nil {
+		t.Error("revoked token was accepted")
+	}
+
+	result, err := auth.AuthFunc(issue("valid"))
+	if err != nil {
+		t.Fatalf("valid token was refused: %v", err)
+	}
+	if result.ClientIdentifier != "client-valid" || !reflect.DeepEqual(result.Permissions, []string{RoleReader}) {
+		t.Errorf("got auth result %+v", result)
+	}
+
+	auth.SetRevokedIDs([]string{"valid"})
+	_, err = auth.AuthFunc(issue("valid"))
+	if err == nil {
+		t.Error("token revoked by SetRevokedIDs was accepted")
+	}
+
+	_, err = auth.AuthFunc(metadata.MD{})
+	if err == nil {
+		t.Error("request without a token was accepted")
+	}
+}
+
+func TestRevokeTokenID(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "revoked-tokens")
+
+	ids, err := LoadRevokedTokenIDs(filename)
+	if err != nil {
+		t.Fatalf("LoadRevokedTokenIDs of a missing file: %v", err)
+	}
+	if len(ids) != 0 {
+		t.Errorf("missing file revoked %q", ids)
+	}
+
+	err = ioutil.WriteFile(filename, []byte("# revoked tokens\n\nfirst"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write revocation list: %v", err)
+	}
+	for _, id := range []string{"second", " third ", "second"} {
+		err = RevokeTokenID(filename, id)
+		if err != nil {
+			t.Fatalf("RevokeTokenID(%q): %v", id, err)
+		}
+	}
+	for _, id := range []string{"", "fourth\nfifth"} {
+		err = RevokeTokenID(filename, id)
+		if err == nil {
+			t.Errorf("RevokeTokenID(%q) succeeded", id)
+		}
+	}
+
+	ids, err = LoadRevokedTokenIDs(filename)
+	if err != nil {
+		t.Fatalf("LoadRevokedTokenIDs: %v", err)
+	}
+	if want := []string{"first", "second", "third"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got revoked IDs %q, want %q", ids, want)
+	}
+}
@@ -0,0 +1,164 @@
+package wgrpcd
+
+import (
+	"context"
+	"net"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	// tracerName identifies spans created by wgrpcd itself, as opposed to the gRPC instrumentation.
+	tracerName = "github.com/joncooperworks/wgrpcd"
+
+	deviceAttribute    = attribute.Key("wgrpcd.device")
+	publicKeyAttribute = attribute.Key("wgrpcd.public_key")
+)
+
+// tracerProvider returns tp, or the global OpenTelemetry TracerProvider if tp is nil.
+// The global provider does nothing unless the application has configured one.
+func tracerProvider(tp trace.TracerProvider) trace.TracerProvider {
+	if tp == nil {
+		return otel.GetTracerProvider()
+	}
+	return tp
+}
+
+// tracePropagator returns the W3C trace context and baggage propagator wgrpcd uses to carry spans over gRPC metadata.
+func tracePropagator() propagation.TextMapPropagator {
+	return propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+}
+
+// endSpan records err on span, if there is one, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TracedCredentials wraps per-RPC credentials, like an OAuth2 token source, so fetching them is recorded as its own span.
+// Use it with grpc.WithPerRPCCredentials to tell a slow token fetch apart from a slow wgrpcd server.
+func TracedCredentials(creds credentials.PerRPCCredentials, tp trace.TracerProvider) credentials.PerRPCCredentials {
+	return &tracedCredentials{
+		PerRPCCredentials: creds,
+		tracer:            tracerProvider(tp).Tracer(tracerName),
+	}
+}
+
+type tracedCredentials struct {
+	credentials.PerRPCCredentials
+	tracer trace.Tracer
+}
+
+// GetRequestMetadata satisfies credentials.PerRPCCredentials.
+func (t *tracedCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	ctx, span := t.tracer.Start(ctx, "wgrpcd.GetRequestMetadata", trace.WithSpanKind(trace.SpanKindClient))
+	md, err := t.PerRPCCredentials.GetRequestMetadata(ctx, uri...)
+	endSpan(span, err)
+	return md, err
+}
+
+// tracedWireguard runs each call to the Wireguard backend in a child span of the request that made it.
+type tracedWireguard struct {
+	*Wireguard
+	ctx    context.Context
+	tracer trace.Tracer
+}
+
+func (t *tracedWireguard) start(operation string, attributes ...attribute.KeyValue) trace.Span {
+	attributes = append(attributes, deviceAttribute.String(t.DeviceName))
+	_, span := t.tracer.Start(t.ctx, "Wireguard."+operation, trace.WithAttributes(attributes...))
+	return span
+}
+
+// ChangeListenPort traces Wireguard.ChangeListenPort.
+func (t *tracedWireguard) ChangeListenPort(port int) error {
+	span := t.start("ChangeListenPort", attribute.Int("wgrpcd.listen_port", port))
+	err := t.Wireguard.ChangeListenPort(port)
+	endSpan(span, err)
+	return err
+}
+
+// AddNewPeer traces Wireguard.AddNewPeer.
+func (t *tracedWireguard) AddNewPeer(allowedIPs []net.IPNet, publicKey wgtypes.Key) (*wgtypes.PeerConfig, error) {
+	span := t.start("AddNewPeer", publicKeyAttribute.String(publicKey.String()))
+	peerConfig, err := t.Wireguard.AddNewPeer(allowedIPs, publicKey)
+	endSpan(span, err)
+	return peerConfig, err
+}
+
+// RekeyClient traces Wireguard.RekeyClient.
+func (t *tracedWireguard) RekeyClient(allowedIPs []net.IPNet, oldPublicKey, newPublicKey wgtypes.Key) (*wgtypes.PeerConfig, error) {
+	span := t.start("RekeyClient", publicKeyAttribute.String(oldPublicKey.String()), attribute.String("wgrpcd.new_public_key", newPublicKey.String()))
+	peerConfig, err := t.Wireguard.RekeyClient(allowedIPs, oldPublicKey, newPublicKey)
+	endSpan(span, err)
+	return peerConfig, err
+}
+
+// RemovePeer traces Wireguard.RemovePeer.
+func (t *tracedWireguard) RemovePeer(publicKey wgtypes.Key) error {
+	span := t.start("RemovePeer", publicKeyAttribute.String(publicKey.String()))
+	err := t.Wireguard.RemovePeer(publicKey)
+	endSpan(span, err)
+	return err
+}
+
+// Peers traces Wireguard.Peers.
+func (t *tracedWireguard) Peers() ([]wgtypes.Peer, error) {
+	span := t.start("Peers")
+	peers, err := t.Wireguard.Peers()
+	endSpan(span, err)
+	return peers, err
+}
+
+// Peer traces Wireguard.Peer.
+func (t *tracedWireguard) Peer(publicKey wgtypes.Key) (*wgtypes.Peer, error) {
+	span := t.start("Peer", publicKeyAttribute.String(publicKey.String()))
+	peer, err := t.Wireguard.Peer(publicKey)
+	endSpan(span, err)
+	return peer, err
+}
+
+// RestorePeer traces Wireguard.RestorePeer.
+func (t *tracedWireguard) RestorePeer(peerConfig wgtypes.PeerConfig) error {
+	span := t.start("RestorePeer", publicKeyAttribute.String(peerConfig.PublicKey.String()))
+	err := t.Wireguard.RestorePeer(peerConfig)
+	endSpan(span, err)
+	return err
+}
+
+// newWireguard traces New and returns the device wrapped so its calls are traced as well.
+func (s *Server) newWireguard(ctx context.Context, deviceName string) (*tracedWireguard, error) {
+	_, span := s.tracer.Start(ctx, "Wireguard.New", trace.WithAttributes(deviceAttribute.String(deviceName)))
+	wireguard, err := New(deviceName)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	return s.wireguard(ctx, wireguard), nil
+}
+
+// wireguard wraps an existing Wireguard so its calls are traced as children of ctx.
+func (s *Server) wireguard(ctx context.Context, wireguard *Wireguard) *tracedWireguard {
+	return &tracedWireguard{
+		Wireguard: wireguard,
+		ctx:       ctx,
+		tracer:    s.tracer,
+	}
+}
+
+// devices traces Devices.
+func (s *Server) devices(ctx context.Context) ([]*Wireguard, error) {
+	_, span := s.tracer.Start(ctx, "Wireguard.Devices")
+	devices, err := Devices()
+	endSpan(span, err)
+	return devices, err
+}
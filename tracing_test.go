@@ -0,0 +1,104 @@
+package wgrpcd
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"testing"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// newInMemoryTracerProvider returns a TracerProvider that exports every span as soon as it ends to the returned in-memory exporter.
+func newInMemoryTracerProvider() (*sdktrace.TracerProvider, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	return sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)), exporter
+}
+
+func TestServerContinuesClientTrace(t *testing.T) {
+	tp, exporter := newInMemoryTracerProvider()
+	serverConfig, clientConfig := testTLSConfigs(t)
+	rpcServer, err := NewServer(&ServerConfig{
+		TLSConfig:      serverConfig,
+		Logger:         slog.New(slog.NewTextHandler(ioutil.Discard, nil)),
+		TracerProvider: tp,
+	})
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+
+	conn := dialTest(t, serveTest(t, rpcServer), clientConfig,
+		grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor(otelgrpc.WithTracerProvider(tp), otelgrpc.WithPropagators(tracePropagator()))),
+	)
+	// Asking about an unknown service fails without reaching Wireguard.
+	_, err = healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{Service: "unknown"})
+	if err == nil {
+		t.Fatal("expected an error for an unknown service")
+	}
+
+	clientSpan := findSpan(t, exporter, trace.SpanKindClient)
+	serverSpan := findSpan(t, exporter, trace.SpanKindServer)
+	if serverSpan.SpanContext.TraceID() != clientSpan.SpanContext.TraceID() {
+		t.Errorf("server span is in trace %s, want %s", serverSpan.SpanContext.TraceID(), clientSpan.SpanContext.TraceID())
+	}
+	if serverSpan.Parent.SpanID() != clientSpan.SpanContext.SpanID() {
+		t.Errorf("server span's parent is %s, want the client span %s", serverSpan.Parent.SpanID(), clientSpan.SpanContext.SpanID())
+	}
+}
+
+func TestTracedCredentialsRecordsErrors(t *testing.T) {
+	tp, exporter := newInMemoryTracerProvider()
+	creds := TracedCredentials(&failingCredentials{}, tp)
+
+	_, err := creds.GetRequestMetadata(context.Background())
+	if !errors.Is(err, errTokenUnavailable) {
+		t.Fatalf("got error %v, want %v", err, errTokenUnavailable)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+	if spans[0].Name != "wgrpcd.GetRequestMetadata" {
+		t.Errorf("got span %q, want wgrpcd.GetRequestMetadata", spans[0].Name)
+	}
+	if spans[0].Status.Code != codes.Error {
+		t.Errorf("got span status %v, want %v", spans[0].Status.Code, codes.Error)
+	}
+}
+
+var errTokenUnavailable = errors.New("token unavailable")
+
+// failingCredentials are per-RPC credentials whose token can never be fetched.
+type failingCredentials struct{}
+
+func (f *failingCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return nil, errTokenUnavailable
+}
+
+func (f *failingCredentials) RequireTransportSecurity() bool {
+	return true
+}
+
+// findSpan returns the only span of the given kind recorded by exporter.
+func findSpan(t *testing.T, exporter *tracetest.InMemoryExporter, kind trace.SpanKind) tracetest.SpanStub {
+	t.Helper()
+
+	var found []tracetest.SpanStub
+	for _, span := range exporter.GetSpans() {
+		if span.SpanKind == kind {
+			found = append(found, span)
+		}
+	}
+	if len(found) != 1 {
+		t.Fatalf("got %d %s spans, want 1", len(found), kind)
+	}
+	return found[0]
+}
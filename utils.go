@@ -2,7 +2,10 @@ package wgrpcd
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 )
 
 // IPNetsToStrings converts a list of net.IPNets to CIDR subnet strings.
@@ -49,3 +52,30 @@ func StringsToIPs(rawIPs []string) ([]net.IP, error) {
 	}
 	return ips, nil
 }
+
+// writeFileAtomic writes data to a temporary file next to filename and renames it into place.
+// Readers will see either the old or the new contents, never a partial write.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(tmp.Name(), perm)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
@@ -0,0 +1,215 @@
+package wgrpcd
+
+import (
+	"os"
+	"sort"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// watchPollInterval is how often WatchPeers reads the device to look for changes.
+	watchPollInterval = time.Second
+)
+
+// WatchPeers streams a snapshot of a device's peers, then an event each time a peer changes until the client goes away.
+// Counter updates for every peer are sent every counterInterval seconds, or never if it is zero.
+// Suspended peers are not on the device, so suspending a peer is reported as its removal.
+// The stream ends with Unavailable when the server shuts down, and clients should reconnect.
+func (s *Server) WatchPeers(request *WatchPeersRequest, stream WireguardRPC_WatchPeersServer) error {
+	ctx := stream.Context()
+	auth, err := s.authResult(ctx)
+	if err != nil {
+		return err
+	}
+
+	selector, err := ParseLabelSelector(request.GetLabelSelector())
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid label selector: %v", err)
+	}
+
+	if request.GetCounterInterval() < 0 {
+		return status.Errorf(codes.InvalidArgument, "counter interval must not be negative")
+	}
+	counterInterval := time.Duration(request.GetCounterInterval()) * time.Second
+
+	watcher := &peerWatcher{
+		wireguard: &Wireguard{DeviceName: request.GetDeviceName()},
+		peers:     s.peers,
+		selector:  selector,
+	}
+	current, err := watcher.poll()
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info("watching peers", logKeyClient, auth.ClientIdentifier, logKeyDevice, request.GetDeviceName())
+	defer s.logger.Info("stopped watching peers", logKeyClient, auth.ClientIdentifier, logKeyDevice, request.GetDeviceName())
+
+	now := time.Now()
+	events := []*PeerEvent{}
+	for _, key := range current.sortedKeys() {
+		events = append(events, current.event(PeerEvent_SNAPSHOT, key, now))
+	}
+	events = append(events, &PeerEvent{Type: PeerEvent_SYNCED, Time: now.Unix()})
+	err = sendPeerEvents(stream, events)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+	lastCounters := now
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-s.done:
+			return status.Errorf(codes.Unavailable, "server is shutting down")
+
+		case now := <-ticker.C:
+			previous := current
+			current, err = watcher.poll()
+			if err != nil {
+				return err
+			}
+
+			events := current.changesSince(previous, now)
+			if counterInterval > 0 && now.Sub(lastCounters) >= counterInterval {
+				lastCounters = now
+				for _, key := range current.sortedKeys() {
+					events = append(events, current.event(PeerEvent_COUNTERS, key, now))
+				}
+			}
+
+			err = sendPeerEvents(stream, events)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func sendPeerEvents(stream WireguardRPC_WatchPeersServer, events []*PeerEvent) error {
+	for _, event := range events {
+		err := stream.Send(event)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// peerWatcher reads the peers a WatchPeers stream is interested in.
+// It doesn't trace its calls to Wireguard, since a long-lived stream would otherwise produce a span every second.
+type peerWatcher struct {
+	wireguard *Wireguard
+	peers     PeerStore
+	selector  *LabelSelector
+}
+
+// poll returns the device's peers that match the selector.
+func (w *peerWatcher) poll() (peerSnapshot, error) {
+	devicePeers, err := w.wireguard.Peers()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "that wireguard device does not exist")
+		}
+		return nil, status.Errorf(codes.Internal, "error listing peers: %v", err)
+	}
+
+	records, err := w.peers.List(w.wireguard.DeviceName)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "error loading peer metadata: %v", err)
+	}
+	recordsByKey := map[string]*PeerRecord{}
+	for _, record := range records {
+		recordsByKey[record.PublicKey] = record
+	}
+
+	snapshot := peerSnapshot{}
+	for _, dp := range devicePeers {
+		key := dp.PublicKey.String()
+		record := recordsByKey[key]
+		var labels map[string]string
+		if record != nil {
+			labels = record.Labels
+		}
+		if !w.selector.Matches(labels) {
+			continue
+		}
+		snapshot[key] = &watchedPeer{
+			device: dp,
+			record: record,
+		}
+	}
+	return snapshot, nil
+}
+
+type watchedPeer struct {
+	device wgtypes.Peer
+	record *PeerRecord
+}
+
+// peerSnapshot is the state of a device's peers at one poll, by public key.
+type peerSnapshot map[string]*watchedPeer
+
+func (p peerSnapshot) sortedKeys() []string {
+	keys := make([]string, 0, len(p))
+	for key := range p {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (p peerSnapshot) event(eventType PeerEvent_Type, key string, now time.Time) *PeerEvent {
+	peer := p[key]
+	return &PeerEvent{
+		Type: eventType,
+		Peer: devicePeer(peer.device, peer.record),
+		Time: now.Unix(),
+	}
+}
+
+// changesSince returns the events that turn previous into p.
+func (p peerSnapshot) changesSince(previous peerSnapshot, now time.Time) []*PeerEvent {
+	events := []*PeerEvent{}
+	for _, key := range previous.sortedKeys() {
+		if _, ok := p[key]; !ok {
+			events = append(events, previous.event(PeerEvent_REMOVED, key, now))
+		}
+	}
+
+	for _, key := range p.sortedKeys() {
+		before, ok := previous[key]
+		if !ok {
+			events = append(events, p.event(PeerEvent_ADDED, key, now))
+			continue
+		}
+
+		after := p[key]
+		if !after.device.LastHandshakeTime.IsZero() && !after.device.LastHandshakeTime.Equal(before.device.LastHandshakeTime) {
+			if before.device.LastHandshakeTime.IsZero() {
+				events = append(events, p.event(PeerEvent_FIRST_HANDSHAKE, key, now))
+			} else {
+				events = append(events, p.event(PeerEvent_HANDSHAKE, key, now))
+			}
+		}
+		if endpointString(after.device) != endpointString(before.device) {
+			events = append(events, p.event(PeerEvent_ENDPOINT_CHANGED, key, now))
+		}
+	}
+	return events
+}
+
+func endpointString(peer wgtypes.Peer) string {
+	if peer.Endpoint == nil {
+		return ""
+	}
+	return peer.Endpoint.String()
+}
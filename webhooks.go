@@ -0,0 +1,732 @@
+package wgrpcd
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Webhook event types.
+// wgrpcd has no peer expiry, so there is no event for it.
+const (
+	// WebhookPeerCreated is sent when CreatePeer or Import adds a peer. Peers that Import replaces aren't sent again.
+	WebhookPeerCreated = "peer.created"
+
+	// WebhookPeerRekeyed is sent when RekeyPeer replaces a peer's key.
+	WebhookPeerRekeyed = "peer.rekeyed"
+
+	// WebhookPeerRemoved is sent when RemovePeer removes a peer.
+	WebhookPeerRemoved = "peer.removed"
+
+	// WebhookPeerFirstHandshake is sent the first time a peer created, imported or rekeyed by wgrpcd completes a handshake.
+	WebhookPeerFirstHandshake = "peer.first_handshake"
+)
+
+const (
+	// WebhookSignatureHeader carries the hex HMAC-SHA256 of the request body, keyed with the webhook's secret, as "sha256=<hex>".
+	WebhookSignatureHeader = "X-Wgrpcd-Signature"
+
+	// WebhookEventHeader carries the event type.
+	WebhookEventHeader = "X-Wgrpcd-Event"
+
+	// WebhookDeliveryHeader carries the event ID, which stays the same across retries so receivers can ignore duplicates.
+	WebhookDeliveryHeader = "X-Wgrpcd-Delivery"
+)
+
+var webhookEventTypes = map[string]bool{
+	WebhookPeerCreated:        true,
+	WebhookPeerRekeyed:        true,
+	WebhookPeerRemoved:        true,
+	WebhookPeerFirstHandshake: true,
+}
+
+// Webhook is an HTTP endpoint that is sent the events it subscribes to.
+// A Webhook with no Events is sent every event.
+type Webhook struct {
+	URL    string   `json:"url" yaml:"url"`
+	Secret string   `json:"secret" yaml:"secret"`
+	Events []string `json:"events,omitempty" yaml:"events"`
+}
+
+// Validate checks that the webhook has an http or https URL, a secret, and only events wgrpcd sends.
+func (w *Webhook) Validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return fmt.Errorf("invalid webhook url %q: %w", w.URL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("webhook url %q must be an absolute http or https url", w.URL)
+	}
+	if w.Secret == "" {
+		return fmt.Errorf("webhook %s has no secret", w.URL)
+	}
+	for _, event := range w.Events {
+		if !webhookEventTypes[event] {
+			return fmt.Errorf("webhook %s subscribes to unknown event %q", w.URL, event)
+		}
+	}
+	return nil
+}
+
+func (w *Webhook) wants(eventType string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, event := range w.Events {
+		if event == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookEvent is the JSON body sent to webhooks.
+type WebhookEvent struct {
+	ID               string            `json:"id"`
+	Type             string            `json:"type"`
+	Time             time.Time         `json:"time"`
+	ClientIdentifier string            `json:"clientIdentifier,omitempty"`
+	DeviceName       string            `json:"deviceName"`
+	PublicKey        string            `json:"publicKey"`
+	OldPublicKey     string            `json:"oldPublicKey,omitempty"`
+	Name             string            `json:"name,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+}
+
+// SignWebhook returns the value of the WebhookSignatureHeader for body.
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook returns true if signature is the WebhookSignatureHeader wgrpcd would send with body.
+// Receivers should use it rather than comparing signatures themselves so the comparison takes constant time.
+func VerifyWebhook(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(SignWebhook(secret, body)), []byte(signature))
+}
+
+// WebhookDispatcherConfig configures a WebhookDispatcher.
+// Zero values are replaced with the defaults below.
+type WebhookDispatcherConfig struct {
+	Webhooks []*Webhook
+
+	// OutboxFilename is where undelivered events are kept so they survive a restart.
+	// Events are only kept in memory if it is empty.
+	OutboxFilename string
+
+	HTTPClient *http.Client
+	Logger     Logger
+
+	// MaxAttempts is how many times an event is sent to a webhook before it is dropped. The default is 10.
+	MaxAttempts int
+
+	// MinBackoff is the wait before the first retry, doubling after every failure up to MaxBackoff.
+	// The defaults are 1 second and 10 minutes.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// HandshakeInterval is how often peers waiting for their first handshake are checked. The default is 10 seconds.
+	HandshakeInterval time.Duration
+}
+
+// WebhookDispatcher sends signed events to webhooks, retrying failed deliveries with exponential backoff.
+// Events are written to the outbox before Notify returns and removed once delivered, so they are not lost if wgrpcd restarts.
+// The dispatcher only delivers events and checks for first handshakes while Run is running.
+type WebhookDispatcher struct {
+	mutex             sync.RWMutex
+	webhooks          map[string]*Webhook
+	client            *http.Client
+	logger            Logger
+	maxAttempts       int
+	minBackoff        time.Duration
+	maxBackoff        time.Duration
+	handshakeInterval time.Duration
+	outbox            *webhookOutbox
+	wake              chan struct{}
+}
+
+// NewWebhookDispatcher validates the webhooks and loads the outbox.
+func NewWebhookDispatcher(config *WebhookDispatcherConfig) (*WebhookDispatcher, error) {
+	d := &WebhookDispatcher{
+		client:            config.HTTPClient,
+		logger:            config.Logger,
+		maxAttempts:       config.MaxAttempts,
+		minBackoff:        config.MinBackoff,
+		maxBackoff:        config.MaxBackoff,
+		handshakeInterval: config.HandshakeInterval,
+		wake:              make(chan struct{}, 1),
+	}
+	if d.client == nil {
+		d.client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if d.logger == nil {
+		d.logger = slog.Default()
+	}
+	if d.maxAttempts <= 0 {
+		d.maxAttempts = 10
+	}
+	if d.minBackoff <= 0 {
+		d.minBackoff = time.Second
+	}
+	if d.maxBackoff <= 0 {
+		d.maxBackoff = 10 * time.Minute
+	}
+	if d.handshakeInterval <= 0 {
+		d.handshakeInterval = 10 * time.Second
+	}
+
+	webhooks, err := webhooksByURL(config.Webhooks)
+	if err != nil {
+		return nil, err
+	}
+	d.webhooks = webhooks
+
+	outbox, err := newWebhookOutbox(config.OutboxFilename)
+	if err != nil {
+		return nil, err
+	}
+	d.outbox = outbox
+	return d, nil
+}
+
+// SetWebhooks replaces the webhooks events are sent to, so they can be changed without restarting wgrpcd.
+// Queued events for webhooks that are no longer configured are dropped.
+func (d *WebhookDispatcher) SetWebhooks(webhooks []*Webhook) error {
+	byURL, err := webhooksByURL(webhooks)
+	if err != nil {
+		return err
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.webhooks = byURL
+	return nil
+}
+
+// webhook returns the webhook configured for webhookURL, if there is one.
+func (d *WebhookDispatcher) webhook(webhookURL string) (*Webhook, bool) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	webhook, ok := d.webhooks[webhookURL]
+	return webhook, ok
+}
+
+// webhooksByURL validates webhooks and returns copies of them keyed by URL.
+func webhooksByURL(webhooks []*Webhook) (map[string]*Webhook, error) {
+	byURL := map[string]*Webhook{}
+	for _, webhook := range webhooks {
+		err := webhook.Validate()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := byURL[webhook.URL]; ok {
+			return nil, fmt.Errorf("webhook %s is configured more than once", webhook.URL)
+		}
+		w := *webhook
+		byURL[webhook.URL] = &w
+	}
+	return byURL, nil
+}
+
+// LoadWebhooks reads a JSON array of Webhooks from filename.
+func LoadWebhooks(filename string) ([]*Webhook, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks := []*Webhook{}
+	err = json.Unmarshal(contents, &webhooks)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhooks file %s: %w", filename, err)
+	}
+	return webhooks, nil
+}
+
+// Notify queues an event for every webhook subscribed to it.
+// It fills in the event's ID and Time if they are empty.
+func (d *WebhookDispatcher) Notify(event *WebhookEvent) error {
+	if event.ID == "" {
+		id, err := newWebhookEventID()
+		if err != nil {
+			return err
+		}
+		event.ID = id
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	deliveries := []*webhookDelivery{}
+	d.mutex.RLock()
+	for _, webhook := range d.webhooks {
+		if !webhook.wants(event.Type) {
+			continue
+		}
+		deliveries = append(deliveries, &webhookDelivery{
+			EventID:     event.ID,
+			EventType:   event.Type,
+			URL:         webhook.URL,
+			Body:        string(body),
+			NextAttempt: event.Time,
+		})
+	}
+	d.mutex.RUnlock()
+
+	// Only peers created, imported or rekeyed while wgrpcd is watching can have a first handshake.
+	var awaiting *awaitingHandshake
+	var done []string
+	switch event.Type {
+	case WebhookPeerCreated, WebhookPeerRekeyed:
+		awaiting = &awaitingHandshake{
+			DeviceName: event.DeviceName,
+			PublicKey:  event.PublicKey,
+			Name:       event.Name,
+			Labels:     event.Labels,
+		}
+		if event.OldPublicKey != "" {
+			done = append(done, event.OldPublicKey)
+		}
+	case WebhookPeerRemoved:
+		done = append(done, event.PublicKey)
+	}
+
+	err = d.outbox.add(deliveries, awaiting, event.DeviceName, done)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run delivers queued events and watches for first handshakes until ctx is cancelled.
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+	handshakes := time.NewTicker(d.handshakeInterval)
+	defer handshakes.Stop()
+
+	for {
+		d.deliverDue(ctx, time.Now())
+
+		wait := d.maxBackoff
+		next, ok := d.outbox.nextAttempt()
+		if ok {
+			wait = time.Until(next)
+		}
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-d.wake:
+		case <-timer.C:
+		case <-handshakes.C:
+			d.checkHandshakes()
+		}
+		timer.Stop()
+	}
+}
+
+// deliverDue sends every delivery whose next attempt is due, oldest first.
+func (d *WebhookDispatcher) deliverDue(ctx context.Context, now time.Time) {
+	for _, delivery := range d.outbox.due(now) {
+		if ctx.Err() != nil {
+			return
+		}
+
+		webhook, ok := d.webhook(delivery.URL)
+		if !ok {
+			d.logger.Warn("dropping webhook event for an endpoint that is no longer configured", "url", delivery.URL, "event_id", delivery.EventID)
+			d.finish(delivery)
+			continue
+		}
+
+		err := d.send(ctx, webhook, delivery)
+		if ctx.Err() != nil {
+			// Shutting down isn't the webhook's fault, so the attempt doesn't count.
+			return
+		}
+		if err == nil {
+			d.logger.Debug("delivered webhook event", "url", delivery.URL, "event", delivery.EventType, "event_id", delivery.EventID)
+			d.finish(delivery)
+			continue
+		}
+
+		delivery.Attempts++
+		delivery.LastError = err.Error()
+		if delivery.Attempts >= d.maxAttempts {
+			d.logger.Error("giving up on webhook event", "url", delivery.URL, "event", delivery.EventType, "event_id", delivery.EventID, "attempts", delivery.Attempts, logKeyError, err)
+			d.finish(delivery)
+			continue
+		}
+
+		delivery.NextAttempt = time.Now().Add(d.backoff(delivery.Attempts))
+		d.logger.Warn("webhook delivery failed", "url", delivery.URL, "event", delivery.EventType, "event_id", delivery.EventID, "attempts", delivery.Attempts, "next_attempt", delivery.NextAttempt, logKeyError, err)
+		saveErr := d.outbox.update(delivery)
+		if saveErr != nil {
+			d.logger.Error("failed to save webhook outbox", logKeyError, saveErr)
+		}
+	}
+}
+
+func (d *WebhookDispatcher) finish(delivery *webhookDelivery) {
+	err := d.outbox.remove(delivery)
+	if err != nil {
+		d.logger.Error("failed to save webhook outbox", logKeyError, err)
+	}
+}
+
+// backoff returns how long to wait after a delivery has failed attempts times.
+func (d *WebhookDispatcher) backoff(attempts int) time.Duration {
+	backoff := d.minBackoff
+	for i := 1; i < attempts && backoff < d.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > d.maxBackoff {
+		backoff = d.maxBackoff
+	}
+	return backoff
+}
+
+// send posts a delivery's body to its webhook. Any response other than 2xx is a failure.
+func (d *WebhookDispatcher) send(ctx context.Context, webhook *Webhook, delivery *webhookDelivery) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, strings.NewReader(delivery.Body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "wgrpcd")
+	request.Header.Set(WebhookEventHeader, delivery.EventType)
+	request.Header.Set(WebhookDeliveryHeader, delivery.EventID)
+	request.Header.Set(WebhookSignatureHeader, SignWebhook(webhook.Secret, []byte(delivery.Body)))
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, 64*1024))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", response.Status)
+	}
+	return nil
+}
+
+// checkHandshakes sends WebhookPeerFirstHandshake for peers that have completed a handshake since the last check.
+func (d *WebhookDispatcher) checkHandshakes() {
+	for _, awaiting := range d.outbox.awaiting() {
+		publicKey, err := wgtypes.ParseKey(awaiting.PublicKey)
+		if err != nil {
+			d.outbox.handshakeDone(awaiting.DeviceName, awaiting.PublicKey)
+			continue
+		}
+
+		// Peers that are missing, or on a device that is missing, might be resumed or recreated later, so they are kept.
+		wireguard := &Wireguard{DeviceName: awaiting.DeviceName}
+		peer, err := wireguard.Peer(publicKey)
+		if err != nil || peer.LastHandshakeTime.IsZero() {
+			continue
+		}
+
+		event := &WebhookEvent{
+			Type:       WebhookPeerFirstHandshake,
+			Time:       peer.LastHandshakeTime.UTC(),
+			DeviceName: awaiting.DeviceName,
+			PublicKey:  awaiting.PublicKey,
+			Name:       awaiting.Name,
+			Labels:     awaiting.Labels,
+		}
+		err = d.Notify(event)
+		if err != nil {
+			d.logger.Error("failed to queue webhook event", "event", event.Type, logKeyDevice, event.DeviceName, logKeyPublicKey, event.PublicKey, logKeyError, err)
+			continue
+		}
+		err = d.outbox.handshakeDone(awaiting.DeviceName, awaiting.PublicKey)
+		if err != nil {
+			d.logger.Error("failed to save webhook outbox", logKeyError, err)
+		}
+	}
+}
+
+func newWebhookEventID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// webhookDelivery is one event waiting to be sent to one webhook.
+type webhookDelivery struct {
+	EventID     string    `json:"eventID"`
+	EventType   string    `json:"eventType"`
+	URL         string    `json:"url"`
+	Body        string    `json:"body"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+func (w *webhookDelivery) key() string {
+	return w.EventID + " " + w.URL
+}
+
+// awaitingHandshake is a peer whose first handshake hasn't been seen yet.
+type awaitingHandshake struct {
+	DeviceName string            `json:"deviceName"`
+	PublicKey  string            `json:"publicKey"`
+	Name       string            `json:"name,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+// webhookOutbox keeps undelivered events, and the peers waiting for a first handshake, in memory and writes them to a JSON file after every change.
+type webhookOutbox struct {
+	filename   string
+	mutex      sync.Mutex
+	deliveries map[string]*webhookDelivery
+	handshakes map[string]*awaitingHandshake
+}
+
+// webhookOutboxContents is the on-disk format of a webhookOutbox.
+type webhookOutboxContents struct {
+	Deliveries             []*webhookDelivery   `json:"deliveries"`
+	AwaitingFirstHandshake []*awaitingHandshake `json:"awaitingFirstHandshake"`
+}
+
+func newWebhookOutbox(filename string) (*webhookOutbox, error) {
+	outbox := &webhookOutbox{
+		filename:   filename,
+		deliveries: map[string]*webhookDelivery{},
+		handshakes: map[string]*awaitingHandshake{},
+	}
+	if filename == "" {
+		return outbox, nil
+	}
+
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return outbox, nil
+		}
+		return nil, err
+	}
+
+	var decoded webhookOutboxContents
+	err = json.Unmarshal(contents, &decoded)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, delivery := range decoded.Deliveries {
+		outbox.deliveries[delivery.key()] = delivery
+	}
+	for _, awaiting := range decoded.AwaitingFirstHandshake {
+		outbox.handshakes[peerRecordKey(awaiting.DeviceName, awaiting.PublicKey)] = awaiting
+	}
+	return outbox, nil
+}
+
+// add queues deliveries, starts waiting for a peer's first handshake and stops waiting for the keys in done, in a single write.
+// The outbox is left unchanged if it can't be saved.
+func (w *webhookOutbox) add(deliveries []*webhookDelivery, awaiting *awaitingHandshake, deviceName string, done []string) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	previousDeliveries := map[string]*webhookDelivery{}
+	for _, delivery := range deliveries {
+		key := delivery.key()
+		previousDeliveries[key] = w.deliveries[key]
+		w.deliveries[key] = delivery
+	}
+	previousHandshakes := map[string]*awaitingHandshake{}
+	if awaiting != nil {
+		key := peerRecordKey(awaiting.DeviceName, awaiting.PublicKey)
+		previousHandshakes[key] = w.handshakes[key]
+		w.handshakes[key] = awaiting
+	}
+	for _, publicKey := range done {
+		key := peerRecordKey(deviceName, publicKey)
+		if _, ok := previousHandshakes[key]; !ok {
+			previousHandshakes[key] = w.handshakes[key]
+		}
+		delete(w.handshakes, key)
+	}
+
+	err := w.save()
+	if err != nil {
+		for key, delivery := range previousDeliveries {
+			restoreEntry(w.deliveries, key, delivery)
+		}
+		for key, awaiting := range previousHandshakes {
+			restoreEntry(w.handshakes, key, awaiting)
+		}
+		return err
+	}
+	return nil
+}
+
+// restoreEntry puts back an entry that was replaced or deleted, removing the key if previous is nil because it didn't exist.
+func restoreEntry[V any](entries map[string]*V, key string, previous *V) {
+	if previous == nil {
+		delete(entries, key)
+		return
+	}
+	entries[key] = previous
+}
+
+// due returns copies of the deliveries whose next attempt is no later than now, oldest first.
+func (w *webhookOutbox) due(now time.Time) []*webhookDelivery {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	due := []*webhookDelivery{}
+	for _, delivery := range w.sortedDeliveries() {
+		if !delivery.NextAttempt.After(now) {
+			due = append(due, delivery)
+		}
+	}
+	return due
+}
+
+// nextAttempt returns the time of the earliest delivery, if there are any.
+func (w *webhookOutbox) nextAttempt() (time.Time, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	deliveries := w.sortedDeliveries()
+	if len(deliveries) == 0 {
+		return time.Time{}, false
+	}
+	return deliveries[0].NextAttempt, true
+}
+
+func (w *webhookOutbox) update(delivery *webhookDelivery) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	key := delivery.key()
+	previous := w.deliveries[key]
+	d := *delivery
+	w.deliveries[key] = &d
+	err := w.save()
+	if err != nil {
+		restoreEntry(w.deliveries, key, previous)
+		return err
+	}
+	return nil
+}
+
+func (w *webhookOutbox) remove(delivery *webhookDelivery) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	key := delivery.key()
+	previous := w.deliveries[key]
+	delete(w.deliveries, key)
+	err := w.save()
+	if err != nil {
+		restoreEntry(w.deliveries, key, previous)
+		return err
+	}
+	return nil
+}
+
+func (w *webhookOutbox) awaiting() []*awaitingHandshake {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.sortedHandshakes()
+}
+
+func (w *webhookOutbox) handshakeDone(deviceName, publicKey string) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	key := peerRecordKey(deviceName, publicKey)
+	previous := w.handshakes[key]
+	delete(w.handshakes, key)
+	err := w.save()
+	if err != nil {
+		restoreEntry(w.handshakes, key, previous)
+		return err
+	}
+	return nil
+}
+
+// sortedDeliveries returns copies of all deliveries ordered by their next attempt.
+// Callers must hold w.mutex.
+func (w *webhookOutbox) sortedDeliveries() []*webhookDelivery {
+	deliveries := []*webhookDelivery{}
+	for _, delivery := range w.deliveries {
+		d := *delivery
+		deliveries = append(deliveries, &d)
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		if !deliveries[i].NextAttempt.Equal(deliveries[j].NextAttempt) {
+			return deliveries[i].NextAttempt.Before(deliveries[j].NextAttempt)
+		}
+		return deliveries[i].key() < deliveries[j].key()
+	})
+	return deliveries
+}
+
+// sortedHandshakes returns copies of the peers waiting for a first handshake ordered by device and public key.
+// Callers must hold w.mutex.
+func (w *webhookOutbox) sortedHandshakes() []*awaitingHandshake {
+	handshakes := []*awaitingHandshake{}
+	for _, awaiting := range w.handshakes {
+		a := *awaiting
+		handshakes = append(handshakes, &a)
+	}
+	sort.Slice(handshakes, func(i, j int) bool {
+		return peerRecordKey(handshakes[i].DeviceName, handshakes[i].PublicKey) < peerRecordKey(handshakes[j].DeviceName, handshakes[j].PublicKey)
+	})
+	return handshakes
+}
+
+// save writes the outbox to disk.
+// Callers must hold w.mutex.
+func (w *webhookOutbox) save() error {
+	if w.filename == "" {
+		return nil
+	}
+
+	contents := webhookOutboxContents{
+		Deliveries:             w.sortedDeliveries(),
+		AwaitingFirstHandshake: w.sortedHandshakes(),
+	}
+	b, err := json.MarshalIndent(contents, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(w.filename, b, 0600)
+}
@@ -0,0 +1,346 @@
+package wgrpcd
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestVerifyWebhook(t *testing.T) {
+	body := []byte(`{"type":"peer.created"}`)
+	signature := SignWebhook("secret", body)
+
+	if !VerifyWebhook("secret", body, signature) {
+		t.Error("signature of the body was not verified")
+	}
+	if VerifyWebhook("other secret", body, signature) {
+		t.Error("signature verified with the wrong secret")
+	}
+	if VerifyWebhook("secret", []byte(`{"type":"peer.removed"}`), signature) {
+		t.Error("signature verified for a different body")
+	}
+	if VerifyWebhook("secret", body, signature[len("sha256="):]) {
+		t.Error("signature verified without its sha256= prefix")
+	}
+}
+
+// webhookReceiver is a webhook endpoint that fails the first failures requests and records every request it gets.
+type webhookReceiver struct {
+	t        *testing.T
+	secret   string
+	failures int
+
+	mutex     sync.Mutex
+	requests  []*http.Request
+	events    []*WebhookEvent
+	delivered chan struct{}
+}
+
+func newWebhookReceiver(t *testing.T, secret string, failures int) (*webhookReceiver, *httptest.Server) {
+	receiver := &webhookReceiver{
+		t:         t,
+		secret:    secret,
+		failures:  failures,
+		delivered: make(chan struct{}, 1),
+	}
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+	return receiver, server
+}
+
+func (w *webhookReceiver) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.t.Errorf("failed to read webhook body: %v", err)
+		return
+	}
+	if !VerifyWebhook(w.secret, body, r.Header.Get(WebhookSignatureHeader)) {
+		w.t.Errorf("webhook signature %q does not match its body", r.Header.Get(WebhookSignatureHeader))
+	}
+	var event WebhookEvent
+	err = json.Unmarshal(body, &event)
+	if err != nil {
+		w.t.Errorf("invalid webhook body: %v", err)
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.requests = append(w.requests, r)
+	w.events = append(w.events, &event)
+	if len(w.requests) <= w.failures {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	select {
+	case w.delivered <- struct{}{}:
+	default:
+	}
+}
+
+func (w *webhookReceiver) received() ([]*http.Request, []*WebhookEvent) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.requests, w.events
+}
+
+func newTestWebhookDispatcher(t *testing.T, config *WebhookDispatcherConfig) *WebhookDispatcher {
+	t.Helper()
+
+	config.Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	config.MinBackoff = 10 * time.Millisecond
+	config.MaxBackoff = 40 * time.Millisecond
+	dispatcher, err := NewWebhookDispatcher(config)
+	if err != nil {
+		t.Fatalf("NewWebhookDispatcher: %v", err)
+	}
+	return dispatcher
+}
+
+// runDispatcher runs dispatcher until the test ends.
+func runDispatcher(t *testing.T, dispatcher *WebhookDispatcher) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		dispatcher.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func waitForDelivery(t *testing.T, receiver *webhookReceiver) {
+	t.Helper()
+
+	select {
+	case <-receiver.delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook event was not delivered")
+	}
+}
+
+// waitForEmptyOutbox waits for the dispatcher to finish with every queued event, by delivering or dropping it.
+func waitForEmptyOutbox(t *testing.T, dispatcher *WebhookDispatcher) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := dispatcher.outbox.nextAttempt(); !ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("events are still in the outbox")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebhookDispatcherRetriesFailedDeliveries(t *testing.T) {
+	receiver, server := newWebhookReceiver(t, "secret", 2)
+	dispatcher := newTestWebhookDispatcher(t, &WebhookDispatcherConfig{
+		Webhooks: []*Webhook{{URL: server.URL, Secret: "secret"}},
+	})
+	runDispatcher(t, dispatcher)
+
+	event := &WebhookEvent{
+		Type:       WebhookPeerRemoved,
+		DeviceName: "wg0",
+		PublicKey:  "key",
+	}
+	err := dispatcher.Notify(event)
+	if err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	waitForDelivery(t, receiver)
+
+	requests, events := receiver.received()
+	if len(requests) != 3 {
+		t.Fatalf("got %d requests, want 2 failures and a success", len(requests))
+	}
+	for i, request := range requests {
+		if request.Header.Get(WebhookDeliveryHeader) != event.ID {
+			t.Errorf("request %d has delivery ID %q, want %q", i, request.Header.Get(WebhookDeliveryHeader), event.ID)
+		}
+		if request.Header.Get(WebhookEventHeader) != WebhookPeerRemoved {
+			t.Errorf("request %d has event type %q, want %q", i, request.Header.Get(WebhookEventHeader), WebhookPeerRemoved)
+		}
+		if events[i].PublicKey != "key" || events[i].DeviceName != "wg0" {
+			t.Errorf("request %d has event %+v", i, events[i])
+		}
+	}
+	waitForEmptyOutbox(t, dispatcher)
+}
+
+func TestWebhookDispatcherGivesUpAfterMaxAttempts(t *testing.T) {
+	receiver, server := newWebhookReceiver(t, "secret", 100)
+	dispatcher := newTestWebhookDispatcher(t, &WebhookDispatcherConfig{
+		Webhooks:    []*Webhook{{URL: server.URL, Secret: "secret"}},
+		MaxAttempts: 3,
+	})
+	runDispatcher(t, dispatcher)
+
+	err := dispatcher.Notify(&WebhookEvent{Type: WebhookPeerRemoved, DeviceName: "wg0", PublicKey: "key"})
+	if err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+
+	waitForEmptyOutbox(t, dispatcher)
+
+	requests, _ := receiver.received()
+	if len(requests) != 3 {
+		t.Errorf("got %d requests, want 3", len(requests))
+	}
+}
+
+func TestWebhookDispatcherDeliversEventsFromOutbox(t *testing.T) {
+	receiver, server := newWebhookReceiver(t, "secret", 0)
+	config := &WebhookDispatcherConfig{
+		Webhooks:       []*Webhook{{URL: server.URL, Secret: "secret"}},
+		OutboxFilename: filepath.Join(t.TempDir(), "outbox.json"),
+	}
+
+	// The first dispatcher never runs, as if wgrpcd stopped before delivering the event.
+	err := newTestWebhookDispatcher(t, config).Notify(&WebhookEvent{Type: WebhookPeerRemoved, DeviceName: "wg0", PublicKey: "key"})
+	if err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+
+	runDispatcher(t, newTestWebhookDispatcher(t, config))
+	waitForDelivery(t, receiver)
+
+	_, events := receiver.received()
+	if len(events) != 1 || events[0].PublicKey != "key" {
+		t.Errorf("got events %+v, want the queued event", events)
+	}
+}
+
+func TestWebhookDispatcherOnlySendsSubscribedEvents(t *testing.T) {
+	receiver, server := newWebhookReceiver(t, "secret", 0)
+	dispatcher := newTestWebhookDispatcher(t, &WebhookDispatcherConfig{
+		Webhooks: []*Webhook{{URL: server.URL, Secret: "secret", Events: []string{WebhookPeerRemoved}}},
+	})
+	runDispatcher(t, dispatcher)
+
+	for _, eventType := range []string{WebhookPeerRekeyed, WebhookPeerRemoved} {
+		err := dispatcher.Notify(&WebhookEvent{Type: eventType, DeviceName: "wg0", PublicKey: eventType})
+		if err != nil {
+			t.Fatalf("Notify: %v", err)
+		}
+	}
+	waitForDelivery(t, receiver)
+
+	_, events := receiver.received()
+	if len(events) != 1 || events[0].Type != WebhookPeerRemoved {
+		t.Errorf("got events %+v, want only %s", events, WebhookPeerRemoved)
+	}
+}
+
+func TestImportNotifiesOnlyForNewPeers(t *testing.T) {
+	fake := useFakeWireguard(t, "wg0")
+	// The dispatcher isn't run, so the events stay in its outbox.
+	dispatcher := newTestWebhookDispatcher(t, &WebhookDispatcherConfig{
+		Webhooks: []*Webhook{{URL: "http://127.0.0.1:1/", Secret: "secret"}},
+	})
+	client := newTestClient(t, &ServerConfig{Webhooks: dispatcher}, PermissionImport)
+
+	imported := testPublicKey(t)
+	_, err := client.Import(context.Background(), &ImportRequest{
+		DeviceName: "wg0",
+		Peers:      []*ImportedPeer{{PublicKey: imported.String(), AllowedIPs: []string{"10.0.0.2/32"}}},
+	})
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	if deliveries := dispatcher.outbox.due(time.Now()); len(deliveries) != 1 || deliveries[0].EventType != WebhookPeerCreated {
+		t.Fatalf("got deliveries %+v, want one %s", deliveries, WebhookPeerCreated)
+	}
+
+	// The peer connects and its events are delivered.
+	fake.handshake("wg0", imported, time.Now().Add(-time.Hour))
+	dispatcher.checkHandshakes()
+	for _, delivery := range dispatcher.outbox.due(time.Now()) {
+		dispatcher.finish(delivery)
+	}
+
+	// A peer added to the device without wgrpcd has no record, but isn't new either.
+	unmanaged := testPublicKey(t)
+	err = fake.ConfigureDevice("wg0", wgtypes.Config{Peers: []wgtypes.PeerConfig{{PublicKey: unmanaged}}})
+	if err != nil {
+		t.Fatalf("failed to add peer: %v", err)
+	}
+
+	added := testPublicKey(t)
+	_, err = client.Import(context.Background(), &ImportRequest{
+		DeviceName: "wg0",
+		Peers: []*ImportedPeer{
+			{PublicKey: imported.String(), AllowedIPs: []string{"10.0.0.2/32"}},
+			{PublicKey: unmanaged.String(), AllowedIPs: []string{"10.0.0.3/32"}},
+			{PublicKey: added.String(), AllowedIPs: []string{"10.0.0.4/32"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+
+	deliveries := dispatcher.outbox.due(time.Now())
+	if len(deliveries) != 1 {
+		t.Fatalf("got %d deliveries, want one for the new peer", len(deliveries))
+	}
+	var event WebhookEvent
+	err = json.Unmarshal([]byte(deliveries[0].Body), &event)
+	if err != nil {
+		t.Fatalf("invalid event: %v", err)
+	}
+	if event.Type != WebhookPeerCreated || event.PublicKey != added.String() {
+		t.Errorf("got %s for %s, want %s for %s", event.Type, event.PublicKey, WebhookPeerCreated, added.String())
+	}
+
+	awaiting := dispatcher.outbox.awaiting()
+	if len(awaiting) != 1 || awaiting[0].PublicKey != added.String() {
+		t.Errorf("got peers awaiting a first handshake %+v, want only the new peer", awaiting)
+	}
+}
+
+func TestWebhookOutboxUnchangedWhenSaveFails(t *testing.T) {
+	dispatcher := newTestWebhookDispatcher(t, &WebhookDispatcherConfig{
+		Webhooks:       []*Webhook{{URL: "http://127.0.0.1:1/", Secret: "secret"}},
+		OutboxFilename: filepath.Join(t.TempDir(), "outbox.json"),
+	})
+	err := dispatcher.Notify(&WebhookEvent{Type: WebhookPeerCreated, DeviceName: "wg0", PublicKey: "created"})
+	if err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+
+	dispatcher.outbox.filename = filepath.Join(t.TempDir(), "missing", "outbox.json")
+	err = dispatcher.Notify(&WebhookEvent{Type: WebhookPeerRekeyed, DeviceName: "wg0", PublicKey: "rekeyed", OldPublicKey: "created"})
+	if err == nil {
+		t.Fatal("Notify succeeded without saving the outbox")
+	}
+
+	deliveries := dispatcher.outbox.due(time.Now())
+	if len(deliveries) != 1 || deliveries[0].EventType != WebhookPeerCreated {
+		t.Errorf("got deliveries %+v, want only the %s event", deliveries, WebhookPeerCreated)
+	}
+	awaiting := dispatcher.outbox.awaiting()
+	if len(awaiting) != 1 || awaiting[0].PublicKey != "created" {
+		t.Errorf("got peers awaiting a first handshake %+v, want only the created peer", awaiting)
+	}
+
+	err = dispatcher.outbox.remove(deliveries[0])
+	if err == nil {
+		t.Fatal("remove succeeded without saving the outbox")
+	}
+	if _, ok := dispatcher.outbox.nextAttempt(); !ok {
+		t.Error("delivery was removed from memory even though the outbox wasn't saved")
+	}
+}
@@ -24,6 +24,12 @@ type WireguardRPCClient interface {
 	ListPeers(ctx context.Context, in *ListPeersRequest, opts ...grpc.CallOption) (*ListPeersResponse, error)
 	Devices(ctx context.Context, in *DevicesRequest, opts ...grpc.CallOption) (*DevicesResponse, error)
 	Import(ctx context.Context, in *ImportRequest, opts ...grpc.CallOption) (*ImportResponse, error)
+	SuspendPeer(ctx context.Context, in *SuspendPeerRequest, opts ...grpc.CallOption) (*SuspendPeerResponse, error)
+	ResumePeer(ctx context.Context, in *ResumePeerRequest, opts ...grpc.CallOption) (*ResumePeerResponse, error)
+	ListRevokedKeys(ctx context.Context, in *ListRevokedKeysRequest, opts ...grpc.CallOption) (*ListRevokedKeysResponse, error)
+	LiftRevocation(ctx context.Context, in *LiftRevocationRequest, opts ...grpc.CallOption) (*LiftRevocationResponse, error)
+	QueryAudit(ctx context.Context, in *QueryAuditRequest, opts ...grpc.CallOption) (*QueryAuditResponse, error)
+	WatchPeers(ctx context.Context, in *WatchPeersRequest, opts ...grpc.CallOption) (WireguardRPC_WatchPeersClient, error)
 }
 
 type wireguardRPCClient struct {
@@ -97,6 +103,83 @@ func (c *wireguardRPCClient) Import(ctx context.Context, in *ImportRequest, opts
 	return out, nil
 }
 
+func (c *wireguardRPCClient) SuspendPeer(ctx context.Context, in *SuspendPeerRequest, opts ...grpc.CallOption) (*SuspendPeerResponse, error) {
+	out := new(SuspendPeerResponse)
+	err := c.cc.Invoke(ctx, "/wgrpcd.WireguardRPC/SuspendPeer", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *wireguardRPCClient) ResumePeer(ctx context.Context, in *ResumePeerRequest, opts ...grpc.CallOption) (*ResumePeerResponse, error) {
+	out := new(ResumePeerResponse)
+	err := c.cc.Invoke(ctx, "/wgrpcd.WireguardRPC/ResumePeer", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *wireguardRPCClient) ListRevokedKeys(ctx context.Context, in *ListRevokedKeysRequest, opts ...grpc.CallOption) (*ListRevokedKeysResponse, error) {
+	out := new(ListRevokedKeysResponse)
+	err := c.cc.Invoke(ctx, "/wgrpcd.WireguardRPC/ListRevokedKeys", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *wireguardRPCClient) LiftRevocation(ctx context.Context, in *LiftRevocationRequest, opts ...grpc.CallOption) (*LiftRevocationResponse, error) {
+	out := new(LiftRevocationResponse)
+	err := c.cc.Invoke(ctx, "/wgrpcd.WireguardRPC/LiftRevocation", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *wireguardRPCClient) QueryAudit(ctx context.Context, in *QueryAuditRequest, opts ...grpc.CallOption) (*QueryAuditResponse, error) {
+	out := new(QueryAuditResponse)
+	err := c.cc.Invoke(ctx, "/wgrpcd.WireguardRPC/QueryAudit", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *wireguardRPCClient) WatchPeers(ctx context.Context, in *WatchPeersRequest, opts ...grpc.CallOption) (WireguardRPC_WatchPeersClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_WireguardRPC_serviceDesc.Streams[0], "/wgrpcd.WireguardRPC/WatchPeers", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &wireguardRPCWatchPeersClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type WireguardRPC_WatchPeersClient interface {
+	Recv() (*PeerEvent, error)
+	grpc.ClientStream
+}
+
+type wireguardRPCWatchPeersClient struct {
+	grpc.ClientStream
+}
+
+func (x *wireguardRPCWatchPeersClient) Recv() (*PeerEvent, error) {
+	m := new(PeerEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // WireguardRPCServer is the server API for WireguardRPC service.
 // All implementations must embed UnimplementedWireguardRPCServer
 // for forward compatibility
@@ -108,6 +191,12 @@ type WireguardRPCServer interface {
 	ListPeers(context.Context, *ListPeersRequest) (*ListPeersResponse, error)
 	Devices(context.Context, *DevicesRequest) (*DevicesResponse, error)
 	Import(context.Context, *ImportRequest) (*ImportResponse, error)
+	SuspendPeer(context.Context, *SuspendPeerRequest) (*SuspendPeerResponse, error)
+	ResumePeer(context.Context, *ResumePeerRequest) (*ResumePeerResponse, error)
+	ListRevokedKeys(context.Context, *ListRevokedKeysRequest) (*ListRevokedKeysResponse, error)
+	LiftRevocation(context.Context, *LiftRevocationRequest) (*LiftRevocationResponse, error)
+	QueryAudit(context.Context, *QueryAuditRequest) (*QueryAuditResponse, error)
+	WatchPeers(*WatchPeersRequest, WireguardRPC_WatchPeersServer) error
 	mustEmbedUnimplementedWireguardRPCServer()
 }
 
@@ -136,6 +225,24 @@ func (UnimplementedWireguardRPCServer) Devices(context.Context, *DevicesRequest)
 func (UnimplementedWireguardRPCServer) Import(context.Context, *ImportRequest) (*ImportResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Import not implemented")
 }
+func (UnimplementedWireguardRPCServer) SuspendPeer(context.Context, *SuspendPeerRequest) (*SuspendPeerResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SuspendPeer not implemented")
+}
+func (UnimplementedWireguardRPCServer) ResumePeer(context.Context, *ResumePeerRequest) (*ResumePeerResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ResumePeer not implemented")
+}
+func (UnimplementedWireguardRPCServer) ListRevokedKeys(context.Context, *ListRevokedKeysRequest) (*ListRevokedKeysResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListRevokedKeys not implemented")
+}
+func (UnimplementedWireguardRPCServer) LiftRevocation(context.Context, *LiftRevocationRequest) (*LiftRevocationResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method LiftRevocation not implemented")
+}
+func (UnimplementedWireguardRPCServer) QueryAudit(context.Context, *QueryAuditRequest) (*QueryAuditResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method QueryAudit not implemented")
+}
+func (UnimplementedWireguardRPCServer) WatchPeers(*WatchPeersRequest, WireguardRPC_WatchPeersServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchPeers not implemented")
+}
 func (UnimplementedWireguardRPCServer) mustEmbedUnimplementedWireguardRPCServer() {}
 
 // UnsafeWireguardRPCServer may be embedded to opt out of forward compatibility for this service.
@@ -275,6 +382,117 @@ func _WireguardRPC_Import_Handler(srv interface{}, ctx context.Context, dec func
 	return interceptor(ctx, in, info, handler)
 }
 
+func _WireguardRPC_SuspendPeer_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SuspendPeerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WireguardRPCServer).SuspendPeer(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/wgrpcd.WireguardRPC/SuspendPeer",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WireguardRPCServer).SuspendPeer(ctx, req.(*SuspendPeerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _WireguardRPC_ResumePeer_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResumePeerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WireguardRPCServer).ResumePeer(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/wgrpcd.WireguardRPC/ResumePeer",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WireguardRPCServer).ResumePeer(ctx, req.(*ResumePeerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _WireguardRPC_ListRevokedKeys_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRevokedKeysRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WireguardRPCServer).ListRevokedKeys(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/wgrpcd.WireguardRPC/ListRevokedKeys",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WireguardRPCServer).ListRevokedKeys(ctx, req.(*ListRevokedKeysRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _WireguardRPC_LiftRevocation_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LiftRevocationRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WireguardRPCServer).LiftRevocation(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/wgrpcd.WireguardRPC/LiftRevocation",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WireguardRPCServer).LiftRevocation(ctx, req.(*LiftRevocationRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _WireguardRPC_QueryAudit_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QueryAuditRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WireguardRPCServer).QueryAudit(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/wgrpcd.WireguardRPC/QueryAudit",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WireguardRPCServer).QueryAudit(ctx, req.(*QueryAuditRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _WireguardRPC_WatchPeers_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchPeersRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(WireguardRPCServer).WatchPeers(m, &wireguardRPCWatchPeersServer{stream})
+}
+
+type WireguardRPC_WatchPeersServer interface {
+	Send(*PeerEvent) error
+	grpc.ServerStream
+}
+
+type wireguardRPCWatchPeersServer struct {
+	grpc.ServerStream
+}
+
+func (x *wireguardRPCWatchPeersServer) Send(m *PeerEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 var _WireguardRPC_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "wgrpcd.WireguardRPC",
 	HandlerType: (*WireguardRPCServer)(nil),
@@ -307,7 +525,33 @@ var _WireguardRPC_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Import",
 			Handler:    _WireguardRPC_Import_Handler,
 		},
+		{
+			MethodName: "SuspendPeer",
+			Handler:    _WireguardRPC_SuspendPeer_Handler,
+		},
+		{
+			MethodName: "ResumePeer",
+			Handler:    _WireguardRPC_ResumePeer_Handler,
+		},
+		{
+			MethodName: "ListRevokedKeys",
+			Handler:    _WireguardRPC_ListRevokedKeys_Handler,
+		},
+		{
+			MethodName: "LiftRevocation",
+			Handler:    _WireguardRPC_LiftRevocation_Handler,
+		},
+		{
+			MethodName: "QueryAudit",
+			Handler:    _WireguardRPC_QueryAudit_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchPeers",
+			Handler:       _WireguardRPC_WatchPeers_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "wgrpcd.proto",
 }
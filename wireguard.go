@@ -1,12 +1,35 @@
 package wgrpcd
 
 import (
+	"errors"
 	"net"
 
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
+var (
+	// ErrPeerNotFound is returned when a Wireguard device has no peer with the requested public key.
+	ErrPeerNotFound = errors.New("peer not found")
+)
+
+// wireguardClient is the part of wgctrl.Client that Wireguard uses.
+type wireguardClient interface {
+	Close() error
+	Devices() ([]*wgtypes.Device, error)
+	Device(name string) (*wgtypes.Device, error)
+	ConfigureDevice(name string, cfg wgtypes.Config) error
+}
+
+// newWireguardClient opens a client for the machine's Wireguard devices. Tests replace it so they can run without one.
+var newWireguardClient = func() (wireguardClient, error) {
+	client, err := wgctrl.New()
+	if err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
 // Wireguard represents a wireguard interface.
 // It is simply a struct with the device name.
 // Each call will attempt to control the device and return os.IsNotExist if the named device cannot be found.
@@ -19,7 +42,7 @@ type Wireguard struct {
 
 // New returns a new Wireguard controller.
 func New(deviceName string) (*Wireguard, error) {
-	client, err := wgctrl.New()
+	client, err := newWireguardClient()
 	if err != nil {
 		return nil, err
 	}
@@ -40,7 +63,7 @@ func New(deviceName string) (*Wireguard, error) {
 // Devices shows all Wireguard interfaces.
 func Devices() ([]*Wireguard, error) {
 	wireguardDevices := []*Wireguard{}
-	client, err := wgctrl.New()
+	client, err := newWireguardClient()
 	if err != nil {
 		return wireguardDevices, err
 	}
@@ -71,7 +94,7 @@ func (w Wireguard) String() string {
 // ChangeListenPort updates the listening port wireguard is running on.
 // It can be used to allow coordination with a firewall.
 func (w Wireguard) ChangeListenPort(port int) error {
-	client, err := wgctrl.New()
+	client, err := newWireguardClient()
 	if err != nil {
 		return err
 	}
@@ -92,7 +115,7 @@ func (w Wireguard) ChangeListenPort(port int) error {
 
 // AddNewPeer adds a new Wireguard peer to the VPN.
 func (w Wireguard) AddNewPeer(allowedIPs []net.IPNet, publicKey wgtypes.Key) (*wgtypes.PeerConfig, error) {
-	client, err := wgctrl.New()
+	client, err := newWireguardClient()
 	if err != nil {
 		return nil, err
 	}
@@ -122,7 +145,7 @@ func (w Wireguard) AddNewPeer(allowedIPs []net.IPNet, publicKey wgtypes.Key) (*w
 
 // RekeyClient revokes a client's old public key and replaces it with a new one.
 func (w Wireguard) RekeyClient(allowedIPs []net.IPNet, oldPublicKey, newPublicKey wgtypes.Key) (*wgtypes.PeerConfig, error) {
-	client, err := wgctrl.New()
+	client, err := newWireguardClient()
 	if err != nil {
 		return nil, err
 	}
@@ -156,7 +179,7 @@ func (w Wireguard) RekeyClient(allowedIPs []net.IPNet, oldPublicKey, newPublicKe
 
 // RemovePeer deletes a peer from the Wireguard interface.
 func (w Wireguard) RemovePeer(publicKey wgtypes.Key) error {
-	client, err := wgctrl.New()
+	client, err := newWireguardClient()
 	if err != nil {
 		return err
 	}
@@ -181,7 +204,7 @@ func (w Wireguard) RemovePeer(publicKey wgtypes.Key) error {
 
 // Peers returns all peers from a Wireguard device.
 func (w Wireguard) Peers() ([]wgtypes.Peer, error) {
-	client, err := wgctrl.New()
+	client, err := newWireguardClient()
 	if err != nil {
 		return []wgtypes.Peer{}, err
 	}
@@ -193,3 +216,39 @@ func (w Wireguard) Peers() ([]wgtypes.Peer, error) {
 	}
 	return device.Peers, nil
 }
+
+// Peer returns a single peer from a Wireguard device, or ErrPeerNotFound if the device has no peer with that public key.
+func (w Wireguard) Peer(publicKey wgtypes.Key) (*wgtypes.Peer, error) {
+	peers, err := w.Peers()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, peer := range peers {
+		if peer.PublicKey == publicKey {
+			return &peer, nil
+		}
+	}
+	return nil, ErrPeerNotFound
+}
+
+// RestorePeer adds a peer to the Wireguard interface with a previously saved configuration.
+func (w Wireguard) RestorePeer(peerConfig wgtypes.PeerConfig) error {
+	client, err := newWireguardClient()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	device, err := client.Device(w.DeviceName)
+	if err != nil {
+		return err
+	}
+
+	peerConfig.ReplaceAllowedIPs = true
+	config := wgtypes.Config{
+		ReplacePeers: false,
+		Peers:        []wgtypes.PeerConfig{peerConfig},
+	}
+	return client.ConfigureDevice(device.Name, config)
+}